@@ -0,0 +1,184 @@
+// recordtool 是录像文件的命令行工具，不需要启动服务即可查看、修复、转换和截取录像文件
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"m7s.live/plugin/record/v4/recordfile"
+)
+
+const usage = `usage: recordtool <command> [options]
+
+commands:
+  list    [-probe] <dir>                        列出目录下的录像文件
+  probe   <file>...                             输出录像文件信息
+  verify  [-gap 1000] [-v] <file>...            检查录像文件是否完整
+  repair  [-o output] <file>                    修复录像文件，默认输出到<file>.repaired.<ext>
+  convert [-f format] -o output <file>...       转换格式，多个文件按顺序合并，format支持flv、mp4、fmp4、ts
+  cut     [-f format] -ss 10s -t 30s -o output <file>...  截取时间范围
+`
+
+func main() {
+	if len(os.Args) < 2 {
+		fmt.Fprint(os.Stderr, usage)
+		os.Exit(2)
+	}
+	var err error
+	args := os.Args[2:]
+	switch os.Args[1] {
+	case "list":
+		err = list(args)
+	case "probe":
+		err = probe(args)
+	case "verify":
+		err = verify(args)
+	case "repair":
+		err = repair(args)
+	case "convert":
+		err = convert(args, false)
+	case "cut":
+		err = convert(args, true)
+	default:
+		fmt.Fprint(os.Stderr, usage)
+		os.Exit(2)
+	}
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+}
+
+func printJSON(v any) {
+	encoder := json.NewEncoder(os.Stdout)
+	encoder.SetIndent("", "  ")
+	encoder.Encode(v)
+}
+
+func list(args []string) error {
+	flags := flag.NewFlagSet("list", flag.ExitOnError)
+	withProbe := flags.Bool("probe", false, "读取每个文件获取时长")
+	flags.Parse(args)
+	dir := flags.Arg(0)
+	if dir == "" {
+		dir = "."
+	}
+	return filepath.Walk(dir, func(path string, info os.FileInfo, err error) error {
+		if err != nil || info.IsDir() || recordfile.FormatByExt(path) == "" {
+			return err
+		}
+		line := fmt.Sprintf("%s\t%d\t%s", path, info.Size(), info.ModTime().Format("2006-01-02 15:04:05"))
+		if *withProbe {
+			if probeInfo, err := recordfile.ProbeFile(path); err == nil {
+				line += "\t" + (time.Duration(probeInfo.Duration) * time.Millisecond).String()
+			} else {
+				line += "\t" + err.Error()
+			}
+		}
+		fmt.Println(line)
+		return nil
+	})
+}
+
+func probe(args []string) error {
+	if len(args) == 0 {
+		return fmt.Errorf("no file")
+	}
+	for _, file := range args {
+		info, err := recordfile.ProbeFile(file)
+		if err != nil {
+			return fmt.Errorf("%s: %w", file, err)
+		}
+		printJSON(info)
+	}
+	return nil
+}
+
+func verify(args []string) error {
+	flags := flag.NewFlagSet("verify", flag.ExitOnError)
+	gap := flags.Uint("gap", 1000, "判断时间戳跳跃的阈值(毫秒)，0表示不检查")
+	detail := flags.Bool("v", false, "输出完整的检查报告")
+	flags.Parse(args)
+	if flags.NArg() == 0 {
+		return fmt.Errorf("no file")
+	}
+	var failed int
+	for _, file := range flags.Args() {
+		report, err := recordfile.VerifyFile(file, uint32(*gap))
+		if err != nil {
+			fmt.Printf("%s\tFAIL\t%v\n", file, err)
+			failed++
+			continue
+		}
+		if *detail {
+			printJSON(report)
+		}
+		if report.Healthy {
+			fmt.Printf("%s\tOK\t%s\n", file, time.Duration(report.Duration)*time.Millisecond)
+			continue
+		}
+		failed++
+		fmt.Printf("%s\tFAIL\t%d issue(s)\n", file, report.IssueCount)
+		if !*detail {
+			for _, issue := range report.Issues {
+				fmt.Printf("\t%s\t%s\n", issue.Type, issue.Message)
+			}
+		}
+	}
+	if failed > 0 {
+		return fmt.Errorf("%d file(s) failed", failed)
+	}
+	return nil
+}
+
+func repair(args []string) error {
+	flags := flag.NewFlagSet("repair", flag.ExitOnError)
+	output := flags.String("o", "", "输出文件")
+	flags.Parse(args)
+	input := flags.Arg(0)
+	if input == "" {
+		return fmt.Errorf("no file")
+	}
+	if *output == "" {
+		ext := filepath.Ext(input)
+		*output = strings.TrimSuffix(input, ext) + ".repaired" + ext
+	}
+	duration, err := recordfile.RepairFile(input, *output)
+	if err != nil {
+		return err
+	}
+	fmt.Printf("%s\t%s\n", *output, time.Duration(duration)*time.Millisecond)
+	return nil
+}
+
+func convert(args []string, cut bool) error {
+	flags := flag.NewFlagSet("convert", flag.ExitOnError)
+	output := flags.String("o", "", "输出文件")
+	format := flags.String("f", "", "输出格式，默认根据输出文件扩展名判断")
+	var offset, duration time.Duration
+	if cut {
+		flags.DurationVar(&offset, "ss", 0, "起始时间，相对第一个文件")
+		flags.DurationVar(&duration, "t", 0, "截取时长，0表示到最后")
+	}
+	flags.Parse(args)
+	if flags.NArg() == 0 {
+		return fmt.Errorf("no file")
+	}
+	if *output == "" {
+		return fmt.Errorf("no output")
+	}
+	if *format == "" {
+		*format = recordfile.FormatByExt(*output)
+	}
+	lastTs, err := recordfile.ConvertFile(flags.Args(), *output, *format, offset, duration)
+	if err != nil {
+		return err
+	}
+	fmt.Printf("%s\t%s\n", *output, time.Duration(lastTs)*time.Millisecond)
+	return nil
+}
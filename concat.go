@@ -0,0 +1,165 @@
+package record
+
+import (
+	"fmt"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"go.uber.org/zap"
+	"m7s.live/engine/v4/util"
+	"m7s.live/plugin/record/v4/recordfile"
+)
+
+// 合并结果
+type ConcatResult struct {
+	FilePath string   `json:"filePath"`
+	Size     int64    `json:"size"`
+	Duration uint32   `json:"duration"`
+	Sources  []string `json:"sources"`
+	Replaced bool     `json:"replaced"`
+}
+
+// 合并后删除原文件，并更新录像目录中的记录
+func replaceConcatSources(streamPath, format, recordPath string, sources []string, output string, duration uint32) (err error) {
+	var eventRecords []EventRecord
+	db.Where("filepath IN ?", sources).Order("id").Find(&eventRecords)
+	eventRecord := EventRecord{StreamPath: streamPath, RecordMode: "0", BeforeDuration: "0", AfterDuration: "0", Fragment: "0", Type: format}
+	if len(eventRecords) > 0 {
+		first, last := eventRecords[0], eventRecords[len(eventRecords)-1]
+		eventRecord.RecordMode = first.RecordMode
+		eventRecord.EventLevel = first.EventLevel
+		eventRecord.CreateTime = first.CreateTime
+		eventRecord.StartTime = first.StartTime
+		eventRecord.EndTime = last.EndTime
+	} else {
+		endTime := time.Now()
+		if info, err := os.Stat(output); err == nil {
+			endTime = info.ModTime()
+		}
+		eventRecord.EndTime = endTime.Format("2006-01-02 15:04:05")
+		eventRecord.StartTime = endTime.Add(-time.Duration(duration) * time.Millisecond).Format("2006-01-02 15:04:05")
+		eventRecord.CreateTime = eventRecord.StartTime
+	}
+	eventRecord.Filepath = output
+	eventRecord.Filename = filepath.Base(output)
+	eventRecord.Urlpath = "record/" + strings.TrimPrefix(filepath.ToSlash(output), filepath.ToSlash(recordPath)+"/")
+	if err = db.Omit("id", "isDelete").Create(&eventRecord).Error; err != nil {
+		return
+	}
+	if len(eventRecords) > 0 {
+		db.Delete(&eventRecords)
+	}
+	for _, source := range sources {
+		if err := os.Remove(source); err != nil {
+			plugin.Error("remove concat source failed", zap.String("file", source), zap.Error(err))
+		}
+	}
+	return
+}
+
+// 合并分片录像，file为录像目录下的相对路径，可以有多个；或者用streamPath、start和end指定时间范围
+// format为输出格式，支持flv、mp4、fmp4、ts、ps，replace表示合并后删除原文件并更新录像记录
+// 不替换时合并结果写到导出目录，否则按时间范围回放、导出和合并时会同时找到合并结果和原文件
+func (conf *RecordConfig) API_concat(w http.ResponseWriter, r *http.Request) {
+	query := r.URL.Query()
+	t := query.Get("type")
+	if t == "" {
+		t = "flv"
+	}
+	recorder := conf.getRecorderConfigByType(t)
+	if recorder == nil || (t != "flv" && t != "mp4" && t != "ts" && t != "ps") {
+		http.Error(w, "type not supported", http.StatusBadRequest)
+		return
+	}
+	format := query.Get("format")
+	if format == "" {
+		format = t
+	}
+	if format != "flv" && format != "mp4" && format != "fmp4" && format != "ts" && format != "ps" {
+		http.Error(w, "format not supported", http.StatusBadRequest)
+		return
+	}
+	streamPath := query.Get("streamPath")
+	var sources []string
+	if fileNames := query["file"]; len(fileNames) > 0 {
+		for _, fileName := range fileNames {
+			sources = append(sources, filepath.Join(recorder.Path, filepath.Clean("/"+fileName)))
+		}
+	} else if streamPath != "" {
+		startTime, err := time.ParseInLocation("20060102150405", query.Get("start"), time.Local)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		endTime, err := time.ParseInLocation("20060102150405", query.Get("end"), time.Local)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		dir := filepath.Join(recorder.Path, streamPath)
+		fileList, _, found := findRecordFiles(dir, recorder.Ext, startTime, endTime)
+		if !found {
+			util.ReturnError(util.APIErrorNotFound, ErrNoRecordFile.Error(), w, r)
+			return
+		}
+		for _, info := range fileList {
+			sources = append(sources, filepath.Join(dir, info.Name()))
+		}
+	} else {
+		http.Error(w, "no file or streamPath", http.StatusBadRequest)
+		return
+	}
+	for _, source := range sources {
+		if !util.Exist(source) {
+			util.ReturnError(util.APIErrorNotFound, "no such file: "+source, w, r)
+			return
+		}
+	}
+	ext := "." + format
+	if format == "fmp4" {
+		ext = ".mp4"
+	}
+	output := query.Get("fileName")
+	if output == "" {
+		first := filepath.Base(sources[0])
+		output = fmt.Sprintf("%s_merged%s", strings.TrimSuffix(first, filepath.Ext(first)), ext)
+	}
+	replace := query.Get("replace") != ""
+	if replace {
+		output = filepath.Join(filepath.Dir(sources[0]), filepath.Base(output))
+	} else {
+		output = filepath.Join(conf.ExportPath, filepath.Base(output))
+		os.MkdirAll(conf.ExportPath, 0766)
+	}
+	// 输出先写入临时文件再改名，与输入同名时会在读取完之前覆盖输入
+	for _, source := range sources {
+		if filepath.Clean(source) == filepath.Clean(output) {
+			http.Error(w, "fileName is one of the sources", http.StatusBadRequest)
+			return
+		}
+	}
+	plugin.Info("concat", zap.Strings("sources", sources), zap.String("output", output))
+	duration, err := recordfile.ConvertFile(sources, output, format, 0, 0)
+	if err != nil {
+		util.ReturnError(util.APIErrorInternal, err.Error(), w, r)
+		return
+	}
+	result := &ConcatResult{FilePath: output, Duration: duration, Sources: sources}
+	if replace {
+		if streamPath == "" {
+			streamPath = strings.TrimPrefix(filepath.ToSlash(filepath.Dir(output)), filepath.ToSlash(recorder.Path)+"/")
+		}
+		if err = replaceConcatSources(streamPath, format, recorder.Path, sources, output, duration); err != nil {
+			util.ReturnError(util.APIErrorInternal, err.Error(), w, r)
+			return
+		}
+		result.Replaced = true
+	}
+	if info, err := os.Stat(output); err == nil {
+		result.Size = info.Size()
+	}
+	util.ReturnValue(result, w, r)
+}
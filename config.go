@@ -11,6 +11,7 @@ import (
 	"sync"
 	"time"
 
+	"go.uber.org/zap"
 	"m7s.live/engine/v4/config"
 	"m7s.live/engine/v4/util"
 )
@@ -52,25 +53,43 @@ type VideoFileInfo struct {
 }
 
 type Record struct {
-	Ext           string        `desc:"文件扩展名"`       //文件扩展名
-	Path          string        `desc:"存储文件的目录"`     //存储文件的目录
-	AutoRecord    bool          `desc:"是否自动录制"`      //是否自动录制
-	Filter        config.Regexp `desc:"录制过滤器"`       //录制过滤器
-	Fragment      time.Duration `desc:"分片大小，0表示不分片"` //分片大小，0表示不分片
-	http.Handler  `json:"-" yaml:"-"`
-	CreateFileFn  func(filename string, append bool) (FileWr, error) `json:"-" yaml:"-"`
-	GetDurationFn func(file io.ReadSeeker) uint32                    `json:"-" yaml:"-"`
+	Ext                    string        `desc:"文件扩展名"`       //文件扩展名
+	Path                   string        `desc:"存储文件的目录"`     //存储文件的目录
+	AutoRecord             bool          `desc:"是否自动录制"`      //是否自动录制
+	Filter                 config.Regexp `desc:"录制过滤器"`       //录制过滤器
+	Fragment               time.Duration `desc:"分片大小，0表示不分片"` //分片大小，0表示不分片
+	Discontinuity          string        `desc:"时间戳不连续时的处理方式，rebase重写时间戳保持连续，split在下一个关键帧切分新文件(需要开启分片)，空表示不处理"`
+	DiscontinuityThreshold time.Duration `desc:"时间戳跳跃超过该值视为不连续，默认5s"`
+	ReconnectGrace         time.Duration `desc:"断流后等待重新推流的时长，期间继续写入同一个文件，0表示不等待，支持flv、mp4、fmp4"`
+	Tracks                 string        `desc:"录制的轨道，video只录视频，audio只录音频，也可以指定轨道名称，多个用逗号分隔，空表示录制所有轨道"`
+	DropUnsupportedAudio   bool          `desc:"丢弃该格式无法存储的音频编码，避免生成无法播放的文件"`
+	Rules                  []RecordRule  `desc:"自动录制规则，按顺序使用第一个匹配的规则，配置后不再使用Filter"`
+	http.Handler           `json:"-" yaml:"-"`
+	CreateFileFn           func(filename string, append bool) (FileWr, error) `json:"-" yaml:"-"`
+	GetDurationFn          func(file io.ReadSeeker) uint32                    `json:"-" yaml:"-"`
 }
 
 func (r *Record) NeedRecord(streamPath string) bool {
-	return r.AutoRecord && (!r.Filter.Valid() || r.Filter.MatchString(streamPath))
+	_, ok := r.MatchRule(streamPath)
+	return ok
 }
 
 func (r *Record) Init() {
 	os.MkdirAll(r.Path, 0766)
+	if r.DiscontinuityThreshold <= 0 {
+		r.DiscontinuityThreshold = 5 * time.Second
+	}
+	for i := range r.Rules {
+		if err := r.Rules[i].init(); err != nil {
+			// 规则不生效，不能当作匹配所有的流
+			plugin.Error("invalid record rule, disabled", zap.String("filter", r.Rules[i].Filter), zap.String("path", r.Rules[i].Path), zap.Error(err))
+		}
+	}
 	r.Handler = http.FileServer(http.Dir(r.Path))
+	// 录像持有配置的副本，不能引用r，配置被API替换后r会被修改
+	dir := r.Path
 	r.CreateFileFn = func(filename string, append bool) (file FileWr, err error) {
-		filePath := filepath.Join(r.Path, filename)
+		filePath := filepath.Join(dir, filename)
 		if err = os.MkdirAll(filepath.Dir(filePath), 0766); err != nil {
 			return file, err
 		}
@@ -104,7 +123,7 @@ func (r *Record) Tree(dstPath string, level int) (files []*VideoFileInfo, err er
 		return
 	}
 	if !fileInfo.IsDir() { //如果dstF是文件
-		if r.Ext == "." || path.Ext(fileInfo.Name()) == r.Ext {
+		if (r.Ext == "." || path.Ext(fileInfo.Name()) == r.Ext || mkvExtMatch(r.Ext, path.Ext(fileInfo.Name()))) && !(r.Ext == ".m3u8" && isHLSAuxPlaylist(fileInfo.Name())) {
 			//p := strings.TrimPrefix(dstPath, r.Path)
 			p := strings.ReplaceAll(dstPath, "\\", "/")
 			var duration uint32
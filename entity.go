@@ -46,3 +46,81 @@ type FLVKeyframe struct {
 	FrameAbstime uint32    `gorm:"not null"`
 	CreatedAt    time.Time `gorm:"autoCreateTime"`
 }
+
+// 录像导出任务
+type ExportJob struct {
+	Id         uint    `json:"id" desc:"自增长id" gorm:"primaryKey;autoIncrement"`
+	StreamPath string  `json:"streamPath" desc:"流路径" gorm:"type:varchar(255);comment:流路径"`
+	Type       string  `json:"type" desc:"源录像文件类型" gorm:"type:varchar(255);comment:源录像文件类型,flv,mp4"`
+	Format     string  `json:"format" desc:"导出文件格式" gorm:"type:varchar(255);comment:导出文件格式,flv,mp4,fmp4"`
+	StartTime  string  `json:"startTime" desc:"导出开始时间" gorm:"type:varchar(255);comment:导出开始时间"`
+	EndTime    string  `json:"endTime" desc:"导出结束时间" gorm:"type:varchar(255);comment:导出结束时间"`
+	Status     string  `json:"status" desc:"任务状态" gorm:"type:varchar(255);comment:任务状态,waiting,running,done,failed,canceled"`
+	Progress   float64 `json:"progress" desc:"导出进度" gorm:"comment:导出进度,0到1"`
+	Filepath   string  `json:"filePath" desc:"导出文件物理路径" gorm:"type:varchar(255);comment:导出文件物理路径"`
+	Size       int64   `json:"size" desc:"导出文件大小" gorm:"comment:导出文件大小"`
+	ErrorMsg   string  `json:"errorMsg" desc:"失败原因" gorm:"type:varchar(255);comment:失败原因"`
+	CreateTime string  `json:"createTime" desc:"创建时间" gorm:"type:varchar(255);comment:创建时间"`
+	FinishTime string  `json:"finishTime" desc:"完成时间" gorm:"type:varchar(255);comment:完成时间"`
+}
+
+// 录像时间戳不连续的记录
+type Discontinuity struct {
+	Id         uint   `json:"id" desc:"自增长id" gorm:"primaryKey;autoIncrement"`
+	StreamPath string `json:"streamPath" desc:"流路径" gorm:"type:varchar(255);comment:流路径"`
+	Type       string `json:"type" desc:"录像类型" gorm:"type:varchar(255);comment:录像类型,flv,mp4,fmp4"`
+	Filepath   string `json:"filePath" desc:"正在写入的录像文件" gorm:"type:varchar(255);comment:正在写入的录像文件"`
+	Track      string `json:"track" desc:"轨道" gorm:"type:varchar(255);comment:轨道,video,audio"`
+	LastTs     uint32 `json:"lastTs" desc:"上一帧的原始时间戳" gorm:"comment:上一帧的原始时间戳"`
+	Ts         uint32 `json:"ts" desc:"当前帧的原始时间戳" gorm:"comment:当前帧的原始时间戳"`
+	Jump       int64  `json:"jump" desc:"时间戳跳跃量(毫秒)，负数表示回退" gorm:"comment:时间戳跳跃量(毫秒)，负数表示回退"`
+	Action     string `json:"action" desc:"处理方式" gorm:"type:varchar(255);comment:处理方式,rebase,split"`
+	CreateTime string `json:"createTime" desc:"发生时间" gorm:"type:varchar(255);comment:发生时间"`
+}
+
+// 通过API启动的录像，服务重启后流发布时自动恢复，主动停止后删除
+type ActiveRecording struct {
+	Id         uint   `json:"id" desc:"自增长id" gorm:"primaryKey;autoIncrement"`
+	RecorderId string `json:"recorderId" desc:"录像id" gorm:"type:varchar(255);uniqueIndex;comment:录像id"`
+	Type       string `json:"type" desc:"录像类型" gorm:"type:varchar(255);comment:录像类型,flv,mp4,fmp4,hls,raw,raw_audio"`
+	StreamPath string `json:"streamPath" desc:"流路径" gorm:"type:varchar(255);comment:流路径"`
+	Fragment   string `json:"fragment" desc:"切片大小" gorm:"type:varchar(255);comment:切片大小"`
+	FileName   string `json:"fileName" desc:"自定义文件名" gorm:"type:varchar(255);comment:自定义文件名"`
+	Append     bool   `json:"append" desc:"是否追加模式" gorm:"comment:是否追加模式"`
+	Tracks     string `json:"tracks" desc:"录制的轨道" gorm:"type:varchar(255);comment:录制的轨道,video,audio或轨道名称"`
+	DropAudio  string `json:"dropAudio" desc:"是否丢弃无法存储的音频编码" gorm:"type:varchar(255);comment:是否丢弃无法存储的音频编码,1丢弃,0保留,空表示使用配置"`
+	Deadline   string `json:"deadline" desc:"定时录像的截止时间" gorm:"type:varchar(255);comment:定时录像的截止时间,空表示不限时"`
+	CreateTime string `json:"createTime" desc:"启动时间" gorm:"type:varchar(255);comment:启动时间"`
+}
+
+// 录像计划，在指定的时间段自动录制匹配的流
+type RecordPlan struct {
+	Id            uint   `json:"id" desc:"自增长id" gorm:"primaryKey;autoIncrement"`
+	Name          string `json:"name" desc:"计划名称" gorm:"type:varchar(255);comment:计划名称"`
+	StreamPattern string `json:"streamPattern" desc:"流路径正则表达式" gorm:"type:varchar(255);comment:流路径正则表达式"`
+	Type          string `json:"type" desc:"录像类型" gorm:"type:varchar(255);comment:录像类型,flv,mp4,fmp4,hls,raw,raw_audio"`
+	Fragment      string `json:"fragment" desc:"切片大小" gorm:"type:varchar(255);comment:切片大小"`
+	Windows       string `json:"windows" desc:"每天录像的时间段" gorm:"type:varchar(255);comment:每天录像的时间段,例如08:00-12:00,22:00-06:00,空表示全天"`
+	Weekdays      string `json:"weekdays" desc:"录像的星期" gorm:"type:varchar(255);comment:录像的星期,0表示周日,例如1,2,3,4,5,空表示每天"`
+	ExcludeDates  string `json:"excludeDates" desc:"不录像的日期" gorm:"type:varchar(1024);comment:不录像的日期,例如2024-10-01,2024-10-02"`
+	Enable        bool   `json:"enable" desc:"是否启用" gorm:"comment:是否启用"`
+	CreateTime    string `json:"createTime" desc:"创建时间" gorm:"type:varchar(255);comment:创建时间"`
+}
+
+// 通过API修改的录制配置，启动时覆盖配置文件中的值
+type RecordSetting struct {
+	Id         uint   `json:"id" desc:"自增长id" gorm:"primaryKey;autoIncrement"`
+	Type       string `json:"type" desc:"录像类型" gorm:"type:varchar(255);uniqueIndex;comment:录像类型,flv,mp4,fmp4,hls,raw,raw_audio"`
+	Settings   string `json:"settings" desc:"配置内容" gorm:"type:text;comment:配置内容,json格式"`
+	UpdateTime string `json:"updateTime" desc:"修改时间" gorm:"type:varchar(255);comment:修改时间"`
+}
+
+// hls录像加密使用的密钥，通过密钥接口获取
+type HLSKey struct {
+	Id         uint   `json:"id" desc:"自增长id" gorm:"primaryKey;autoIncrement"`
+	KeyId      string `json:"keyId" desc:"密钥id" gorm:"type:varchar(255);uniqueIndex;comment:密钥id,m3u8中密钥地址的id参数"`
+	StreamPath string `json:"streamPath" desc:"流路径" gorm:"type:varchar(255);comment:流路径"`
+	Method     string `json:"method" desc:"加密方式" gorm:"type:varchar(255);comment:加密方式,AES-128或SAMPLE-AES"`
+	Key        string `json:"-" desc:"密钥" gorm:"type:varchar(255);comment:密钥,16字节的十六进制"`
+	CreateTime string `json:"createTime" desc:"创建时间" gorm:"type:varchar(255);comment:创建时间"`
+}
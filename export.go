@@ -0,0 +1,310 @@
+package record
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"go.uber.org/zap"
+	"m7s.live/engine/v4/util"
+	"m7s.live/plugin/record/v4/recordfile"
+)
+
+const (
+	ExportStatusWaiting  = "waiting"
+	ExportStatusRunning  = "running"
+	ExportStatusDone     = "done"
+	ExportStatusFailed   = "failed"
+	ExportStatusCanceled = "canceled"
+)
+
+var ErrExportQueueFull = errors.New("export queue is full")
+
+// 工作协程修改任务状态时，查询接口可能同时在读取，都需要加锁，查询接口返回副本
+type exportTask struct {
+	mu     sync.Mutex
+	job    ExportJob
+	ctx    context.Context
+	cancel context.CancelFunc
+}
+
+// 修改任务并保存到数据库
+func (task *exportTask) update(fn func(job *ExportJob)) {
+	task.mu.Lock()
+	fn(&task.job)
+	job := task.job
+	task.mu.Unlock()
+	db.Save(&job)
+}
+
+func (task *exportTask) snapshot() ExportJob {
+	task.mu.Lock()
+	defer task.mu.Unlock()
+	return task.job
+}
+
+var exportQueue = make(chan *exportTask, 1024)
+var exportWorkersOnce sync.Once
+
+// 启动导出任务的工作协程，服务重启前未完成的任务标记为失败
+func (conf *RecordConfig) startExportWorkers() {
+	exportWorkersOnce.Do(func() {
+		os.MkdirAll(conf.ExportPath, 0766)
+		db.Model(&ExportJob{}).Where("status IN ?", []string{ExportStatusWaiting, ExportStatusRunning}).
+			Updates(map[string]any{"status": ExportStatusFailed, "error_msg": "服务重启，导出中断"})
+		workers := conf.ExportWorkers
+		if workers <= 0 {
+			workers = 1
+		}
+		for i := 0; i < workers; i++ {
+			go func() {
+				for task := range exportQueue {
+					conf.runExport(task)
+				}
+			}()
+		}
+	})
+}
+
+func (conf *RecordConfig) runExport(task *exportTask) {
+	job := task.snapshot()
+	defer conf.exportTasks.Delete(job.Id)
+	if task.ctx.Err() != nil {
+		return
+	}
+	task.update(func(job *ExportJob) {
+		job.Status = ExportStatusRunning
+	})
+	plugin.Info("export start", zap.Uint("id", job.Id), zap.String("stream", job.StreamPath), zap.String("format", job.Format))
+	err := conf.export(task, &job)
+	finishTime := time.Now().Format("2006-01-02 15:04:05")
+	switch {
+	case task.ctx.Err() != nil:
+		os.Remove(job.Filepath)
+		task.update(func(job *ExportJob) {
+			job.Status = ExportStatusCanceled
+			job.FinishTime = finishTime
+		})
+	case err != nil:
+		os.Remove(job.Filepath)
+		task.update(func(job *ExportJob) {
+			job.Status = ExportStatusFailed
+			job.ErrorMsg = err.Error()
+			job.FinishTime = finishTime
+		})
+		plugin.Error("export failed", zap.Uint("id", job.Id), zap.Error(err))
+		exceptionChannel <- &Exception{AlarmType: "export", AlarmDesc: "录像导出文件中断", StreamPath: job.StreamPath}
+	default:
+		var size int64
+		if info, err := os.Stat(job.Filepath); err == nil {
+			size = info.Size()
+		}
+		task.update(func(job *ExportJob) {
+			job.Status = ExportStatusDone
+			job.Progress = 1
+			job.Size = size
+			job.FinishTime = finishTime
+		})
+		plugin.Info("export done", zap.Uint("id", job.Id), zap.String("file", job.Filepath))
+	}
+}
+
+// job为任务开始时的副本，只读取不修改
+func (conf *RecordConfig) export(task *exportTask, job *ExportJob) (err error) {
+	recorder := conf.getRecorderConfigByType(job.Type)
+	startTime, err := time.ParseInLocation("2006-01-02 15:04:05", job.StartTime, time.Local)
+	if err != nil {
+		return
+	}
+	endTime, err := time.ParseInLocation("2006-01-02 15:04:05", job.EndTime, time.Local)
+	if err != nil {
+		return
+	}
+	dir := filepath.Join(recorder.Path, job.StreamPath)
+	fileList, offsetTime, found := findRecordFiles(dir, recorder.Ext, startTime, endTime)
+	if !found {
+		return ErrNoRecordFile
+	}
+	reader := &recordfile.ConcatTagReader{Offset: offsetTime, Duration: endTime.Sub(startTime)}
+	for _, info := range fileList {
+		reader.Files = append(reader.Files, filepath.Join(dir, info.Name()))
+	}
+	defer reader.Close()
+	writer, err := recordfile.CreateTagWriter(job.Filepath, job.Format)
+	if err != nil {
+		return
+	}
+	total := float64(endTime.Sub(startTime).Milliseconds())
+	lastUpdate := time.Now()
+	for task.ctx.Err() == nil {
+		var tag *recordfile.FLVTag
+		if tag, err = reader.ReadTag(); err != nil {
+			break
+		}
+		if err = writer.WriteTag(tag); err != nil {
+			break
+		}
+		if time.Since(lastUpdate) > time.Second {
+			lastUpdate = time.Now()
+			progress := float64(tag.Timestamp) / total
+			task.mu.Lock()
+			task.job.Progress = progress
+			task.mu.Unlock()
+			db.Model(&ExportJob{}).Where("id = ?", job.Id).Update("progress", progress)
+		}
+	}
+	if closeErr := writer.Close(); err == nil || err == io.EOF {
+		err = closeErr
+	}
+	return
+}
+
+// 提交导出任务，start和end格式为20060102150405，format支持flv、mp4、fmp4、ts、ps
+func (conf *RecordConfig) API_export_submit(w http.ResponseWriter, r *http.Request) {
+	query := r.URL.Query()
+	streamPath := query.Get("streamPath")
+	if streamPath == "" {
+		http.Error(w, "no streamPath", http.StatusBadRequest)
+		return
+	}
+	t := query.Get("type")
+	if t == "" {
+		t = "flv"
+	}
+	if t != "flv" && t != "mp4" && t != "ts" && t != "ps" {
+		http.Error(w, "type not supported", http.StatusBadRequest)
+		return
+	}
+	format := query.Get("format")
+	if format == "" {
+		format = t
+	}
+	if format != "flv" && format != "mp4" && format != "fmp4" && format != "ts" && format != "ps" {
+		http.Error(w, "format not supported", http.StatusBadRequest)
+		return
+	}
+	startTime, err := time.ParseInLocation("20060102150405", query.Get("start"), time.Local)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	endTime, err := time.ParseInLocation("20060102150405", query.Get("end"), time.Local)
+	if err != nil || !endTime.After(startTime) {
+		http.Error(w, "end parameter error", http.StatusBadRequest)
+		return
+	}
+	job := &ExportJob{
+		StreamPath: streamPath,
+		Type:       t,
+		Format:     format,
+		StartTime:  startTime.Format("2006-01-02 15:04:05"),
+		EndTime:    endTime.Format("2006-01-02 15:04:05"),
+		Status:     ExportStatusWaiting,
+		CreateTime: time.Now().Format("2006-01-02 15:04:05"),
+	}
+	if err = db.Create(job).Error; err != nil {
+		util.ReturnError(util.APIErrorInternal, err.Error(), w, r)
+		return
+	}
+	ext := "." + format
+	if format == "fmp4" {
+		ext = ".mp4"
+	}
+	job.Filepath = filepath.Join(conf.ExportPath, fmt.Sprintf("%s_%s_%s_%d%s", strings.ReplaceAll(streamPath, "/", "-"), startTime.Format("20060102150405"), endTime.Format("20060102150405"), job.Id, ext))
+	db.Model(job).Update("filepath", job.Filepath)
+	task := &exportTask{job: *job}
+	task.ctx, task.cancel = context.WithCancel(context.Background())
+	conf.exportTasks.Store(job.Id, task)
+	select {
+	case exportQueue <- task:
+	default:
+		conf.exportTasks.Delete(job.Id)
+		task.update(func(job *ExportJob) {
+			job.Status = ExportStatusFailed
+			job.ErrorMsg = ErrExportQueueFull.Error()
+		})
+		util.ReturnError(util.APIErrorInternal, ErrExportQueueFull.Error(), w, r)
+		return
+	}
+	util.ReturnValue(task.snapshot(), w, r)
+}
+
+func (conf *RecordConfig) getExportJob(r *http.Request) (job *ExportJob, err error) {
+	id, err := strconv.Atoi(r.URL.Query().Get("id"))
+	if err != nil {
+		return
+	}
+	if task, ok := conf.exportTasks.Load(uint(id)); ok {
+		snapshot := task.(*exportTask).snapshot()
+		return &snapshot, nil
+	}
+	job = &ExportJob{}
+	err = db.First(job, id).Error
+	return
+}
+
+func (conf *RecordConfig) API_export_status(w http.ResponseWriter, r *http.Request) {
+	job, err := conf.getExportJob(r)
+	if err != nil {
+		util.ReturnError(util.APIErrorNotFound, err.Error(), w, r)
+		return
+	}
+	util.ReturnValue(job, w, r)
+}
+
+func (conf *RecordConfig) API_export_list(w http.ResponseWriter, r *http.Request) {
+	util.ReturnFetchValue(func() (jobs []ExportJob) {
+		query := db.Order("id DESC")
+		if streamPath := r.URL.Query().Get("streamPath"); streamPath != "" {
+			query = query.Where("stream_path = ?", streamPath)
+		}
+		query.Limit(100).Find(&jobs)
+		return
+	}, w, r)
+}
+
+func (conf *RecordConfig) API_export_cancel(w http.ResponseWriter, r *http.Request) {
+	id, err := strconv.Atoi(r.URL.Query().Get("id"))
+	if err != nil {
+		http.Error(w, "id parameter error", http.StatusBadRequest)
+		return
+	}
+	if task, ok := conf.exportTasks.Load(uint(id)); ok {
+		task := task.(*exportTask)
+		task.cancel()
+		task.mu.Lock()
+		waiting := task.job.Status == ExportStatusWaiting
+		task.mu.Unlock()
+		if waiting {
+			task.update(func(job *ExportJob) {
+				job.Status = ExportStatusCanceled
+			})
+		}
+		util.ReturnOK(w, r)
+		return
+	}
+	util.ReturnError(util.APIErrorNotFound, "no such export job", w, r)
+}
+
+// 下载导出完成的文件
+func (conf *RecordConfig) API_export_download(w http.ResponseWriter, r *http.Request) {
+	job, err := conf.getExportJob(r)
+	if err != nil {
+		http.NotFound(w, r)
+		return
+	}
+	if job.Status != ExportStatusDone {
+		http.Error(w, "export job is "+job.Status, http.StatusBadRequest)
+		return
+	}
+	w.Header().Set("Content-Disposition", "attachment; filename="+filepath.Base(job.Filepath))
+	http.ServeFile(w, r, job.Filepath)
+}
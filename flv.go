@@ -33,14 +33,7 @@ func (r *FLVRecorder) SetId(streamPath string) {
 }
 
 func (r *FLVRecorder) GetRecordModeString(mode RecordMode) string {
-	switch mode {
-	case EventMode:
-		return "eventmode"
-	case OrdinaryMode:
-		return "ordinarymode"
-	default:
-		return ""
-	}
+	return recordModeString(mode)
 }
 
 // Goroutine 等待定时器停止录像
@@ -59,7 +52,9 @@ func (r *FLVRecorder) StopTimerRecord(reason ...zapcore.Field) {
 	defer r.mu.Unlock()
 
 	// 停止录像
+	r.closing = true
 	r.Stop(reason...)
+	removeActiveRecording(r.ID)
 
 	// 关闭 stop 通道，停止 Goroutine
 	close(r.stopCh)
@@ -104,7 +99,7 @@ func NewFLVRecorder(mode RecordMode) (r *FLVRecorder) {
 		stopCh:     make(chan struct{}),
 		RecordMode: mode,
 	}
-	r.Record = RecordPluginConfig.Flv
+	r.Record = *RecordPluginConfig.getRecorderConfigByType("flv")
 	return r
 }
 
@@ -207,6 +202,21 @@ func (r *FLVRecorder) writeMetaData(file FileWr, duration int64) {
 	}
 }
 
+// 检测并修正flv tag头中的时间戳
+func (r *FLVRecorder) fixFLVTimestamp(frame FLVFrame) uint32 {
+	head := frame[0]
+	raw := uint32(head[4])<<16 | uint32(head[5])<<8 | uint32(head[6]) | uint32(head[7])<<24
+	track := 0
+	if !frame.IsVideo() {
+		track = 1
+	}
+	ts := r.fixTimestamp(track, raw)
+	if ts != raw {
+		putFlvTimestamp(head, ts)
+	}
+	return ts
+}
+
 func (r *FLVRecorder) OnEvent(event any) {
 	r.Recorder.OnEvent(event)
 	switch v := event.(type) {
@@ -251,21 +261,24 @@ func (r *FLVRecorder) OnEvent(event any) {
 	case FLVFrame:
 		check := false
 		var absTime uint32
+		ts := r.fixFLVTimestamp(v)
 		if r.VideoReader == nil {
 			check = true
-			absTime = r.AudioReader.AbsTime
+			absTime = ts
 		} else if v.IsVideo() {
 			check = r.VideoReader.Value.IFrame
-			absTime = r.VideoReader.AbsTime
+			absTime = ts
 			if check {
 				r.filepositions = append(r.filepositions, uint64(r.Offset))
 				r.times = append(r.times, float64(absTime)/1000)
 			}
 		}
 
-		if r.duration = int64(absTime); r.Fragment > 0 && check && time.Duration(r.duration)*time.Millisecond >= r.Fragment {
+		if r.duration = int64(absTime); r.Fragment > 0 && check && (r.splitPending || time.Duration(r.duration)*time.Millisecond >= r.Fragment) {
 			r.Close()
 			r.Offset = 0
+			// 新文件的时间戳从0开始
+			r.resetTimeline()
 			if file, err := r.CreateFile(); err == nil {
 				r.File = file
 				file.Write(codec.FLVHeader)
@@ -307,7 +320,7 @@ func (r *FLVRecorder) Close() error {
 					if r.FileName == "" {
 						fileName = strings.ReplaceAll(r.Stream.Path, "/", "-") + "-" + time.Now().Format("2006-01-02-15-04-05")
 					}
-					filepath := RecordPluginConfig.Flv.Path + "/" + r.Stream.Path + "/" + fileName + r.Ext //录像文件存入的完整路径（相对路径）
+					filepath := r.Path + "/" + r.Stream.Path + "/" + fileName + r.Ext //录像文件存入的完整路径（相对路径）
 					eventRecord := EventRecord{StreamPath: r.Stream.Path, RecordMode: "0", BeforeDuration: "0",
 						AfterDuration: fmt.Sprintf("%.0f", r.Fragment.Seconds()), CreateTime: startTime, StartTime: startTime,
 						EndTime: endTime, Filepath: filepath, Filename: fileName + r.Ext, Urlpath: "record/" + strings.ReplaceAll(r.filePath, "\\", "/"), Fragment: fmt.Sprintf("%.0f", r.Fragment.Seconds()), Type: "flv"}
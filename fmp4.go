@@ -1,47 +1,302 @@
 package record
 
 import (
+	"bytes"
+	"encoding/binary"
+	"io"
+
 	"github.com/Eyevinn/mp4ff/aac"
 	"github.com/Eyevinn/mp4ff/mp4"
+	"go.uber.org/zap"
 	. "m7s.live/engine/v4"
 	"m7s.live/engine/v4/codec"
 	"time"
 )
 
-type mediaContext struct {
-	trackId  uint32
-	fragment *mp4.Fragment
-	ts       uint32 // 每个小片段起始时间戳
+// fmp4的片段，一个moof中包含所有轨道的traf，有视频时在关键帧处开始新的片段，fmp4和hls(CMAF)录制共用
+type fragmentWriter struct {
+	videoId, audioId     uint32 // 0表示没有该轨道
+	seqNumber            uint32
+	video, audio         []mp4.FullSample // 当前片段中还没有写入的采样
+	lastVideo, lastAudio *mp4.FullSample  // 等待下一个采样确定时长的采样
+	videoDur, audioDur   uint32           // 最近一个采样的时长，用于估计最后一个采样的时长
+	startTime            uint32           // 当前片段第一个采样的时间戳
+	endTime              uint32           // 最后一个采样结束的时间戳
+	offset               uint64           // 下一个片段在文件中的位置
+	index                []fragmentIndex  // 已经写入的片段，用于生成sidx和mfra
+	sidxOffset           uint64           // moov之后预留给sidx的free box的位置
+	sidxReserved         uint64           // 预留的大小，0表示没有预留
+}
+
+type fragmentIndex struct {
+	offset, size uint64
+	startTime    uint32
+	sap          bool     // 以关键帧开始
+	trafs        []uint32 // moof中traf的轨道
+	trafTimes    []uint32 // 每个traf第一个采样的时间戳
+}
+
+// 使用新的初始化分片，片段序号重新开始
+func (f *fragmentWriter) reset(videoId, audioId uint32) {
+	f.videoId, f.audioId = videoId, audioId
+	f.seqNumber = 0
+}
+
+// 开始写入新的文件，offset为第一个片段在文件中的位置
+func (f *fragmentWriter) begin(offset uint64) {
+	f.video, f.audio = nil, nil
+	f.lastVideo, f.lastAudio = nil, nil
+	f.offset = offset
+	f.index = nil
+	f.sidxReserved = 0
+}
+
+// 在当前位置(moov之后)写入一个free box，结束时把sidx写入其中，refs为最多能索引的片段数
+func (f *fragmentWriter) reserveSidx(w io.Writer, refs int) error {
+	// sidx之后剩余的空间至少要能放下一个free box的头
+	size := mp4.CreateSidx(0).Size() + uint64(refs)*12 + 8
+	if _, err := w.Write(freeBox(size)); err != nil {
+		return err
+	}
+	f.sidxOffset, f.sidxReserved = f.offset, size
+	f.offset += size
+	return nil
+}
+
+// 指定大小的free box，内容全部为0
+func freeBox(size uint64) []byte {
+	box := make([]byte, size)
+	binary.BigEndian.PutUint32(box, uint32(size))
+	copy(box[4:], "free")
+	return box
 }
 
-func (m *mediaContext) push(recoder *FMP4Recorder, dt uint32, dur uint32, data []byte, flags uint32) {
-	if m.fragment != nil && dt-m.ts > 1000 {
-		m.fragment.Encode(recoder.File)
-		m.fragment = nil
+// 采样的时长为下一个采样的解码时间减去该采样的解码时间，所以每个轨道延迟一个采样写入
+// cto为显示时间减去解码时间(毫秒)，保持原值，第一帧的延迟由初始化分片中的edts抵消
+func (f *fragmentWriter) push(w io.Writer, trackId uint32, dt uint32, cto int32, data []byte, flags uint32) (err error) {
+	samples, last, lastDur := &f.audio, &f.lastAudio, &f.audioDur
+	if trackId == f.videoId {
+		samples, last, lastDur = &f.video, &f.lastVideo, &f.videoDur
+	}
+	if *last != nil {
+		// 时间戳回退时沿用上一个时长
+		if prev := uint32((*last).DecodeTime); dt > prev {
+			*lastDur = dt - prev
+		}
+		(*last).Dur = *lastDur
+		*samples = append(*samples, **last)
+		*last = nil
 	}
-	if m.fragment == nil {
-		recoder.seqNumber++
-		m.fragment, _ = mp4.CreateFragment(recoder.seqNumber, m.trackId)
-		m.ts = dt
+	if trackId == f.videoId && mp4.IsSyncSampleFlags(flags) {
+		err = f.flush(w)
+	} else if f.videoId == 0 && len(f.audio) > 0 && dt-uint32(f.audio[0].DecodeTime) > 1000 {
+		// 纯音频每秒一个片段
+		err = f.flush(w)
 	}
-	m.fragment.AddFullSample(mp4.FullSample{
+	*last = &mp4.FullSample{
 		Data:       data,
 		DecodeTime: uint64(dt),
 		Sample: mp4.Sample{
-			Flags: flags,
-			Dur:   dur,
-			Size:  uint32(len(data)),
+			Flags:                 flags,
+			Size:                  uint32(len(data)),
+			CompositionTimeOffset: cto,
 		},
+	}
+	return
+}
+
+// 写入所有的采样，最后一个采样的时长使用之前的采样时长，在文件或者分片结束时调用
+func (f *fragmentWriter) finish(w io.Writer) error {
+	if f.lastVideo != nil {
+		f.lastVideo.Dur = f.videoDur
+		f.video = append(f.video, *f.lastVideo)
+		f.lastVideo = nil
+	}
+	if f.lastAudio != nil {
+		f.lastAudio.Dur = f.audioDur
+		f.audio = append(f.audio, *f.lastAudio)
+		f.lastAudio = nil
+	}
+	return f.flush(w)
+}
+
+// 在tkhd之后插入edts，从mediaTime开始显示，片段化的文件中segment_duration为0表示持续到结束
+func addEditList(trak *mp4.TrakBox, mediaTime int64) {
+	edts := &mp4.EdtsBox{}
+	edts.AddChild(&mp4.ElstBox{Entries: []mp4.ElstEntry{{MediaTime: mediaTime, MediaRateInteger: 1}}})
+	trak.Edts = edts
+	children := make([]mp4.Box, 0, len(trak.Children)+1)
+	for _, child := range trak.Children {
+		children = append(children, child)
+		if child.Type() == "tkhd" {
+			children = append(children, edts)
+		}
+	}
+	trak.Children = children
+}
+
+// 写入当前的片段，每个轨道的采样放在各自的traf和trun中
+func (f *fragmentWriter) flush(w io.Writer) error {
+	var trackIds, trafTimes []uint32
+	for _, track := range []struct {
+		id      uint32
+		samples []mp4.FullSample
+	}{{f.videoId, f.video}, {f.audioId, f.audio}} {
+		trackId, samples := track.id, track.samples
+		if len(samples) == 0 {
+			continue
+		}
+		startTime := uint32(samples[0].DecodeTime)
+		if len(trackIds) == 0 || startTime < f.startTime {
+			f.startTime = startTime
+		}
+		if last := samples[len(samples)-1]; uint32(last.DecodeTime)+last.Dur > f.endTime {
+			f.endTime = uint32(last.DecodeTime) + last.Dur
+		}
+		trackIds = append(trackIds, trackId)
+		trafTimes = append(trafTimes, startTime)
+	}
+	if len(trackIds) == 0 {
+		return nil
+	}
+	f.seqNumber++
+	fragment, err := mp4.CreateMultiTrackFragment(f.seqNumber, trackIds)
+	if err != nil {
+		return err
+	}
+	for _, sample := range f.video {
+		if err = fragment.AddFullSampleToTrack(sample, f.videoId); err != nil {
+			return err
+		}
+	}
+	for _, sample := range f.audio {
+		if err = fragment.AddFullSampleToTrack(sample, f.audioId); err != nil {
+			return err
+		}
+	}
+	if err = fragment.Encode(w); err != nil {
+		return err
+	}
+	size := fragment.Size()
+	f.index = append(f.index, fragmentIndex{
+		offset:    f.offset,
+		size:      size,
+		startTime: f.startTime,
+		sap:       len(f.video) == 0 || mp4.IsSyncSampleFlags(f.video[0].Flags),
+		trafs:     trackIds,
+		trafTimes: trafTimes,
 	})
+	f.offset += size
+	f.video, f.audio = nil, nil
+	return nil
+}
+
+// 文件结束时在末尾追加mfra，并把sidx写入moov之后预留的free box，播放器不需要扫描整个文件就可以定位
+// 只写入末尾和预留的位置，已经写入的片段不会被修改，中途崩溃时文件仍然可以播放
+// 片段数超过预留的数量时不写入sidx，只有mfra
+func (f *fragmentWriter) writeIndex(file FileWr) (err error) {
+	if len(f.index) == 0 {
+		return
+	}
+	referenceId := f.videoId
+	if referenceId == 0 {
+		referenceId = f.audioId
+	}
+	// sidx中的时间使用参考轨道的时间
+	referenceTime := func(fragment fragmentIndex) uint32 {
+		for i, id := range fragment.trafs {
+			if id == referenceId {
+				return fragment.trafTimes[i]
+			}
+		}
+		return fragment.startTime
+	}
+	sidx := mp4.CreateSidx(uint64(referenceTime(f.index[0])))
+	sidx.ReferenceID = referenceId
+	sidx.Timescale = 1000
+	sidx.EarliestPresentationTime = uint64(referenceTime(f.index[0]))
+	for i, fragment := range f.index {
+		endTime := f.endTime
+		if i+1 < len(f.index) {
+			endTime = referenceTime(f.index[i+1])
+		}
+		ref := mp4.SidxRef{
+			ReferencedSize:     uint32(fragment.size),
+			SubSegmentDuration: endTime - referenceTime(fragment),
+		}
+		if fragment.sap {
+			ref.StartsWithSAP, ref.SAPType = 1, 1
+		}
+		sidx.SidxRefs = append(sidx.SidxRefs, ref)
+	}
+	mfra := &mp4.MfraBox{}
+	for _, trackId := range []uint32{f.videoId, f.audioId} {
+		if trackId == 0 {
+			continue
+		}
+		tfra := &mp4.TfraBox{TrackID: trackId}
+		for _, fragment := range f.index {
+			for i, id := range fragment.trafs {
+				if id == trackId && (trackId != f.videoId || fragment.sap) {
+					tfra.Entries = append(tfra.Entries, mp4.TfraEntry{
+						Time:         uint64(fragment.trafTimes[i]),
+						MoofOffset:   fragment.offset,
+						TrafNumber:   uint32(i + 1),
+						TrunNumber:   1,
+						SampleNumber: 1,
+					})
+				}
+			}
+		}
+		if f.offset >= 1<<32 {
+			tfra.Version = 1
+		}
+		mfra.AddChild(tfra)
+	}
+	mfro := &mp4.MfroBox{}
+	mfra.AddChild(mfro)
+	mfro.ParentSize = uint32(mfra.Size())
+	if _, err = file.Seek(int64(f.offset), io.SeekStart); err != nil {
+		return
+	}
+	if err = mfra.Encode(file); err != nil {
+		return
+	}
+	if remaining := f.sidxReserved - sidx.Size(); f.sidxReserved >= sidx.Size()+8 {
+		// sidx的偏移从sidx结束的位置开始计算，需要跳过剩余的free box
+		sidx.FirstOffset = remaining
+		var buf bytes.Buffer
+		if err = sidx.Encode(&buf); err != nil {
+			return
+		}
+		buf.Write(freeBox(remaining))
+		if _, err = file.Seek(int64(f.sidxOffset), io.SeekStart); err != nil {
+			return
+		}
+		if _, err = file.Write(buf.Bytes()); err != nil {
+			return
+		}
+	}
+	// 移动到末尾时会写出缓冲区中的数据
+	_, err = file.Seek(0, io.SeekEnd)
+	return
+}
+
+// 预留的sidx能索引的片段数，片段至少1秒(纯音频每秒一个片段，视频每个关键帧一个片段)
+// 不分片时按4096个片段预留，大约48KB
+func sidxReserveRefs(fragment time.Duration) int {
+	if fragment > 0 {
+		return int(fragment/time.Second) + 16
+	}
+	return 4096
 }
 
 type FMP4Recorder struct {
 	Recorder
 	initSegment *mp4.InitSegment `json:"-" yaml:"-"`
-	video       mediaContext
-	audio       mediaContext
-	seqNumber   uint32
+	fragments   fragmentWriter
 	ftyp        *mp4.FtypBox
+	initPending bool // 新文件还没有写入ftyp和moov，edts需要第一个视频帧的CTO
 }
 
 func (r *FMP4Recorder) SetId(string) {
@@ -66,7 +321,7 @@ func (r *FMP4Recorder) UpdateTimeout(timeout time.Duration) {
 
 func NewFMP4Recorder() *FMP4Recorder {
 	r := &FMP4Recorder{}
-	r.Record = RecordPluginConfig.Fmp4
+	r.Record = *RecordPluginConfig.getRecorderConfigByType("fmp4")
 	return r
 }
 
@@ -80,15 +335,41 @@ func (r *FMP4Recorder) StartWithFileName(streamPath string, fileName string) err
 	return r.start(r, streamPath, SUBTYPE_RAW)
 }
 
+// 收到第一帧时写入ftyp、moov，并在moov之后预留sidx的空间
+func (r *FMP4Recorder) writeInit(videoCTO int32) (err error) {
+	if !r.initPending {
+		return
+	}
+	r.initPending = false
+	var videoId, audioId uint32
+	r.ftyp, r.initSegment, videoId, audioId = r.createInitSegment(videoCTO)
+	if err = r.ftyp.Encode(r.File); err != nil {
+		return
+	}
+	if err = r.initSegment.Moov.Encode(r.File); err != nil {
+		return
+	}
+	r.fragments.reset(videoId, audioId)
+	r.fragments.begin(r.ftyp.Size() + r.initSegment.Moov.Size())
+	if !r.append {
+		err = r.fragments.reserveSidx(r.File, sidxReserveRefs(r.Fragment))
+	}
+	return
+}
+
 func (r *FMP4Recorder) Close() error {
 	if r.File != nil {
-		if r.video.fragment != nil {
-			r.video.fragment.Encode(r.File)
-			r.video.fragment = nil
+		if err := r.writeInit(0); err != nil {
+			r.Error("fmp4 write init", zap.Error(err))
 		}
-		if r.audio.fragment != nil {
-			r.audio.fragment.Encode(r.File)
-			r.audio.fragment = nil
+		if err := r.fragments.finish(r.File); err != nil {
+			r.Error("fmp4 write fragment", zap.Error(err))
+		}
+		// 追加模式下文件中已经有之前的片段，不生成索引
+		if !r.append {
+			if err := r.fragments.writeIndex(r.File); err != nil {
+				r.Error("fmp4 write index", zap.Error(err))
+			}
 		}
 		r.File.Close()
 	}
@@ -96,85 +377,97 @@ func (r *FMP4Recorder) Close() error {
 }
 
 func (r *FMP4Recorder) OnEvent(event any) {
+	var err error
 	r.Recorder.OnEvent(event)
 	switch v := event.(type) {
 	case FileWr:
-		r.initSegment = mp4.CreateEmptyInit()
-		r.initSegment.Moov.Mvhd.NextTrackID = 1
-		if r.VideoReader != nil {
-			moov := r.initSegment.Moov
-			trackID := moov.Mvhd.NextTrackID
-			moov.Mvhd.NextTrackID++
-			newTrak := mp4.CreateEmptyTrak(trackID, 1000, "video", "chi")
-			moov.AddChild(newTrak)
-			moov.Mvex.AddChild(mp4.CreateTrex(trackID))
-			r.video.trackId = trackID
-			switch r.Video.CodecID {
-			case codec.CodecID_H264:
-				r.ftyp = mp4.NewFtyp("isom", 0x200, []string{
-					"isom", "iso2", "avc1", "mp41",
-				})
-				newTrak.SetAVCDescriptor("avc1", r.Video.ParamaterSets[0:1], r.Video.ParamaterSets[1:2], true)
-			case codec.CodecID_H265:
-				r.ftyp = mp4.NewFtyp("isom", 0x200, []string{
-					"isom", "iso2", "hvc1", "mp41",
-				})
-				newTrak.SetHEVCDescriptor("hvc1", r.Video.ParamaterSets[0:1], r.Video.ParamaterSets[1:2], r.Video.ParamaterSets[2:3], nil, true)
-			}
-		}
-		if r.AudioReader != nil {
-			moov := r.initSegment.Moov
-			trackID := moov.Mvhd.NextTrackID
-			moov.Mvhd.NextTrackID++
-			newTrak := mp4.CreateEmptyTrak(trackID, 1000, "audio", "chi")
-			moov.AddChild(newTrak)
-			moov.Mvex.AddChild(mp4.CreateTrex(trackID))
-			r.audio.trackId = trackID
-			switch r.Audio.CodecID {
-			case codec.CodecID_AAC:
-				switch r.Audio.AudioObjectType {
-				case 1:
-					newTrak.SetAACDescriptor(aac.HEAACv1, int(r.Audio.SampleRate))
-				case 2:
-					newTrak.SetAACDescriptor(aac.AAClc, int(r.Audio.SampleRate))
-				case 3:
-					newTrak.SetAACDescriptor(aac.HEAACv2, int(r.Audio.SampleRate))
-				}
-			case codec.CodecID_PCMA:
-				stsd := newTrak.Mdia.Minf.Stbl.Stsd
-				pcma := mp4.CreateAudioSampleEntryBox("pcma",
-					uint16(r.Audio.Channels),
-					uint16(r.Audio.SampleSize), uint16(r.Audio.SampleRate), nil)
-				stsd.AddChild(pcma)
-			case codec.CodecID_PCMU:
-				stsd := newTrak.Mdia.Minf.Stbl.Stsd
-				pcmu := mp4.CreateAudioSampleEntryBox("pcmu",
-					uint16(r.Audio.Channels),
-					uint16(r.Audio.SampleSize), uint16(r.Audio.SampleRate), nil)
-				stsd.AddChild(pcmu)
-			}
-		}
-		if r.ftyp == nil {
-			r.ftyp = mp4.NewFtyp("isom", 0x200, []string{
-				"isom", "iso2", "avc1", "mp41",
-			})
-		}
-		r.ftyp.Encode(v)
-		r.initSegment.Moov.Encode(v)
-		r.seqNumber = 0
+		r.initPending = true
 	case AudioFrame:
-		if r.audio.trackId != 0 {
-			r.audio.push(r, v.AbsTime, v.DeltaTime, v.AUList.ToBytes(), mp4.SyncSampleFlags)
+		if err = r.writeInit(0); err == nil && r.fragments.audioId != 0 {
+			err = r.fragments.push(r.File, r.fragments.audioId, r.frameTs, 0, v.AUList.ToBytes(), mp4.SyncSampleFlags)
 		}
 	case VideoFrame:
-		if r.video.trackId != 0 {
+		cto := int32(v.PTS-v.DTS) / 90
+		if err = r.writeInit(cto); err == nil && r.fragments.videoId != 0 {
 			flag := mp4.NonSyncSampleFlags
 			if v.IFrame {
 				flag = mp4.SyncSampleFlags
 			}
 			if data := v.AVCC.ToBytes(); len(data) > 5 {
-				r.video.push(r, v.AbsTime, v.DeltaTime, data[5:], flag)
+				err = r.fragments.push(r.File, r.fragments.videoId, r.frameTs, cto, data[5:], flag)
 			}
 		}
 	}
+	if err != nil {
+		r.Stop(zap.Error(err))
+	}
+}
+
+// 根据当前的轨道创建ftyp和moov，trackId为0表示没有该轨道，fmp4和hls(CMAF)录制共用
+// videoCTO为第一个视频帧的CTO(毫秒)，有B帧时通过edts把视频的显示时间提前，使第一帧从0开始显示，与音频对齐
+func (r *Recorder) createInitSegment(videoCTO int32) (ftyp *mp4.FtypBox, initSegment *mp4.InitSegment, videoId, audioId uint32) {
+	initSegment = mp4.CreateEmptyInit()
+	initSegment.Moov.Mvhd.NextTrackID = 1
+	if r.VideoReader != nil {
+		moov := initSegment.Moov
+		trackID := moov.Mvhd.NextTrackID
+		moov.Mvhd.NextTrackID++
+		newTrak := mp4.CreateEmptyTrak(trackID, 1000, "video", "chi")
+		moov.AddChild(newTrak)
+		moov.Mvex.AddChild(mp4.CreateTrex(trackID))
+		videoId = trackID
+		switch r.Video.CodecID {
+		case codec.CodecID_H264:
+			ftyp = mp4.NewFtyp("isom", 0x200, []string{
+				"isom", "iso2", "avc1", "mp41",
+			})
+			newTrak.SetAVCDescriptor("avc1", r.Video.ParamaterSets[0:1], r.Video.ParamaterSets[1:2], true)
+		case codec.CodecID_H265:
+			ftyp = mp4.NewFtyp("isom", 0x200, []string{
+				"isom", "iso2", "hvc1", "mp41",
+			})
+			newTrak.SetHEVCDescriptor("hvc1", r.Video.ParamaterSets[0:1], r.Video.ParamaterSets[1:2], r.Video.ParamaterSets[2:3], nil, true)
+		}
+		if videoCTO > 0 {
+			addEditList(newTrak, int64(videoCTO))
+		}
+	}
+	if r.AudioReader != nil {
+		moov := initSegment.Moov
+		trackID := moov.Mvhd.NextTrackID
+		moov.Mvhd.NextTrackID++
+		newTrak := mp4.CreateEmptyTrak(trackID, 1000, "audio", "chi")
+		moov.AddChild(newTrak)
+		moov.Mvex.AddChild(mp4.CreateTrex(trackID))
+		audioId = trackID
+		switch r.Audio.CodecID {
+		case codec.CodecID_AAC:
+			switch r.Audio.AudioObjectType {
+			case 1:
+				newTrak.SetAACDescriptor(aac.HEAACv1, int(r.Audio.SampleRate))
+			case 2:
+				newTrak.SetAACDescriptor(aac.AAClc, int(r.Audio.SampleRate))
+			case 3:
+				newTrak.SetAACDescriptor(aac.HEAACv2, int(r.Audio.SampleRate))
+			}
+		case codec.CodecID_PCMA:
+			stsd := newTrak.Mdia.Minf.Stbl.Stsd
+			pcma := mp4.CreateAudioSampleEntryBox("pcma",
+				uint16(r.Audio.Channels),
+				uint16(r.Audio.SampleSize), uint16(r.Audio.SampleRate), nil)
+			stsd.AddChild(pcma)
+		case codec.CodecID_PCMU:
+			stsd := newTrak.Mdia.Minf.Stbl.Stsd
+			pcmu := mp4.CreateAudioSampleEntryBox("pcmu",
+				uint16(r.Audio.Channels),
+				uint16(r.Audio.SampleSize), uint16(r.Audio.SampleRate), nil)
+			stsd.AddChild(pcmu)
+		}
+	}
+	if ftyp == nil {
+		ftyp = mp4.NewFtyp("isom", 0x200, []string{
+			"isom", "iso2", "avc1", "mp41",
+		})
+	}
+	return
 }
@@ -5,13 +5,13 @@ go 1.19
 require (
 	github.com/Eyevinn/mp4ff v0.40.1
 	github.com/glebarez/sqlite v1.11.0
+	github.com/pion/rtp v1.8.3
 	github.com/shirou/gopsutil/v3 v3.23.8
 	github.com/yapingcat/gomedia v0.0.0-20230905155010-55b9713fcec1
 	go.uber.org/zap v1.26.0
 	gorm.io/driver/mysql v1.5.7
 	gorm.io/gorm v1.25.12
 	m7s.live/engine/v4 v4.15.2
-	m7s.live/plugin/hls/v4 v4.3.2
 )
 
 require (
@@ -40,7 +40,6 @@ require (
 	github.com/mcuadros/go-defaults v1.2.0 // indirect
 	github.com/onsi/ginkgo/v2 v2.9.5 // indirect
 	github.com/pion/randutil v0.1.0 // indirect
-	github.com/pion/rtp v1.8.3 // indirect
 	github.com/pion/webrtc/v3 v3.2.20 // indirect
 	github.com/pkg/errors v0.9.1 // indirect
 	github.com/power-devops/perfstat v0.0.0-20221212215047-62379fc7944b // indirect
@@ -0,0 +1,195 @@
+package record
+
+import (
+	"net/http"
+	"sync"
+	"time"
+
+	"go.uber.org/zap"
+	"m7s.live/engine/v4/util"
+)
+
+// 支持断流重连后继续写入同一个文件的录像
+type resumable interface {
+	IRecorder
+	resumeFrom(old IRecorder)
+}
+
+// 断流后等待重新推流的录像，文件保持打开
+type graceRecorder struct {
+	Recorder   IRecorder `json:"-"`
+	ID         string    `json:"id"`
+	Type       string    `json:"type"`
+	StreamPath string    `json:"streamPath"`
+	FilePath   string    `json:"filePath"`
+	Deadline   time.Time `json:"deadline"`
+	timer      *time.Timer
+	claimed    bool
+	mu         sync.Mutex
+}
+
+// 超时关闭和重新推流只能有一个生效
+func (g *graceRecorder) claim() bool {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	if g.claimed {
+		return false
+	}
+	g.claimed = true
+	if g.timer != nil {
+		g.timer.Stop()
+	}
+	RecordPluginConfig.waitingRecorders.Delete(g.ID)
+	return true
+}
+
+func recorderType(re IRecorder) string {
+	switch v := re.(type) {
+	case *FLVRecorder:
+		return "flv"
+	case *MP4Recorder:
+		return "mp4"
+	case *FMP4Recorder:
+		return "fmp4"
+	case *HLSRecorder:
+		return "hls"
+	case *TSRecorder:
+		return "ts"
+	case *MKVRecorder:
+		return "mkv"
+	case *PSRecorder:
+		return "ps"
+	case *RTPRecorder:
+		return "rtp"
+	case *RawRecorder:
+		if v.IsAudio {
+			return "raw_audio"
+		}
+		return "raw"
+	}
+	return ""
+}
+
+// 录像被停止时调用，断流(非主动停止)且配置了等待时长时暂不关闭文件
+type graceCloser struct {
+	re IRecorder
+}
+
+func (c *graceCloser) Close() error {
+	r := c.re.GetRecorder()
+	// 分片切割时也会调用Close，此时订阅仍然有效
+	if r.Err() == nil || r.closing || r.ReconnectGrace <= 0 || r.File == nil {
+		return c.re.Close()
+	}
+	if _, ok := c.re.(resumable); !ok {
+		return c.re.Close()
+	}
+	g := &graceRecorder{
+		Recorder:   c.re,
+		ID:         r.ID,
+		Type:       recorderType(c.re),
+		StreamPath: r.Stream.Path,
+		FilePath:   r.filePath,
+		Deadline:   time.Now().Add(r.ReconnectGrace),
+	}
+	RecordPluginConfig.waitingRecorders.Store(g.ID, g)
+	g.mu.Lock()
+	g.timer = time.AfterFunc(r.ReconnectGrace, func() {
+		if g.claim() {
+			r.Info("reconnect grace expired", zap.String("file", g.FilePath))
+			c.re.Close()
+		}
+	})
+	g.mu.Unlock()
+	r.Info("wait for republish", zap.String("file", g.FilePath), zap.Duration("grace", r.ReconnectGrace))
+	return nil
+}
+
+// 继承旧录像的文件和时间轴
+func (r *Recorder) inherit(old *Recorder) {
+	r.Record = old.Record
+	r.FileName = old.FileName
+	r.File = old.File
+	r.filePath = old.filePath
+	r.SkipTS = old.SkipTS
+	r.frameTs = old.frameTs
+	r.timeline = old.timeline
+	r.rule = old.rule
+}
+
+func (r *FLVRecorder) resumeFrom(old IRecorder) {
+	o := old.(*FLVRecorder)
+	r.Recorder.inherit(&o.Recorder)
+	r.filepositions = o.filepositions
+	r.times = o.times
+	r.Offset = o.Offset
+	r.duration = o.duration
+}
+
+func (r *MP4Recorder) resumeFrom(old IRecorder) {
+	o := old.(*MP4Recorder)
+	r.Recorder.inherit(&o.Recorder)
+	r.Movmuxer = o.Movmuxer
+	r.videoId = o.videoId
+	r.audioId = o.audioId
+}
+
+func (r *FMP4Recorder) resumeFrom(old IRecorder) {
+	o := old.(*FMP4Recorder)
+	r.Recorder.inherit(&o.Recorder)
+	r.initSegment = o.initSegment
+	r.fragments = o.fragments
+	r.ftyp = o.ftyp
+	r.initPending = o.initPending
+}
+
+// 重新推流时恢复等待中的录像，返回恢复的录像类型和id
+func (conf *RecordConfig) resumeRecorders(streamPath string) (resumed map[string]bool, resumedIds map[string]bool) {
+	resumed = make(map[string]bool)
+	resumedIds = make(map[string]bool)
+	conf.waitingRecorders.Range(func(key, value any) bool {
+		g := value.(*graceRecorder)
+		if g.StreamPath != streamPath || !g.claim() {
+			return true
+		}
+		var re resumable
+		switch old := g.Recorder.(type) {
+		case *FLVRecorder:
+			re = NewFLVRecorder(old.RecordMode)
+		case *MP4Recorder:
+			re = NewMP4Recorder()
+		case *FMP4Recorder:
+			re = NewFMP4Recorder()
+		}
+		re.resumeFrom(g.Recorder)
+		resumed[g.Type] = true
+		resumedIds[g.ID] = true
+		// 在发布事件中调用，订阅放到协程中避免阻塞引擎的事件处理
+		go func() {
+			var err error
+			if fileName := re.GetRecorder().FileName; fileName != "" {
+				err = re.StartWithFileName(streamPath, fileName)
+			} else {
+				err = re.Start(streamPath)
+			}
+			if err != nil {
+				plugin.Error("resume record failed", zap.String("id", g.ID), zap.Error(err))
+				g.Recorder.Close()
+				return
+			}
+			plugin.Info("resume record", zap.String("id", g.ID), zap.String("file", g.FilePath))
+		}()
+		return true
+	})
+	return
+}
+
+func (conf *RecordConfig) API_list_waiting(w http.ResponseWriter, r *http.Request) {
+	util.ReturnFetchValue(func() (recorders []any) {
+		conf.waitingRecorders.Range(func(key, value any) bool {
+			recorders = append(recorders, value)
+			return true
+		})
+		return
+	}, w, r)
+}
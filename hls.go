@@ -1,25 +1,47 @@
 package record
 
 import (
+	"crypto/aes"
+	"crypto/cipher"
+	"encoding/binary"
 	"fmt"
-	"math"
+	"os"
 	"path/filepath"
+	"strings"
 	"time"
 
+	"github.com/Eyevinn/mp4ff/mp4"
+	"github.com/yapingcat/gomedia/go-mpeg2"
 	"go.uber.org/zap"
 	. "m7s.live/engine/v4"
 	"m7s.live/engine/v4/codec"
 	"m7s.live/engine/v4/codec/mpegts"
 	"m7s.live/engine/v4/util"
-	"m7s.live/plugin/hls/v4"
+	"m7s.live/plugin/record/v4/recordfile"
 )
 
 type HLSRecorder struct {
-	playlist           hls.Playlist
-	tsStartTime        uint32
-	tsLastTime         uint32
+	playlist           *hlsPlaylist
+	tsStartTime        uint32 // 当前分片第一帧修正后的时间戳
+	tsStarted          bool
 	tsTitle            string
+	tsDateTime         time.Time // 当前分片开始的时间
+	initName           string    // CMAF的初始化分片
 	video_cc, audio_cc byte
+	cmaf               bool // 使用fmp4分片
+	fragments          fragmentWriter
+	method             string // 加密方式，空表示不加密
+	key                *hlsKey
+	keySegments        int // 当前密钥已经加密的分片数
+	block              cipher.Block
+	iv                 []byte
+	tsMuxer            *mpeg2.TSMuxer // SAMPLE-AES需要修改采样数据，不能使用MemoryTs
+	videoPid, audioPid uint16
+	muxErr             error
+	iframes            *hlsPlaylist // I帧列表，只有ts分片且不是整个分片加密时生成
+	iframe             *hlsSegment  // 还不知道时长的最近一个I帧
+	iframeTime         uint32
+	segmentSize        int64 // 当前分片已经写入的字节数
 	Recorder
 	MemoryTs
 }
@@ -45,8 +67,8 @@ func (h *HLSRecorder) UpdateTimeout(timeout time.Duration) {
 }
 
 func NewHLSRecorder() (r *HLSRecorder) {
-	r = &HLSRecorder{}
-	r.Record = RecordPluginConfig.Hls
+	r = &HLSRecorder{cmaf: RecordPluginConfig.HlsSegmentFormat == "fmp4"}
+	r.Record = *RecordPluginConfig.getRecorderConfigByType("hls")
 	return r
 }
 
@@ -62,16 +84,75 @@ func (h *HLSRecorder) StartWithFileName(streamPath string, fileName string) erro
 
 func (r *HLSRecorder) Close() (err error) {
 	if r.File != nil {
-		inf := hls.PlaylistInf{
-			Duration: float64(r.tsLastTime-r.tsStartTime) / 1000,
-			Title:    r.tsTitle,
+		if r.cmaf {
+			if flushErr := r.fragments.finish(r.File); flushErr != nil {
+				r.Error("hls write fragment", zap.Error(flushErr))
+			}
 		}
-		r.playlist.WriteInf(inf)
-		r.tsStartTime = 0
 		err = r.File.Close()
+		seg := hlsSegment{
+			Duration: float64(r.frameTs-r.tsStartTime) / 1000,
+			URI:      r.segmentURI(r.tsTitle),
+			DateTime: r.tsDateTime,
+			Map:      r.segmentURI(r.initName),
+		}
+		if r.method != "" {
+			seg.KeyMethod, seg.KeyURI, seg.KeyIV = r.method, r.key.uri, hlsIVString(r.iv)
+		}
+		seg.Length = r.segmentSize
+		r.playlist.add(seg)
+		// 切分时frameTs已经是下一个分片的第一帧
+		r.tsStartTime = r.frameTs
+		// 订阅已经结束说明是停止录制，而不是分片切割
+		r.playlist.ended = r.Err() != nil
+		if writeErr := r.playlist.write(); err == nil {
+			err = writeErr
+		}
+		if r.iframes != nil {
+			r.addIFrame(r.frameTs)
+			r.iframes.ended = r.playlist.ended
+			if writeErr := r.writeIFramesPlaylist(); err == nil {
+				err = writeErr
+			}
+		}
 	}
 	return
 }
+
+// 分片相对于m3u8的路径，name为空时返回空
+func (h *HLSRecorder) segmentURI(name string) string {
+	if name == "" {
+		return ""
+	}
+	uri, err := filepath.Rel(filepath.Dir(h.filePath), filepath.Join(h.Stream.Path, name))
+	if err != nil {
+		return name
+	}
+	return filepath.ToSlash(uri)
+}
+
+// m3u8的文件名，同一个流重复录制时追加到同一个文件
+func (h *HLSRecorder) playlistName() string {
+	name := h.FileName
+	if name == "" {
+		name = "index"
+	}
+	return filepath.Join(h.Stream.Path, name+h.Ext)
+}
+
+// 分片时长使用修正后的frameTs，需要在Recorder.OnEvent之后调用
+func (h *HLSRecorder) startSegmentTime() {
+	if !h.tsStarted {
+		h.tsStartTime, h.tsStarted = h.frameTs, true
+	}
+}
+
+// PES使用修正后的frameTs，与ts录制一致，时间戳不连续时重写的时间轴才能生效
+// 分片之间的时间戳需要连续，不像ts录制那样每个文件从0开始
+func (h *HLSRecorder) pesTimestamp(pts, dts uint32) (uint32, uint32) {
+	return h.frameTs*90 + pts - dts, h.frameTs * 90
+}
+
 func (h *HLSRecorder) OnEvent(event any) {
 	var err error
 	defer func() {
@@ -82,28 +163,51 @@ func (h *HLSRecorder) OnEvent(event any) {
 	switch v := event.(type) {
 	case *HLSRecorder:
 		h.BytesPool = make(util.BytesPool, 17)
-		if h.Writer, err = h.Recorder.CreateFile(); err != nil {
+		h.filePath = h.playlistName()
+		playlistPath := filepath.Join(h.Path, h.filePath)
+		if err = os.MkdirAll(filepath.Dir(playlistPath), 0766); err != nil {
 			return
 		}
-		h.SetIO(h.Writer)
-		h.playlist = hls.Playlist{
-			Writer:         h.Writer,
-			Version:        3,
-			Sequence:       0,
-			Targetduration: int(math.Ceil(h.Fragment.Seconds())),
+		h.playlist = loadHLSPlaylist(playlistPath)
+		h.method = h.encryptionMethod()
+		if h.cmaf {
+			// EXT-X-MAP需要版本6以上，使用CMAF推荐的版本7
+			h.playlist.begin(7)
+		} else if h.method == hlsMethodSampleAES {
+			h.playlist.begin(5)
+		} else {
+			h.playlist.begin(3)
 		}
-		if err = h.playlist.Init(); err != nil {
+		if err = h.playlist.write(); err != nil {
 			return
 		}
+		h.Info("create playlist", zap.String("path", playlistPath), zap.Int("segments", len(h.playlist.segments)))
+		// 整个分片加密时无法按字节范围读取I帧
+		if !h.cmaf && h.method != hlsMethodAES128 && h.Video != nil {
+			h.iframes = loadHLSPlaylist(hlsIFramesPlaylistPath(playlistPath))
+			h.iframes.iframes = true
+			// I帧列表中使用EXT-X-MAP需要版本5
+			h.iframes.begin(5)
+		}
 		if h.File, err = h.CreateFile(); err != nil {
 			return
 		}
 	case AudioFrame:
-		if h.tsStartTime == 0 {
-			h.tsStartTime = v.AbsTime
-		}
-		h.tsLastTime = v.AbsTime
 		h.Recorder.OnEvent(event)
+		h.startSegmentTime()
+		if h.cmaf {
+			if err = h.writeInitSegment(0); err == nil && h.fragments.audioId != 0 {
+				err = h.fragments.push(h.File, h.fragments.audioId, h.frameTs, 0, v.AUList.ToBytes(), mp4.SyncSampleFlags)
+			}
+			return
+		}
+		if h.tsMuxer != nil {
+			if h.audioPid != 0 {
+				err = h.writeSampleAESAudio(v)
+			}
+			return
+		}
+		v.PTS, v.DTS = h.pesTimestamp(v.PTS, v.DTS)
 		pes := &mpegts.MpegtsPESFrame{
 			Pid:                       mpegts.PID_AUDIO,
 			IsKeyFrame:                false,
@@ -111,16 +215,53 @@ func (h *HLSRecorder) OnEvent(event any) {
 			ProgramClockReferenceBase: uint64(v.DTS),
 		}
 		h.WriteAudioFrame(v, pes)
-		_, err = h.BLL.WriteTo(h.File)
+		var n int64
+		n, err = h.BLL.WriteTo(h.File)
+		h.segmentSize += n
 		h.Recycle()
 		h.Clear()
 		h.audio_cc = pes.ContinuityCounter
 	case VideoFrame:
-		if h.tsStartTime == 0 {
-			h.tsStartTime = v.AbsTime
-		}
-		h.tsLastTime = v.AbsTime
 		h.Recorder.OnEvent(event)
+		h.startSegmentTime()
+		if h.cmaf {
+			cto := int32(v.PTS-v.DTS) / 90
+			if err = h.writeInitSegment(cto); err == nil && h.fragments.videoId != 0 {
+				flag := mp4.NonSyncSampleFlags
+				if v.IFrame {
+					flag = mp4.SyncSampleFlags
+				}
+				if data := v.AVCC.ToBytes(); len(data) > 5 {
+					err = h.fragments.push(h.File, h.fragments.videoId, h.frameTs, cto, data[5:], flag)
+				}
+			}
+			return
+		}
+		offset := h.segmentSize
+		defer func() {
+			if err == nil && v.IFrame && h.iframes != nil {
+				h.addIFrame(h.frameTs)
+				h.iframe = &hlsSegment{
+					URI:       h.segmentURI(h.tsTitle),
+					DateTime:  h.tsDateTime.Add(time.Duration(h.frameTs-h.tsStartTime) * time.Millisecond),
+					Map:       h.segmentURI(h.tsTitle),
+					MapLength: 2 * 188, // PAT和PMT
+					Offset:    offset,
+					Length:    h.segmentSize - offset,
+				}
+				if h.method != "" {
+					h.iframe.KeyMethod, h.iframe.KeyURI, h.iframe.KeyIV = h.method, h.key.uri, hlsIVString(h.iv)
+				}
+				h.iframeTime = h.frameTs
+			}
+		}()
+		if h.tsMuxer != nil {
+			if h.videoPid != 0 {
+				err = h.writeSampleAESVideo(v)
+			}
+			return
+		}
+		v.PTS, v.DTS = h.pesTimestamp(v.PTS, v.DTS)
 		pes := &mpegts.MpegtsPESFrame{
 			Pid:                       mpegts.PID_VIDEO,
 			IsKeyFrame:                v.IFrame,
@@ -130,7 +271,9 @@ func (h *HLSRecorder) OnEvent(event any) {
 		if err = h.WriteVideoFrame(v, pes); err != nil {
 			return
 		}
-		_, err = h.BLL.WriteTo(h.File)
+		var n int64
+		n, err = h.BLL.WriteTo(h.File)
+		h.segmentSize += n
 		h.Recycle()
 		h.Clear()
 		h.video_cc = pes.ContinuityCounter
@@ -139,9 +282,46 @@ func (h *HLSRecorder) OnEvent(event any) {
 	}
 }
 
-// 创建一个新的ts文件
+// hls录像目录下除m3u8之外的分片文件
+func isHLSSegment(path string) bool {
+	switch filepath.Ext(path) {
+	case ".ts", ".m4s":
+		return true
+	case ".mp4":
+		return strings.HasSuffix(path, "_init.mp4")
+	}
+	return false
+}
+
+// 收到第一帧时写入CMAF的初始化分片，每次录制生成一个，分片通过EXT-X-MAP引用
+func (h *HLSRecorder) writeInitSegment(videoCTO int32) (err error) {
+	if h.initName != "" {
+		return
+	}
+	ftyp, initSegment, videoId, audioId := h.createInitSegment(videoCTO)
+	h.fragments.reset(videoId, audioId)
+	h.initName = fmt.Sprintf("%d_init.mp4", time.Now().Unix())
+	filePath := filepath.Join(h.Stream.Path, h.initName)
+	fw, err := h.CreateFileFn(filePath, false)
+	if err != nil {
+		h.Error("create file", zap.String("path", filePath), zap.Error(err))
+		return
+	}
+	defer fw.Close()
+	h.Info("create file", zap.String("path", filePath))
+	if err = ftyp.Encode(fw); err != nil {
+		return
+	}
+	return initSegment.Moov.Encode(fw)
+}
+
+// 创建一个新的分片文件，ts分片以PAT和PMT开始，fmp4分片只包含moof和mdat
 func (h *HLSRecorder) CreateFile() (fw FileWr, err error) {
-	h.tsTitle = fmt.Sprintf("%d.ts", time.Now().Unix())
+	if h.cmaf {
+		h.tsTitle = fmt.Sprintf("%d.m4s", time.Now().Unix())
+	} else {
+		h.tsTitle = fmt.Sprintf("%d.ts", time.Now().Unix())
+	}
 	filePath := filepath.Join(h.Stream.Path, h.tsTitle)
 	fw, err = h.CreateFileFn(filePath, false)
 	if err != nil {
@@ -149,6 +329,31 @@ func (h *HLSRecorder) CreateFile() (fw FileWr, err error) {
 		return
 	}
 	h.Info("create file", zap.String("path", filePath))
+	h.tsDateTime = time.Now()
+	h.segmentSize = 0
+	if h.cmaf {
+		// 每个m4s分片都从moof开始，不需要索引
+		h.fragments.begin(0)
+		return
+	}
+	if h.method != "" {
+		if err = h.rotateKey(); err != nil {
+			fw.Close()
+			return
+		}
+		// IV在两个列表的EXT-X-KEY中都显式写入
+		h.iv = hlsSequenceIV(len(h.playlist.segments))
+		if h.method == hlsMethodSampleAES {
+			h.createSampleAESMuxer()
+			return
+		}
+		var aesWriter *aesFileWriter
+		if aesWriter, err = newAESFileWriter(fw, h.key.key, h.iv); err != nil {
+			fw.Close()
+			return
+		}
+		fw = aesWriter
+	}
 
 	if err = mpegts.WriteDefaultPATPacket(fw); err != nil {
 		return
@@ -162,5 +367,132 @@ func (h *HLSRecorder) CreateFile() (fw FileWr, err error) {
 		acodec = h.Audio.CodecID
 	}
 	mpegts.WritePMTPacket(fw, vcodec, acodec)
+	h.segmentSize = 2 * 188
+	return
+}
+
+// 本次录制使用的加密方式，不支持的组合不加密或者改用AES-128
+func (h *HLSRecorder) encryptionMethod() string {
+	method := RecordPluginConfig.HlsEncryption.Method
+	switch method {
+	case "":
+		return ""
+	case hlsMethodAES128, hlsMethodSampleAES:
+	default:
+		h.Warn("unsupported hls encryption method", zap.String("method", method))
+		return ""
+	}
+	if h.cmaf {
+		h.Warn("hls encryption only supports ts segments")
+		return ""
+	}
+	// SAMPLE-AES的ts格式只定义了h264和aac
+	if method == hlsMethodSampleAES && h.Video != nil && h.Video.CodecID != codec.CodecID_H264 {
+		h.Warn("SAMPLE-AES only supports h264, use AES-128")
+		return hlsMethodAES128
+	}
+	return method
+}
+
+// 开始录制或者达到KeyRotation个分片时更换密钥
+func (h *HLSRecorder) rotateKey() (err error) {
+	if rotation := RecordPluginConfig.HlsEncryption.KeyRotation; h.key == nil || (rotation > 0 && h.keySegments >= rotation) {
+		if h.key, err = newHLSKey(h.Stream.Path, h.method); err != nil {
+			return
+		}
+		if h.block, err = aes.NewCipher(h.key.key); err != nil {
+			return
+		}
+		h.keySegments = 0
+		h.Info("rotate hls key", zap.String("id", h.key.id))
+	}
+	h.keySegments++
 	return
 }
+
+// 每个分片使用新的muxer，分片以PAT和PMT开始，PMT替换为SAMPLE-AES的格式
+func (h *HLSRecorder) createSampleAESMuxer() {
+	h.tsMuxer = mpeg2.NewTSMuxer()
+	h.videoPid, h.audioPid = 0, 0
+	var asc []byte
+	if h.Video != nil {
+		h.videoPid = h.tsMuxer.AddStream(mpeg2.TS_STREAM_H264)
+	}
+	if h.Audio != nil && h.Audio.CodecID == codec.CodecID_AAC && len(h.Audio.SequenceHead) > 2 {
+		h.audioPid = h.tsMuxer.AddStream(mpeg2.TS_STREAM_AAC)
+		asc = h.Audio.SequenceHead[2:]
+	}
+	pcrPid := h.videoPid
+	if pcrPid == 0 {
+		pcrPid = h.audioPid
+	}
+	// gomedia的PMT使用固定的pid
+	const pmtPid = 0x200
+	muxer := h.tsMuxer
+	muxer.OnPacket = func(pkg []byte) {
+		if h.muxErr != nil || h.tsMuxer != muxer {
+			return
+		}
+		if pid := uint16(pkg[1]&0x1f)<<8 | uint16(pkg[2]); pid == pmtPid {
+			pkg = sampleAESPMTPacket(pmtPid, pcrPid, h.videoPid, h.audioPid, asc, pkg[3]&0x0f)
+		}
+		if _, h.muxErr = h.File.Write(pkg); h.muxErr == nil {
+			h.segmentSize += int64(len(pkg))
+		}
+	}
+}
+
+func (h *HLSRecorder) writeSampleAESVideo(v VideoFrame) error {
+	data := v.AVCC.ToBytes()
+	if len(data) <= 5 {
+		return nil
+	}
+	var annexb []byte
+	if v.IFrame {
+		annexb = recordfile.VideoParamSets(h.Video.SequenceHead)
+	}
+	for nalus := data[5:]; len(nalus) > 4; {
+		size := int(binary.BigEndian.Uint32(nalus))
+		if size > len(nalus)-4 {
+			break
+		}
+		annexb = append(annexb, 0, 0, 0, 1)
+		annexb = append(annexb, sampleAESEncryptNALU(h.block, h.iv, nalus[4:4+size])...)
+		nalus = nalus[4+size:]
+	}
+	// 使用修正后的frameTs，显示时间加上CTO
+	if err := h.tsMuxer.Write(h.videoPid, annexb, uint64(h.frameTs+(v.PTS-v.DTS)/90), uint64(h.frameTs)); err != nil {
+		return err
+	}
+	return h.muxErr
+}
+
+func (h *HLSRecorder) writeSampleAESAudio(v AudioFrame) error {
+	raw := v.AUList.ToBytes()
+	frame := append(recordfile.ADTSHeader(h.Audio.SequenceHead[2:], len(raw)), raw...)
+	frame = sampleAESEncryptADTS(h.block, h.iv, frame, 7)
+	if err := h.tsMuxer.Write(h.audioPid, frame, uint64(h.frameTs), uint64(h.frameTs)); err != nil {
+		return err
+	}
+	return h.muxErr
+}
+
+// 上一个I帧到下一个I帧或者分片结束为该I帧的时长
+func (h *HLSRecorder) addIFrame(endTime uint32) {
+	if h.iframe == nil {
+		return
+	}
+	h.iframe.Duration = float64(endTime-h.iframeTime) / 1000
+	h.iframes.add(*h.iframe)
+	h.iframe = nil
+}
+
+func (h *HLSRecorder) writeIFramesPlaylist() error {
+	if len(h.iframes.segments) == 0 {
+		return nil
+	}
+	if err := h.iframes.write(); err != nil {
+		return err
+	}
+	return writeHLSMasterPlaylist(hlsMasterPlaylistPath(h.playlist.path), h.playlist, h.iframes)
+}
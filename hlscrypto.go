@@ -0,0 +1,258 @@
+package record
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/binary"
+	"encoding/hex"
+	"net/http"
+	"strings"
+	"time"
+)
+
+const (
+	hlsMethodAES128    = "AES-128"
+	hlsMethodSampleAES = "SAMPLE-AES"
+)
+
+// hls录像加密配置
+type HLSEncryption struct {
+	Method      string `desc:"加密方式，AES-128加密整个分片，SAMPLE-AES只加密h264和aac的采样数据，空表示不加密，只支持ts分片"`
+	KeyRotation int    `desc:"每隔多少个分片更换一次密钥，0表示每次录制使用一个密钥"`
+	KeyURI      string `desc:"m3u8中密钥的地址，默认/record/api/hls/key"`
+	Token       string `desc:"获取密钥需要的token，通过token参数或者Authorization: Bearer头传递，为空时不提供密钥"`
+}
+
+// 录制中使用的密钥
+type hlsKey struct {
+	id  string
+	key []byte
+	uri string
+}
+
+// 生成新的密钥并保存到数据库，m3u8中只记录密钥的地址
+func newHLSKey(streamPath, method string) (k *hlsKey, err error) {
+	k = &hlsKey{key: make([]byte, 16)}
+	id := make([]byte, 16)
+	if _, err = rand.Read(k.key); err != nil {
+		return
+	}
+	if _, err = rand.Read(id); err != nil {
+		return
+	}
+	k.id = hex.EncodeToString(id)
+	keyURI := RecordPluginConfig.HlsEncryption.KeyURI
+	if keyURI == "" {
+		keyURI = "/record/api/hls/key"
+	}
+	if strings.Contains(keyURI, "?") {
+		k.uri = keyURI + "&id=" + k.id
+	} else {
+		k.uri = keyURI + "?id=" + k.id
+	}
+	err = db.Create(&HLSKey{
+		KeyId:      k.id,
+		StreamPath: streamPath,
+		Method:     method,
+		Key:        hex.EncodeToString(k.key),
+		CreateTime: time.Now().Format("2006-01-02 15:04:05"),
+	}).Error
+	return
+}
+
+// 使用分片的序号作为IV，与没有指定IV时播放器使用的值相同
+func hlsSequenceIV(sequence int) []byte {
+	iv := make([]byte, 16)
+	binary.BigEndian.PutUint64(iv[8:], uint64(sequence))
+	return iv
+}
+
+// EXT-X-KEY中IV属性的格式
+func hlsIVString(iv []byte) string {
+	return "0x" + hex.EncodeToString(iv)
+}
+
+// 使用AES-128-CBC加密整个分片，关闭时补齐PKCS7填充
+type aesFileWriter struct {
+	FileWr
+	mode    cipher.BlockMode
+	pending []byte
+	buf     []byte
+}
+
+func newAESFileWriter(file FileWr, key, iv []byte) (w *aesFileWriter, err error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return
+	}
+	return &aesFileWriter{FileWr: file, mode: cipher.NewCBCEncrypter(block, iv)}, nil
+}
+
+func (w *aesFileWriter) Write(p []byte) (n int, err error) {
+	n = len(p)
+	w.pending = append(w.pending, p...)
+	if size := len(w.pending) / aes.BlockSize * aes.BlockSize; size > 0 {
+		if cap(w.buf) < size {
+			w.buf = make([]byte, size)
+		}
+		out := w.buf[:size]
+		w.mode.CryptBlocks(out, w.pending[:size])
+		w.pending = append(w.pending[:0], w.pending[size:]...)
+		_, err = w.FileWr.Write(out)
+	}
+	return
+}
+
+func (w *aesFileWriter) Close() error {
+	padding := aes.BlockSize - len(w.pending)
+	for i := 0; i < padding; i++ {
+		w.pending = append(w.pending, byte(padding))
+	}
+	out := make([]byte, len(w.pending))
+	w.mode.CryptBlocks(out, w.pending)
+	_, err := w.FileWr.Write(out)
+	if closeErr := w.FileWr.Close(); err == nil {
+		err = closeErr
+	}
+	return err
+}
+
+// 去掉防竞争字节
+func removeEmulationPrevention(nalu []byte) []byte {
+	out := make([]byte, 0, len(nalu))
+	zeros := 0
+	for _, b := range nalu {
+		if zeros >= 2 && b == 3 {
+			zeros = 0
+			continue
+		}
+		if b == 0 {
+			zeros++
+		} else {
+			zeros = 0
+		}
+		out = append(out, b)
+	}
+	return out
+}
+
+// 插入防竞争字节，避免加密后的数据中出现起始码
+func addEmulationPrevention(nalu []byte) []byte {
+	out := make([]byte, 0, len(nalu)+len(nalu)/64)
+	zeros := 0
+	for _, b := range nalu {
+		if zeros >= 2 && b <= 3 {
+			out = append(out, 3)
+			zeros = 0
+		}
+		if b == 0 {
+			zeros++
+		} else {
+			zeros = 0
+		}
+		out = append(out, b)
+	}
+	return out
+}
+
+// 按SAMPLE-AES加密h264的slice：前32字节不加密，之后每10个16字节的块加密第1个，每个nalu重新使用IV
+func sampleAESEncryptNALU(block cipher.Block, iv []byte, nalu []byte) []byte {
+	if len(nalu) <= 48 {
+		return nalu
+	}
+	switch nalu[0] & 0x1f {
+	case 1, 5:
+	default:
+		return nalu
+	}
+	data := removeEmulationPrevention(nalu)
+	mode := cipher.NewCBCEncrypter(block, iv)
+	for offset := 32; offset+aes.BlockSize < len(data); offset += aes.BlockSize * 10 {
+		mode.CryptBlocks(data[offset:offset+aes.BlockSize], data[offset:offset+aes.BlockSize])
+	}
+	return addEmulationPrevention(data)
+}
+
+// 按SAMPLE-AES加密adts帧：adts头和之后的16字节不加密，剩余完整的块加密，不足一个块的部分不加密
+func sampleAESEncryptADTS(block cipher.Block, iv []byte, frame []byte, headerSize int) []byte {
+	offset := headerSize + 16
+	if size := (len(frame) - offset) / aes.BlockSize * aes.BlockSize; size > 0 {
+		cipher.NewCBCEncrypter(block, iv).CryptBlocks(frame[offset:offset+size], frame[offset:offset+size])
+	}
+	return frame
+}
+
+// MPEG-2的CRC32，用于PSI表
+func mpegCRC32(data []byte) (crc uint32) {
+	crc = 0xffffffff
+	for _, b := range data {
+		crc ^= uint32(b) << 24
+		for i := 0; i < 8; i++ {
+			if crc&0x80000000 != 0 {
+				crc = crc<<1 ^ 0x04c11db7
+			} else {
+				crc <<= 1
+			}
+		}
+	}
+	return
+}
+
+// SAMPLE-AES的PMT，视频类型为0xdb，音频类型为0xcf，并带有private_data_indicator和音频配置描述符
+func sampleAESPMTPacket(pid, pcrPid, videoPid, audioPid uint16, asc []byte, cc byte) []byte {
+	section := []byte{0x02, 0, 0, 0x00, 0x01, 0xc1, 0x00, 0x00, 0xe0 | byte(pcrPid>>8), byte(pcrPid), 0xf0, 0x00}
+	addStream := func(streamType byte, streamPid uint16, descriptors []byte) {
+		section = append(section, streamType, 0xe0|byte(streamPid>>8), byte(streamPid), 0xf0|byte(len(descriptors)>>8), byte(len(descriptors)))
+		section = append(section, descriptors...)
+	}
+	if videoPid != 0 {
+		addStream(0xdb, videoPid, []byte{0x0f, 4, 'z', 'a', 'v', 'c'})
+	}
+	if audioPid != 0 {
+		setup := append([]byte{'z', 'a', 'a', 'c', 0, 0, 1, byte(len(asc))}, asc...)
+		registration := append([]byte{0x05, byte(4 + len(setup)), 'a', 'p', 'a', 'd'}, setup...)
+		addStream(0xcf, audioPid, append([]byte{0x0f, 4, 'a', 'a', 'c', 'd'}, registration...))
+	}
+	length := len(section) - 3 + 4
+	section[1] = 0xb0 | byte(length>>8)
+	section[2] = byte(length)
+	section = binary.BigEndian.AppendUint32(section, mpegCRC32(section))
+	packet := make([]byte, 188)
+	for i := range packet {
+		packet[i] = 0xff
+	}
+	packet[0] = 0x47
+	packet[1] = 0x40 | byte(pid>>8)
+	packet[2] = byte(pid)
+	packet[3] = 0x10 | cc&0x0f
+	packet[4] = 0 // pointer_field
+	copy(packet[5:], section)
+	return packet
+}
+
+// 获取hls录像的密钥，/record/api/hls/key?id=xxx&token=xxx
+func (conf *RecordConfig) API_hls_key(w http.ResponseWriter, r *http.Request) {
+	token := r.URL.Query().Get("token")
+	if auth := r.Header.Get("Authorization"); strings.HasPrefix(auth, "Bearer ") {
+		token = strings.TrimPrefix(auth, "Bearer ")
+	}
+	if conf.HlsEncryption.Token == "" || token != conf.HlsEncryption.Token {
+		// 播放器根据状态码判断失败，不能返回json
+		http.Error(w, "unauthorized", http.StatusUnauthorized)
+		return
+	}
+	var key HLSKey
+	if err := db.Where("key_id = ?", r.URL.Query().Get("id")).First(&key).Error; err != nil {
+		http.Error(w, "key not found", http.StatusNotFound)
+		return
+	}
+	data, err := hex.DecodeString(key.Key)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/octet-stream")
+	w.Header().Set("Cache-Control", "no-store")
+	w.Write(data)
+}
@@ -0,0 +1,319 @@
+package record
+
+import (
+	"bytes"
+	"fmt"
+	"math"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"m7s.live/engine/v4/util"
+)
+
+const hlsDateTimeFormat = "2006-01-02T15:04:05.000Z07:00"
+
+// 录制的m3u8中的一个分片
+type hlsSegment struct {
+	Duration      float64
+	URI           string
+	DateTime      time.Time // 分片开始的时间
+	Discontinuity bool      // 与上一个分片的时间戳不连续，例如重新推流
+	Map           string    // CMAF的初始化分片
+	KeyMethod     string    // 加密方式，空表示不加密
+	KeyURI        string
+	KeyIV         string // 十六进制的IV，I帧列表中的序号与分片不同，必须显式指定
+	Length        int64  // 分片的字节数，I帧列表中为I帧的字节数
+	Offset        int64  // I帧列表中I帧在分片中的偏移
+	MapLength     int64  // I帧列表中EXT-X-MAP引用分片开头的PAT和PMT
+}
+
+// 录制的m3u8播放列表，可以在重新推流时继续追加
+// 录制中新的分片直接追加到文件末尾，列表头变化(例如EXT-X-TARGETDURATION变大)或者结束录制时才整体重写
+type hlsPlaylist struct {
+	path          string
+	version       int
+	segments      []hlsSegment
+	ended         bool
+	resumed       bool // 已有分片，下一个分片前插入EXT-X-DISCONTINUITY
+	iframes       bool // EXT-X-I-FRAMES-ONLY列表，每一项是分片中一个I帧的字节范围
+	target        int  // 分片的最大时长，向上取整
+	written       int  // 文件中已经写入的分片数，0表示下次需要整体重写
+	writtenTarget int  // 文件中的EXT-X-TARGETDURATION
+	tags          hlsTagState
+	peak          int64 // 已经统计过的分片的峰值码率
+	measured      int   // 已经统计过码率的分片数
+}
+
+// 写入分片时当前生效的EXT-X-MAP和EXT-X-KEY，变化时才需要重新写入
+type hlsTagState struct {
+	mapURI, keyMethod, keyURI, keyIV string
+}
+
+// 读取已经存在的m3u8，文件不存在时返回空的播放列表
+func loadHLSPlaylist(path string) (p *hlsPlaylist) {
+	p = &hlsPlaylist{path: path, version: 3}
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return
+	}
+	var seg hlsSegment
+	var currentMap, keyMethod, keyURI, keyIV string
+	var mapLength int64
+	for _, line := range strings.Split(string(data), "\n") {
+		line = strings.TrimSpace(line)
+		switch {
+		case strings.HasPrefix(line, "#EXT-X-VERSION:"):
+			if v, err := strconv.Atoi(line[len("#EXT-X-VERSION:"):]); err == nil && v > p.version {
+				p.version = v
+			}
+		case line == "#EXT-X-I-FRAMES-ONLY":
+			p.iframes = true
+		case line == "#EXT-X-DISCONTINUITY":
+			seg.Discontinuity = true
+		case strings.HasPrefix(line, "#EXT-X-MAP:"):
+			attrs := parseHLSAttributes(line[len("#EXT-X-MAP:"):])
+			currentMap = attrs["URI"]
+			mapLength, _ = parseHLSByteRange(attrs["BYTERANGE"])
+		case strings.HasPrefix(line, "#EXT-X-KEY:"):
+			attrs := parseHLSAttributes(line[len("#EXT-X-KEY:"):])
+			if keyMethod, keyURI, keyIV = attrs["METHOD"], attrs["URI"], attrs["IV"]; keyMethod == "NONE" {
+				keyMethod, keyURI, keyIV = "", "", ""
+			}
+		case strings.HasPrefix(line, "#EXT-X-BYTERANGE:"):
+			seg.Length, seg.Offset = parseHLSByteRange(line[len("#EXT-X-BYTERANGE:"):])
+		case strings.HasPrefix(line, "#EXT-X-PROGRAM-DATE-TIME:"):
+			seg.DateTime, _ = time.Parse(hlsDateTimeFormat, line[len("#EXT-X-PROGRAM-DATE-TIME:"):])
+		case strings.HasPrefix(line, "#EXTINF:"):
+			duration, _, _ := strings.Cut(line[len("#EXTINF:"):], ",")
+			seg.Duration, _ = strconv.ParseFloat(duration, 64)
+		case line != "" && !strings.HasPrefix(line, "#"):
+			seg.URI = line
+			seg.Map, seg.MapLength = currentMap, mapLength
+			seg.KeyMethod, seg.KeyURI, seg.KeyIV = keyMethod, keyURI, keyIV
+			p.segments = append(p.segments, seg)
+			seg = hlsSegment{}
+		}
+	}
+	p.resumed = len(p.segments) > 0
+	for _, seg := range p.segments {
+		p.updateTarget(seg)
+	}
+	return
+}
+
+// 解析标签的属性列表，引号中的逗号不作为分隔符，返回的值去掉了引号
+func parseHLSAttributes(line string) map[string]string {
+	attrs := make(map[string]string)
+	for line != "" {
+		name, rest, _ := strings.Cut(line, "=")
+		var value string
+		if strings.HasPrefix(rest, "\"") {
+			end := strings.IndexByte(rest[1:], '"')
+			if end < 0 {
+				end = len(rest) - 1
+			}
+			value, rest = rest[1:end+1], rest[end+1:]
+			rest = strings.TrimPrefix(rest, "\"")
+		} else {
+			value, rest, _ = strings.Cut(rest, ",")
+		}
+		attrs[strings.TrimSpace(name)] = value
+		line = strings.TrimPrefix(rest, ",")
+	}
+	return attrs
+}
+
+// 解析n@o格式的字节范围
+func parseHLSByteRange(value string) (length, offset int64) {
+	l, o, _ := strings.Cut(value, "@")
+	length, _ = strconv.ParseInt(l, 10, 64)
+	offset, _ = strconv.ParseInt(o, 10, 64)
+	return
+}
+
+// I帧列表和主列表的文件名，与媒体列表在同一个目录
+func hlsIFramesPlaylistPath(path string) string {
+	ext := filepath.Ext(path)
+	return strings.TrimSuffix(path, ext) + "_iframes" + ext
+}
+
+func hlsMasterPlaylistPath(path string) string {
+	ext := filepath.Ext(path)
+	return strings.TrimSuffix(path, ext) + "_master" + ext
+}
+
+// 录像列表中不显示I帧列表和主列表
+func isHLSAuxPlaylist(path string) bool {
+	name := strings.TrimSuffix(path, filepath.Ext(path))
+	return strings.HasSuffix(name, "_iframes") || strings.HasSuffix(name, "_master")
+}
+
+// 开始一次新的录制，version取已有文件和当前录制中较大的版本
+func (p *hlsPlaylist) begin(version int) {
+	if version > p.version {
+		p.version = version
+	}
+	p.ended = false
+	p.written = 0
+}
+
+func (p *hlsPlaylist) add(seg hlsSegment) {
+	if p.resumed {
+		seg.Discontinuity = true
+		p.resumed = false
+	}
+	p.segments = append(p.segments, seg)
+	p.updateTarget(seg)
+}
+
+func (p *hlsPlaylist) updateTarget(seg hlsSegment) {
+	if d := int(math.Ceil(seg.Duration)); d > p.target {
+		p.target = d
+	}
+}
+
+// 分片的最大时长，向上取整
+func (p *hlsPlaylist) targetDuration() int {
+	if p.target == 0 {
+		return 1
+	}
+	return p.target
+}
+
+func (p *hlsPlaylist) write() error {
+	// 录制中且列表头没有变化时只追加新的分片，一次Write写入，播放器最多读到追加前的列表
+	if p.written > 0 && !p.ended && p.writtenTarget == p.targetDuration() {
+		var b bytes.Buffer
+		tags := p.tags
+		for _, seg := range p.segments[p.written:] {
+			p.writeSegment(&b, &tags, seg)
+		}
+		err := appendHLSFile(p.path, b.Bytes())
+		if err == nil {
+			p.written, p.tags = len(p.segments), tags
+			return nil
+		}
+		// 追加失败时整体重写
+	}
+	var b bytes.Buffer
+	b.WriteString("#EXTM3U\n")
+	fmt.Fprintf(&b, "#EXT-X-VERSION:%d\n", p.version)
+	fmt.Fprintf(&b, "#EXT-X-TARGETDURATION:%d\n", p.targetDuration())
+	b.WriteString("#EXT-X-MEDIA-SEQUENCE:0\n")
+	if p.iframes {
+		b.WriteString("#EXT-X-I-FRAMES-ONLY\n")
+	}
+	if p.ended {
+		b.WriteString("#EXT-X-PLAYLIST-TYPE:VOD\n")
+	} else {
+		b.WriteString("#EXT-X-PLAYLIST-TYPE:EVENT\n")
+	}
+	var tags hlsTagState
+	for _, seg := range p.segments {
+		p.writeSegment(&b, &tags, seg)
+	}
+	if p.ended {
+		b.WriteString("#EXT-X-ENDLIST\n")
+	}
+	if err := writeHLSFile(p.path, b.Bytes()); err != nil {
+		p.written = 0
+		return err
+	}
+	p.tags, p.writtenTarget = tags, p.targetDuration()
+	// 写入EXT-X-ENDLIST后不能再追加，重新开始录制时整体重写
+	p.written = util.Conditoinal(p.ended, 0, len(p.segments))
+	return nil
+}
+
+// 写入一个分片及其前面需要的标签，tags为写入前生效的标签，写入后更新
+func (p *hlsPlaylist) writeSegment(b *bytes.Buffer, tags *hlsTagState, seg hlsSegment) {
+	if seg.Discontinuity {
+		b.WriteString("#EXT-X-DISCONTINUITY\n")
+	}
+	if seg.Map != "" && (seg.Map != tags.mapURI || seg.Discontinuity) {
+		if seg.MapLength > 0 {
+			fmt.Fprintf(b, "#EXT-X-MAP:URI=\"%s\",BYTERANGE=\"%d@0\"\n", seg.Map, seg.MapLength)
+		} else {
+			fmt.Fprintf(b, "#EXT-X-MAP:URI=\"%s\"\n", seg.Map)
+		}
+		tags.mapURI = seg.Map
+	}
+	if seg.KeyMethod != tags.keyMethod || seg.KeyURI != tags.keyURI || seg.KeyIV != tags.keyIV {
+		switch {
+		case seg.KeyMethod == "":
+			b.WriteString("#EXT-X-KEY:METHOD=NONE\n")
+		case seg.KeyIV != "":
+			fmt.Fprintf(b, "#EXT-X-KEY:METHOD=%s,URI=\"%s\",IV=%s\n", seg.KeyMethod, seg.KeyURI, seg.KeyIV)
+		default:
+			fmt.Fprintf(b, "#EXT-X-KEY:METHOD=%s,URI=\"%s\"\n", seg.KeyMethod, seg.KeyURI)
+		}
+		tags.keyMethod, tags.keyURI, tags.keyIV = seg.KeyMethod, seg.KeyURI, seg.KeyIV
+	}
+	if !seg.DateTime.IsZero() {
+		fmt.Fprintf(b, "#EXT-X-PROGRAM-DATE-TIME:%s\n", seg.DateTime.Format(hlsDateTimeFormat))
+	}
+	fmt.Fprintf(b, "#EXTINF:%.3f,\n", seg.Duration)
+	if p.iframes {
+		fmt.Fprintf(b, "#EXT-X-BYTERANGE:%d@%d\n", seg.Length, seg.Offset)
+	}
+	b.WriteString(seg.URI + "\n")
+}
+
+// 峰值码率(bit/s)，主列表中已有的分片没有记录大小时读取文件大小，只统计新增的分片
+func (p *hlsPlaylist) bandwidth() int64 {
+	for ; p.measured < len(p.segments); p.measured++ {
+		seg := &p.segments[p.measured]
+		if seg.Length == 0 && !p.iframes {
+			if info, err := os.Stat(filepath.Join(filepath.Dir(p.path), filepath.FromSlash(seg.URI))); err == nil {
+				seg.Length = info.Size()
+			}
+		}
+		if seg.Duration > 0 {
+			if bw := int64(float64(seg.Length*8) / seg.Duration); bw > p.peak {
+				p.peak = bw
+			}
+		}
+	}
+	if p.peak == 0 {
+		return 1
+	}
+	return p.peak
+}
+
+// 主列表，同时引用媒体列表和I帧列表，播放器通过EXT-X-I-FRAME-STREAM-INF找到I帧列表
+func writeHLSMasterPlaylist(path string, media, iframes *hlsPlaylist) error {
+	var b bytes.Buffer
+	b.WriteString("#EXTM3U\n")
+	version := media.version
+	if iframes.version > version {
+		version = iframes.version
+	}
+	fmt.Fprintf(&b, "#EXT-X-VERSION:%d\n", version)
+	fmt.Fprintf(&b, "#EXT-X-STREAM-INF:BANDWIDTH=%d\n%s\n", media.bandwidth(), filepath.Base(media.path))
+	fmt.Fprintf(&b, "#EXT-X-I-FRAME-STREAM-INF:BANDWIDTH=%d,URI=\"%s\"\n", iframes.bandwidth(), filepath.Base(iframes.path))
+	return writeHLSFile(path, b.Bytes())
+}
+
+// 先写入临时文件再替换，播放器不会读到写了一半的列表
+func writeHLSFile(path string, data []byte) error {
+	tmpPath := path + ".tmp"
+	if err := os.WriteFile(tmpPath, data, 0666); err != nil {
+		return err
+	}
+	return os.Rename(tmpPath, path)
+}
+
+func appendHLSFile(path string, data []byte) error {
+	file, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND, 0666)
+	if err != nil {
+		return err
+	}
+	if _, err = file.Write(data); err != nil {
+		file.Close()
+		return err
+	}
+	return file.Close()
+}
@@ -0,0 +1,148 @@
+package record
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestHLSPlaylist(t *testing.T) {
+	start := time.Date(2024, 10, 7, 8, 0, 0, 0, time.UTC)
+	const iv = "0x00000000000000000000000000000001"
+	tests := []struct {
+		name     string
+		iframes  bool
+		sessions [][]hlsSegment // 每一次录制写入的分片
+		open     bool           // 最后一次录制没有结束
+		want     []hlsSegment   // 重新读取得到的分片
+		counts   map[string]int // 文件中出现的次数
+	}{
+		{
+			name: "media",
+			sessions: [][]hlsSegment{{
+				{Duration: 4, URI: "0.ts", DateTime: start},
+				{Duration: 4.5, URI: "1.ts", DateTime: start.Add(4 * time.Second)},
+			}},
+			want: []hlsSegment{
+				{Duration: 4, URI: "0.ts", DateTime: start},
+				{Duration: 4.5, URI: "1.ts", DateTime: start.Add(4 * time.Second)},
+			},
+			counts: map[string]int{"#EXTM3U\n": 1, "#EXT-X-TARGETDURATION:5\n": 1, "#EXT-X-PLAYLIST-TYPE:VOD\n": 1, "#EXT-X-ENDLIST\n": 1, "#EXT-X-PROGRAM-DATE-TIME:2024-10-07T08:00:04.000Z\n": 1},
+		},
+		{
+			name: "resume",
+			sessions: [][]hlsSegment{
+				{{Duration: 2, URI: "0.ts"}, {Duration: 2, URI: "1.ts"}},
+				{{Duration: 2, URI: "2.ts"}, {Duration: 2, URI: "3.ts"}},
+			},
+			want: []hlsSegment{
+				{Duration: 2, URI: "0.ts"},
+				{Duration: 2, URI: "1.ts"},
+				{Duration: 2, URI: "2.ts", Discontinuity: true},
+				{Duration: 2, URI: "3.ts"},
+			},
+			counts: map[string]int{"#EXTM3U\n": 1, "#EXT-X-DISCONTINUITY\n": 1, "#EXT-X-ENDLIST\n": 1},
+		},
+		{
+			name: "key",
+			sessions: [][]hlsSegment{{
+				{Duration: 2, URI: "0.ts", KeyMethod: "AES-128", KeyURI: "key.bin", KeyIV: iv},
+				{Duration: 2, URI: "1.ts", KeyMethod: "AES-128", KeyURI: "key.bin", KeyIV: iv},
+				{Duration: 2, URI: "2.ts"},
+			}},
+			want: []hlsSegment{
+				{Duration: 2, URI: "0.ts", KeyMethod: "AES-128", KeyURI: "key.bin", KeyIV: iv},
+				{Duration: 2, URI: "1.ts", KeyMethod: "AES-128", KeyURI: "key.bin", KeyIV: iv},
+				{Duration: 2, URI: "2.ts"},
+			},
+			counts: map[string]int{"#EXT-X-KEY:METHOD=AES-128,URI=\"key.bin\",IV=" + iv + "\n": 1, "#EXT-X-KEY:METHOD=NONE\n": 1},
+		},
+		{
+			name: "map after discontinuity",
+			sessions: [][]hlsSegment{
+				{{Duration: 2, URI: "0.m4s", Map: "init.mp4"}},
+				{{Duration: 2, URI: "1.m4s", Map: "init.mp4"}, {Duration: 2, URI: "2.m4s", Map: "init.mp4"}},
+			},
+			want: []hlsSegment{
+				{Duration: 2, URI: "0.m4s", Map: "init.mp4"},
+				{Duration: 2, URI: "1.m4s", Map: "init.mp4", Discontinuity: true},
+				{Duration: 2, URI: "2.m4s", Map: "init.mp4"},
+			},
+			counts: map[string]int{"#EXT-X-MAP:URI=\"init.mp4\"\n": 2},
+		},
+		{
+			name:    "iframes",
+			iframes: true,
+			sessions: [][]hlsSegment{{
+				{Duration: 1, URI: "0.ts", Map: "0.ts", MapLength: 376, Length: 1000, Offset: 376},
+				{Duration: 1, URI: "0.ts", Map: "0.ts", MapLength: 376, Length: 1200, Offset: 50000},
+				{Duration: 1, URI: "1.ts", Map: "1.ts", MapLength: 376, Length: 900, Offset: 376},
+			}},
+			want: []hlsSegment{
+				{Duration: 1, URI: "0.ts", Map: "0.ts", MapLength: 376, Length: 1000, Offset: 376},
+				{Duration: 1, URI: "0.ts", Map: "0.ts", MapLength: 376, Length: 1200, Offset: 50000},
+				{Duration: 1, URI: "1.ts", Map: "1.ts", MapLength: 376, Length: 900, Offset: 376},
+			},
+			counts: map[string]int{"#EXT-X-I-FRAMES-ONLY\n": 1, "#EXT-X-MAP:URI=\"0.ts\",BYTERANGE=\"376@0\"\n": 1, "#EXT-X-BYTERANGE:1200@50000\n": 1},
+		},
+		{
+			name:     "append while recording",
+			sessions: [][]hlsSegment{{{Duration: 2, URI: "0.ts"}, {Duration: 2, URI: "1.ts"}, {Duration: 2, URI: "2.ts"}}},
+			open:     true,
+			want:     []hlsSegment{{Duration: 2, URI: "0.ts"}, {Duration: 2, URI: "1.ts"}, {Duration: 2, URI: "2.ts"}},
+			counts:   map[string]int{"#EXTM3U\n": 1, "#EXTINF:2.000,\n": 3, "#EXT-X-PLAYLIST-TYPE:EVENT\n": 1, "#EXT-X-ENDLIST\n": 0},
+		},
+		{
+			name:     "target grows while recording",
+			sessions: [][]hlsSegment{{{Duration: 2, URI: "0.ts"}, {Duration: 5.5, URI: "1.ts"}}},
+			open:     true,
+			want:     []hlsSegment{{Duration: 2, URI: "0.ts"}, {Duration: 5.5, URI: "1.ts"}},
+			counts:   map[string]int{"#EXTM3U\n": 1, "#EXT-X-TARGETDURATION:6\n": 1, "#EXT-X-TARGETDURATION:2\n": 0},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			path := filepath.Join(t.TempDir(), "test.m3u8")
+			for i, segments := range tt.sessions {
+				p := loadHLSPlaylist(path)
+				p.iframes = tt.iframes
+				p.begin(3)
+				for _, seg := range segments {
+					p.add(seg)
+					if err := p.write(); err != nil {
+						t.Fatal(err)
+					}
+				}
+				if tt.open && i == len(tt.sessions)-1 {
+					break
+				}
+				p.ended = true
+				if err := p.write(); err != nil {
+					t.Fatal(err)
+				}
+			}
+			data, err := os.ReadFile(path)
+			if err != nil {
+				t.Fatal(err)
+			}
+			for s, n := range tt.counts {
+				if c := strings.Count(string(data), s); c != n {
+					t.Errorf("%q appears %d times, want %d\n%s", s, c, n, data)
+				}
+			}
+			p := loadHLSPlaylist(path)
+			if p.iframes != tt.iframes {
+				t.Errorf("iframes = %v, want %v", p.iframes, tt.iframes)
+			}
+			if !p.resumed {
+				t.Error("loaded playlist should be resumed")
+			}
+			if !reflect.DeepEqual(p.segments, tt.want) {
+				t.Errorf("segments = %+v\nwant %+v", p.segments, tt.want)
+			}
+		})
+	}
+}
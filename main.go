@@ -4,12 +4,14 @@ import (
 	_ "embed"
 	"errors"
 	"fmt"
+	"go.uber.org/zap"
 	"gorm.io/gorm"
 	"io"
 	. "m7s.live/engine/v4"
 	"m7s.live/engine/v4/codec"
 	"m7s.live/engine/v4/config"
 	"m7s.live/engine/v4/util"
+	"m7s.live/plugin/record/v4/recordfile"
 	"net"
 	"os"
 	"sync"
@@ -23,18 +25,32 @@ type RecordConfig struct {
 	Mp4                         Record `desc:"mp4录制配置"`
 	Fmp4                        Record `desc:"fmp4录制配置"`
 	Hls                         Record `desc:"hls录制配置"`
+	Ts                          Record `desc:"ts录制配置"`
+	Mkv                         Record `desc:"mkv录制配置"`
+	Ps                          Record `desc:"ps录制配置"`
+	Rtp                         Record `desc:"rtp抓包录制配置"`
 	Raw                         Record `desc:"视频裸流录制配置"`
 	RawAudio                    Record `desc:"音频裸流录制配置"`
 	recordings                  sync.Map
-	beforeDuration              int     `desc:"事件前缓存时长"`
-	afterDuration               int     `desc:"事件后缓存时长"`
-	MysqlDSN                    string  `desc:"mysql数据库连接字符串"`
-	ExceptionPostUrl            string  `desc:"第三方异常上报地址"`
-	SqliteDbPath                string  `desc:"sqlite数据库路径"`
-	DiskMaxPercent              float64 `desc:"硬盘使用百分之上限值，超过后报警"`
-	LocalIp                     string  `desc:"本机IP"`
-	RecordFileExpireDays        int     `desc:"录像自动删除的天数,0或未设置表示不自动删除"`
-	RecordPathNotShowStreamPath bool    `desc:"录像路径中是否包含streamPath，默认true"`
+	publishers                  sync.Map
+	beforeDuration              int              `desc:"事件前缓存时长"`
+	afterDuration               int              `desc:"事件后缓存时长"`
+	MysqlDSN                    string           `desc:"mysql数据库连接字符串"`
+	ExceptionPostUrl            string           `desc:"第三方异常上报地址"`
+	SqliteDbPath                string           `desc:"sqlite数据库路径"`
+	DiskMaxPercent              float64          `desc:"硬盘使用百分之上限值，超过后报警"`
+	LocalIp                     string           `desc:"本机IP"`
+	RecordFileExpireDays        int              `desc:"录像自动删除的天数,0或未设置表示不自动删除"`
+	RecordPathNotShowStreamPath bool             `desc:"录像路径中是否包含streamPath，默认true"`
+	HlsSegmentFormat            string           `desc:"hls录制的分片格式，ts或fmp4(CMAF，生成init.mp4和.m4s分片)，默认ts"`
+	HlsEncryption               HLSEncryption    `desc:"hls录像加密配置"`
+	Simulate                    []SimulateCamera `desc:"启动时循环发布录像来模拟摄像头"`
+	simulations                 sync.Map
+	ExportPath                  string `desc:"录像导出文件的存储目录"`
+	ExportWorkers               int    `desc:"同时执行的导出任务数"`
+	exportTasks                 sync.Map
+	waitingRecorders            sync.Map // 断流后等待重新推流的录像
+	planRecordings              sync.Map // 按计划启动的录像
 }
 
 //go:embed default.yaml
@@ -42,21 +58,44 @@ var defaultYaml DefaultYaml
 var ErrRecordExist = errors.New("recorder exist")
 var RecordPluginConfig = &RecordConfig{
 	Flv: Record{
-		Path:          "record/flv",
-		Ext:           ".flv",
-		GetDurationFn: getFLVDuration,
+		Path:                 "record/flv",
+		Ext:                  ".flv",
+		GetDurationFn:        getFLVDuration,
+		DropUnsupportedAudio: true,
 	},
 	Fmp4: Record{
-		Path: "record/fmp4",
-		Ext:  ".mp4",
+		Path:                 "record/fmp4",
+		Ext:                  ".mp4",
+		DropUnsupportedAudio: true,
 	},
 	Mp4: Record{
-		Path: "record/mp4",
-		Ext:  ".mp4",
+		Path:                 "record/mp4",
+		Ext:                  ".mp4",
+		DropUnsupportedAudio: true,
 	},
 	Hls: Record{
-		Path: "record/hls",
-		Ext:  ".m3u8",
+		Path:                 "record/hls",
+		Ext:                  ".m3u8",
+		DropUnsupportedAudio: true,
+	},
+	Ts: Record{
+		Path:                 "record/ts",
+		Ext:                  ".ts",
+		DropUnsupportedAudio: true,
+	},
+	Mkv: Record{
+		Path:                 "record/mkv",
+		Ext:                  ".mkv",
+		DropUnsupportedAudio: true,
+	},
+	Ps: Record{
+		Path:                 "record/ps",
+		Ext:                  ".ps",
+		DropUnsupportedAudio: true,
+	},
+	Rtp: Record{
+		Path: "record/rtp",
+		Ext:  ".pcap",
 	},
 	Raw: Record{
 		Path: "record/raw",
@@ -75,6 +114,8 @@ var RecordPluginConfig = &RecordConfig{
 	LocalIp:                     getLocalIP(),
 	RecordFileExpireDays:        0,
 	RecordPathNotShowStreamPath: true,
+	ExportPath:                  "record/export",
+	ExportWorkers:               2,
 }
 
 var plugin = InstallPlugin(RecordPluginConfig, defaultYaml)
@@ -84,6 +125,7 @@ var db *gorm.DB
 func (conf *RecordConfig) OnEvent(event any) {
 	switch v := event.(type) {
 	case FirstConfig, config.Config:
+		recordfile.MetaDataCreator = "m7s " + Engine.Version
 		//if conf.MysqlDSN == "" {
 		//	plugin.Error("mysqlDSN 数据库连接配置为空，无法运行，请在config.yaml里配置")
 		//}
@@ -100,6 +142,9 @@ func (conf *RecordConfig) OnEvent(event any) {
 			plugin.Info("mysqlDSN is" + conf.MysqlDSN)
 			db = initMysqlDB(conf.MysqlDSN)
 		}
+		conf.startExportWorkers()
+		conf.startScheduler()
+		conf.startRuleRetention()
 
 		if conf.RecordFileExpireDays > 0 { //当有设置录像文件自动删除时间时，则开始运行录像自动删除的进程
 			//主要逻辑为
@@ -135,35 +180,59 @@ func (conf *RecordConfig) OnEvent(event any) {
 				}
 			}()
 		}
+		_, first := event.(FirstConfig)
+		conf.loadSettings(first)
 		conf.Flv.Init()
 		conf.Mp4.Init()
 		conf.Fmp4.Init()
 		conf.Hls.Init()
+		conf.Ts.Init()
+		conf.Mkv.Init()
+		conf.Ps.Init()
+		conf.Rtp.Init()
 		conf.Raw.Init()
 		conf.RawAudio.Init()
+		// 配置重新加载时模拟摄像头已经在运行
+		if first {
+			for _, camera := range conf.Simulate {
+				if err := conf.startSimulation(camera); err != nil {
+					plugin.Error("simulate camera", zap.String("streamPath", camera.StreamPath), zap.Error(err))
+				}
+			}
+		}
 	case SEpublish:
 		streamPath := v.Target.Path
-		if conf.Flv.NeedRecord(streamPath) {
-			go NewFLVRecorder(OrdinaryMode).Start(streamPath)
-		}
-		if conf.Mp4.NeedRecord(streamPath) {
-			go NewMP4Recorder().Start(streamPath)
-		}
-		if conf.Fmp4.NeedRecord(streamPath) {
-			go NewFMP4Recorder().Start(streamPath)
-		}
-		if conf.Hls.NeedRecord(streamPath) {
-			go NewHLSRecorder().Start(streamPath)
-		}
-		if conf.Raw.NeedRecord(streamPath) {
-			go NewRawRecorder().Start(streamPath)
-		}
-		if conf.RawAudio.NeedRecord(streamPath) {
-			go NewRawAudioRecorder().Start(streamPath)
+		resumed, resumedIds := conf.resumeRecorders(streamPath)
+		conf.restoreRecordings(streamPath, resumed, resumedIds)
+		go conf.schedulePublish(streamPath)
+		for _, t := range recordTypes {
+			if resumed[t] {
+				continue
+			}
+			if rule, ok := conf.getRecorderConfigByType(t).MatchRule(streamPath); ok {
+				irecorder := newRecorderByType(t)
+				if rule != nil {
+					irecorder.GetRecorder().applyRule(rule)
+				}
+				go irecorder.Start(streamPath)
+			}
 		}
 	}
 }
-func (conf *RecordConfig) getRecorderConfigByType(t string) (recorder *Record) {
+
+// 返回当前生效配置的副本，配置可能被API替换，不能直接读取conf中的字段
+func (conf *RecordConfig) getRecorderConfigByType(t string) *Record {
+	recordConfigLock.RLock()
+	defer recordConfigLock.RUnlock()
+	if recorder := conf.recordConfigRef(t); recorder != nil {
+		record := *recorder
+		return &record
+	}
+	return nil
+}
+
+// 配置字段本身，只在启动时或持有recordConfigLock写锁时使用
+func (conf *RecordConfig) recordConfigRef(t string) (recorder *Record) {
 	switch t {
 	case "flv":
 		recorder = &conf.Flv
@@ -173,6 +242,14 @@ func (conf *RecordConfig) getRecorderConfigByType(t string) (recorder *Record) {
 		recorder = &conf.Fmp4
 	case "hls":
 		recorder = &conf.Hls
+	case "ts":
+		recorder = &conf.Ts
+	case "mkv":
+		recorder = &conf.Mkv
+	case "ps":
+		recorder = &conf.Ps
+	case "rtp":
+		recorder = &conf.Rtp
 	case "raw":
 		recorder = &conf.Raw
 	case "raw_audio":
@@ -0,0 +1,518 @@
+package record
+
+import (
+	"encoding/binary"
+	"errors"
+	"io"
+	"math"
+	"strings"
+	"time"
+
+	"go.uber.org/zap"
+	. "m7s.live/engine/v4"
+	"m7s.live/engine/v4/codec"
+	"m7s.live/engine/v4/util"
+)
+
+// Matroska的元素id
+const (
+	mkvEBML               = 0x1A45DFA3
+	mkvEBMLVersion        = 0x4286
+	mkvEBMLReadVersion    = 0x42F7
+	mkvEBMLMaxIDLength    = 0x42F2
+	mkvEBMLMaxSizeLength  = 0x42F3
+	mkvDocType            = 0x4282
+	mkvDocTypeVersion     = 0x4287
+	mkvDocTypeReadVersion = 0x4285
+	mkvSegment            = 0x18538067
+	mkvSeekHead           = 0x114D9B74
+	mkvSeek               = 0x4DBB
+	mkvSeekID             = 0x53AB
+	mkvSeekPosition       = 0x53AC
+	mkvVoid               = 0xEC
+	mkvInfo               = 0x1549A966
+	mkvTimestampScale     = 0x2AD7B1
+	mkvMuxingApp          = 0x4D80
+	mkvWritingApp         = 0x5741
+	mkvDuration           = 0x4489
+	mkvTracks             = 0x1654AE6B
+	mkvTrackEntry         = 0xAE
+	mkvTrackNumber        = 0xD7
+	mkvTrackUID           = 0x73C5
+	mkvTrackType          = 0x83
+	mkvFlagLacing         = 0x9C
+	mkvCodecID            = 0x86
+	mkvCodecPrivate       = 0x63A2
+	mkvVideo              = 0xE0
+	mkvPixelWidth         = 0xB0
+	mkvPixelHeight        = 0xBA
+	mkvAudio              = 0xE1
+	mkvSamplingFrequency  = 0xB5
+	mkvChannels           = 0x9F
+	mkvBitDepth           = 0x6264
+	mkvCluster            = 0x1F43B675
+	mkvTimestamp          = 0xE7
+	mkvSimpleBlock        = 0xA3
+	mkvCues               = 0x1C53BB6B
+	mkvCuePoint           = 0xBB
+	mkvCueTime            = 0xB3
+	mkvCueTrackPositions  = 0xB7
+	mkvCueTrack           = 0xF7
+	mkvCueClusterPosition = 0xF1
+)
+
+// 文件开头给SeekHead预留的空间
+const mkvSeekHeadReserved = 80
+
+// 没有视频时每个cluster的最大时长(毫秒)
+const mkvClusterDuration = 5000
+
+// 引擎没有VP8、VP9、Opus的编码id，这些轨道按编码名称命名
+func mkvWebMCodec(trackName string) string {
+	switch strings.ToLower(trackName) {
+	case "vp8":
+		return "V_VP8"
+	case "vp9":
+		return "V_VP9"
+	case "opus":
+		return "A_OPUS"
+	}
+	return ""
+}
+
+// mkv录像目录中也包含只有VP8、VP9、Opus轨道时生成的webm文件
+func mkvExtMatch(ext, fileExt string) bool {
+	return ext == ".mkv" && fileExt == ".webm"
+}
+
+func ebmlID(b []byte, id uint32) []byte {
+	switch {
+	case id > 0xFFFFFF:
+		return append(b, byte(id>>24), byte(id>>16), byte(id>>8), byte(id))
+	case id > 0xFFFF:
+		return append(b, byte(id>>16), byte(id>>8), byte(id))
+	case id > 0xFF:
+		return append(b, byte(id>>8), byte(id))
+	}
+	return append(b, byte(id))
+}
+
+// 写入最短的vint
+func ebmlSize(b []byte, size uint64) []byte {
+	length := 1
+	for length < 8 && size >= 1<<(7*length)-1 {
+		length++
+	}
+	size |= 1 << (7 * length)
+	for i := length - 1; i >= 0; i-- {
+		b = append(b, byte(size>>(8*i)))
+	}
+	return b
+}
+
+func ebmlElement(b []byte, id uint32, data []byte) []byte {
+	b = ebmlID(b, id)
+	b = ebmlSize(b, uint64(len(data)))
+	return append(b, data...)
+}
+
+func ebmlUint(b []byte, id uint32, v uint64) []byte {
+	var data [8]byte
+	binary.BigEndian.PutUint64(data[:], v)
+	i := 0
+	for i < 7 && data[i] == 0 {
+		i++
+	}
+	return ebmlElement(b, id, data[i:])
+}
+
+func ebmlFloat(b []byte, id uint32, v float64) []byte {
+	var data [8]byte
+	binary.BigEndian.PutUint64(data[:], math.Float64bits(v))
+	return ebmlElement(b, id, data[:])
+}
+
+func ebmlString(b []byte, id uint32, s string) []byte {
+	return ebmlElement(b, id, []byte(s))
+}
+
+type mkvCuePointInfo struct {
+	time     uint32
+	position uint64 // cluster相对于segment数据开始的位置
+}
+
+// 录制Matroska文件，每个关键帧开始一个新的cluster，关闭时写入Cues和SeekHead
+// 每个cluster写完才落盘，异常退出时只丢失最后一个cluster
+type MKVRecorder struct {
+	Recorder
+	position     int64 // 当前写入的位置
+	segmentStart int64 // segment数据开始的位置
+	infoPos      int64
+	tracksPos    int64
+	durationPos  int64
+	videoTrack   uint64
+	audioTrack   uint64
+	cluster      []byte // 正在缓存的cluster中的block
+	clusterTs    uint32
+	clusterKey   bool // cluster以视频关键帧开始
+	hasCluster   bool
+	firstTs      uint32
+	lastTs       uint32
+	started      bool
+	webm         bool // 只有VP8、VP9、Opus轨道，DocType为webm
+	cues         []mkvCuePointInfo
+}
+
+func (r *MKVRecorder) SetId(streamPath string) {
+	r.ID = streamPath + "/mkv"
+}
+
+// mkv录制只有普通录像
+func (r *MKVRecorder) GetRecordModeString(mode RecordMode) string {
+	return recordModeString(mode)
+}
+
+// 定时停止的录像只支持flv
+func (r *MKVRecorder) StartWithDynamicTimeout(streamPath, fileName string, timeout time.Duration) error {
+	return errors.ErrUnsupported
+}
+
+// 没有定时器，不需要处理
+func (r *MKVRecorder) UpdateTimeout(timeout time.Duration) {
+}
+
+func NewMKVRecorder() *MKVRecorder {
+	r := &MKVRecorder{}
+	r.Record = *RecordPluginConfig.getRecorderConfigByType("mkv")
+	return r
+}
+
+func (r *MKVRecorder) Start(streamPath string) (err error) {
+	r.ID = streamPath + "/mkv"
+	return r.start(r, streamPath, SUBTYPE_RAW)
+}
+
+func (r *MKVRecorder) StartWithFileName(streamPath string, fileName string) error {
+	r.ID = streamPath + "/mkv/" + fileName
+	return r.start(r, streamPath, SUBTYPE_RAW)
+}
+
+// 所有轨道都是webm支持的编码时使用.webm扩展名
+func (r *MKVRecorder) CreateFile() (FileWr, error) {
+	r.webm = r.VideoReader != nil || r.AudioReader != nil
+	if r.VideoReader != nil && mkvWebMCodec(r.Video.GetName()) == "" {
+		r.webm = false
+	}
+	if r.AudioReader != nil && mkvWebMCodec(r.Audio.GetName()) == "" {
+		r.webm = false
+	}
+	if r.Ext == ".mkv" && r.webm {
+		r.Ext = ".webm"
+	} else if r.Ext == ".webm" && !r.webm {
+		r.Ext = ".mkv"
+	}
+	return r.Recorder.CreateFile()
+}
+
+func (r *MKVRecorder) write(data []byte) (err error) {
+	var n int
+	n, err = r.File.Write(data)
+	r.position += int64(n)
+	return
+}
+
+// 在指定位置覆盖写入，写完回到文件末尾
+func (r *MKVRecorder) writeAt(pos int64, data []byte) (err error) {
+	if _, err = r.File.Seek(pos, io.SeekStart); err != nil {
+		return
+	}
+	if _, err = r.File.Write(data); err != nil {
+		return
+	}
+	_, err = r.File.Seek(r.position, io.SeekStart)
+	return
+}
+
+func (r *MKVRecorder) trackEntry(number uint64, trackType uint64, codecID string, private []byte, settings []byte) []byte {
+	var entry []byte
+	entry = ebmlUint(entry, mkvTrackNumber, number)
+	entry = ebmlUint(entry, mkvTrackUID, number)
+	entry = ebmlUint(entry, mkvTrackType, trackType)
+	entry = ebmlUint(entry, mkvFlagLacing, 0)
+	entry = ebmlString(entry, mkvCodecID, codecID)
+	if len(private) > 0 {
+		entry = ebmlElement(entry, mkvCodecPrivate, private)
+	}
+	if trackType == 1 {
+		entry = ebmlElement(entry, mkvVideo, settings)
+	} else {
+		entry = ebmlElement(entry, mkvAudio, settings)
+	}
+	return ebmlElement(nil, mkvTrackEntry, entry)
+}
+
+// G711使用A_MS/ACM，CodecPrivate为WAVEFORMATEX
+func waveFormatEx(formatTag uint16, channels uint16, sampleRate uint32) []byte {
+	b := make([]byte, 18)
+	binary.LittleEndian.PutUint16(b[0:], formatTag)
+	binary.LittleEndian.PutUint16(b[2:], channels)
+	binary.LittleEndian.PutUint32(b[4:], sampleRate)
+	binary.LittleEndian.PutUint32(b[8:], sampleRate*uint32(channels))
+	binary.LittleEndian.PutUint16(b[12:], channels)
+	binary.LittleEndian.PutUint16(b[14:], 8)
+	return b
+}
+
+// Opus的CodecPrivate为OpusHead
+func opusHead(channels uint8, sampleRate uint32) []byte {
+	b := make([]byte, 19)
+	copy(b, "OpusHead")
+	b[8] = 1
+	b[9] = channels
+	binary.LittleEndian.PutUint32(b[12:], sampleRate)
+	return b
+}
+
+func (r *MKVRecorder) tracks() (tracks []byte) {
+	var number uint64
+	if r.VideoReader != nil {
+		var codecID string
+		var private []byte
+		switch r.Video.CodecID {
+		case codec.CodecID_H264:
+			codecID = "V_MPEG4/ISO/AVC"
+		case codec.CodecID_H265:
+			codecID = "V_MPEGH/ISO/HEVC"
+		}
+		if codecID != "" {
+			// h264、h265必须有序列头
+			if len(r.Video.SequenceHead) > 5 {
+				private = r.Video.SequenceHead[5:]
+			} else {
+				codecID = ""
+			}
+		} else {
+			codecID = mkvWebMCodec(r.Video.GetName())
+		}
+		if codecID != "" {
+			number++
+			r.videoTrack = number
+			var settings []byte
+			settings = ebmlUint(settings, mkvPixelWidth, uint64(r.Video.SPSInfo.Width))
+			settings = ebmlUint(settings, mkvPixelHeight, uint64(r.Video.SPSInfo.Height))
+			tracks = append(tracks, r.trackEntry(number, 1, codecID, private, settings)...)
+		}
+	}
+	if r.AudioReader != nil {
+		var codecID string
+		var private []byte
+		switch r.Audio.CodecID {
+		case codec.CodecID_AAC:
+			codecID = "A_AAC"
+			if len(r.Audio.SequenceHead) > 2 {
+				private = r.Audio.SequenceHead[2:]
+			}
+		case codec.CodecID_PCMA:
+			codecID = "A_MS/ACM"
+			private = waveFormatEx(6, uint16(r.Audio.Channels), r.Audio.SampleRate)
+		case codec.CodecID_PCMU:
+			codecID = "A_MS/ACM"
+			private = waveFormatEx(7, uint16(r.Audio.Channels), r.Audio.SampleRate)
+		default:
+			if codecID = mkvWebMCodec(r.Audio.GetName()); codecID == "A_OPUS" {
+				private = opusHead(uint8(r.Audio.Channels), r.Audio.SampleRate)
+			}
+		}
+		if codecID != "" {
+			number++
+			r.audioTrack = number
+			var settings []byte
+			settings = ebmlFloat(settings, mkvSamplingFrequency, float64(r.Audio.SampleRate))
+			settings = ebmlUint(settings, mkvChannels, uint64(r.Audio.Channels))
+			settings = ebmlUint(settings, mkvBitDepth, uint64(r.Audio.SampleSize))
+			tracks = append(tracks, r.trackEntry(number, 2, codecID, private, settings)...)
+		}
+	}
+	return
+}
+
+// 写入EBML头、大小未知的Segment、预留的SeekHead、Info和Tracks
+func (r *MKVRecorder) writeHeader() (err error) {
+	r.position = 0
+	r.videoTrack, r.audioTrack = 0, 0
+	r.cluster = r.cluster[:0]
+	r.hasCluster, r.started = false, false
+	r.firstTs, r.lastTs = 0, 0
+	r.cues = nil
+	var header []byte
+	header = ebmlUint(header, mkvEBMLVersion, 1)
+	header = ebmlUint(header, mkvEBMLReadVersion, 1)
+	header = ebmlUint(header, mkvEBMLMaxIDLength, 4)
+	header = ebmlUint(header, mkvEBMLMaxSizeLength, 8)
+	header = ebmlString(header, mkvDocType, util.Conditoinal(r.webm, "webm", "matroska"))
+	header = ebmlUint(header, mkvDocTypeVersion, 4)
+	header = ebmlUint(header, mkvDocTypeReadVersion, 2)
+	b := ebmlElement(nil, mkvEBML, header)
+	// 大小未知，关闭时再写入
+	b = ebmlID(b, mkvSegment)
+	b = append(b, 0x01, 0xFF, 0xFF, 0xFF, 0xFF, 0xFF, 0xFF, 0xFF)
+	r.segmentStart = int64(len(b))
+	b = ebmlID(b, mkvVoid)
+	b = ebmlSize(b, mkvSeekHeadReserved-2)
+	b = append(b, make([]byte, mkvSeekHeadReserved-2)...)
+	r.infoPos = int64(len(b))
+	var info []byte
+	info = ebmlUint(info, mkvTimestampScale, 1000000)
+	info = ebmlString(info, mkvMuxingApp, "m7s")
+	info = ebmlString(info, mkvWritingApp, "m7s record")
+	info = ebmlFloat(info, mkvDuration, 0)
+	b = ebmlElement(b, mkvInfo, info)
+	r.durationPos = int64(len(b)) - 8
+	r.tracksPos = int64(len(b))
+	b = ebmlElement(b, mkvTracks, r.tracks())
+	return r.write(b)
+}
+
+// 把缓存的cluster写入文件
+func (r *MKVRecorder) flushCluster() (err error) {
+	if !r.hasCluster {
+		return
+	}
+	if r.clusterKey {
+		r.cues = append(r.cues, mkvCuePointInfo{r.clusterTs - r.firstTs, uint64(r.position - r.segmentStart)})
+	}
+	var data []byte
+	data = ebmlUint(data, mkvTimestamp, uint64(r.clusterTs-r.firstTs))
+	data = append(data, r.cluster...)
+	r.cluster = r.cluster[:0]
+	r.hasCluster = false
+	return r.write(ebmlElement(nil, mkvCluster, data))
+}
+
+func (r *MKVRecorder) writeBlock(track uint64, ts uint32, key bool, data []byte) (err error) {
+	if !r.started {
+		r.firstTs = ts
+		r.started = true
+	}
+	if ts < r.firstTs {
+		ts = r.firstTs
+	}
+	relative := int64(ts) - int64(r.clusterTs)
+	// 视频关键帧开始新的cluster，没有视频时按时长切分，相对时间戳超出int16也要切分
+	newCluster := !r.hasCluster || relative > math.MaxInt16 || relative < math.MinInt16
+	if track == r.videoTrack && key {
+		newCluster = true
+	} else if r.videoTrack == 0 && relative >= mkvClusterDuration {
+		newCluster = true
+	}
+	if newCluster {
+		if err = r.flushCluster(); err != nil {
+			return
+		}
+		r.clusterTs = ts
+		r.clusterKey = track == r.videoTrack && key
+		r.hasCluster = true
+		relative = 0
+	}
+	var flags byte
+	if key {
+		flags = 0x80
+	}
+	block := ebmlSize(nil, track)
+	block = append(block, byte(relative>>8), byte(relative), flags)
+	block = append(block, data...)
+	r.cluster = ebmlElement(r.cluster, mkvSimpleBlock, block)
+	if ts > r.lastTs {
+		r.lastTs = ts
+	}
+	return
+}
+
+// SeekHead加上填满预留空间的Void，Void的ID和大小各占1字节
+func mkvSeekHeadBlock(seekHead []byte) []byte {
+	b := ebmlElement(nil, mkvSeekHead, seekHead)
+	voidSize := mkvSeekHeadReserved - len(b) - 2
+	b = ebmlID(b, mkvVoid)
+	b = ebmlSize(b, uint64(voidSize))
+	return append(b, make([]byte, voidSize)...)
+}
+
+// 写入最后一个cluster、Cues、SeekHead，并更新Segment大小和时长
+func (r *MKVRecorder) writeTrailer() (err error) {
+	if err = r.flushCluster(); err != nil {
+		return
+	}
+	cuesPos := r.position - r.segmentStart
+	var cues []byte
+	for _, cue := range r.cues {
+		var positions, point []byte
+		positions = ebmlUint(positions, mkvCueTrack, r.videoTrack)
+		positions = ebmlUint(positions, mkvCueClusterPosition, cue.position)
+		point = ebmlUint(point, mkvCueTime, uint64(cue.time))
+		point = ebmlElement(point, mkvCueTrackPositions, positions)
+		cues = ebmlElement(cues, mkvCuePoint, point)
+	}
+	if len(cues) > 0 {
+		if err = r.write(ebmlElement(nil, mkvCues, cues)); err != nil {
+			return
+		}
+	}
+	var seekHead []byte
+	seek := func(id uint32, pos int64) {
+		var idData, entry []byte
+		idData = ebmlID(idData, id)
+		entry = ebmlElement(entry, mkvSeekID, idData)
+		entry = ebmlUint(entry, mkvSeekPosition, uint64(pos))
+		seekHead = ebmlElement(seekHead, mkvSeek, entry)
+	}
+	seek(mkvInfo, r.infoPos-r.segmentStart)
+	seek(mkvTracks, r.tracksPos-r.segmentStart)
+	if len(cues) > 0 {
+		seek(mkvCues, cuesPos)
+	}
+	if err = r.writeAt(r.segmentStart, mkvSeekHeadBlock(seekHead)); err != nil {
+		return
+	}
+	size := uint64(r.position-r.segmentStart) | 0x01<<56
+	var sizeData [8]byte
+	binary.BigEndian.PutUint64(sizeData[:], size)
+	if err = r.writeAt(r.segmentStart-8, sizeData[:]); err != nil {
+		return
+	}
+	var duration [8]byte
+	binary.BigEndian.PutUint64(duration[:], math.Float64bits(float64(r.lastTs-r.firstTs)))
+	return r.writeAt(r.durationPos, duration[:])
+}
+
+func (r *MKVRecorder) Close() (err error) {
+	if r.File != nil {
+		if err = r.writeTrailer(); err != nil {
+			r.Error("mkv write trailer", zap.Error(err))
+		}
+		err = r.File.Close()
+	}
+	return
+}
+
+func (r *MKVRecorder) OnEvent(event any) {
+	var err error
+	r.Recorder.OnEvent(event)
+	switch v := event.(type) {
+	case FileWr:
+		err = r.writeHeader()
+	case AudioFrame:
+		if r.audioTrack != 0 {
+			err = r.writeBlock(r.audioTrack, r.frameTs, true, v.AUList.ToBytes())
+		}
+	case VideoFrame:
+		if r.videoTrack != 0 {
+			if data := v.AVCC.ToBytes(); len(data) > 5 {
+				// block的时间戳为显示时间
+				err = r.writeBlock(r.videoTrack, r.frameTs+(v.PTS-v.DTS)/90, v.IFrame, data[5:])
+			}
+		}
+	}
+	if err != nil {
+		r.Stop(zap.Error(err))
+	}
+}
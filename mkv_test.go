@@ -0,0 +1,87 @@
+package record
+
+import (
+	"bytes"
+	"testing"
+)
+
+// 读取一个EBML元素，返回id、数据和剩余的字节
+func readEBMLElement(t *testing.T, b []byte) (id uint32, data []byte, rest []byte) {
+	t.Helper()
+	if len(b) == 0 {
+		t.Fatal("empty element")
+	}
+	idLength := 1
+	for idLength <= 4 && b[0]&(0x80>>(idLength-1)) == 0 {
+		idLength++
+	}
+	if idLength > 4 || len(b) < idLength {
+		t.Fatalf("invalid id % x", b)
+	}
+	for _, c := range b[:idLength] {
+		id = id<<8 | uint32(c)
+	}
+	b = b[idLength:]
+	if len(b) == 0 {
+		t.Fatal("missing size")
+	}
+	sizeLength := 1
+	for sizeLength <= 8 && b[0]&(0x80>>(sizeLength-1)) == 0 {
+		sizeLength++
+	}
+	if sizeLength > 8 || len(b) < sizeLength {
+		t.Fatalf("invalid size % x", b)
+	}
+	size := uint64(b[0] & (0xFF >> sizeLength))
+	for _, c := range b[1:sizeLength] {
+		size = size<<8 | uint64(c)
+	}
+	b = b[sizeLength:]
+	if uint64(len(b)) < size {
+		t.Fatalf("element 0x%X size %d exceeds %d bytes", id, size, len(b))
+	}
+	return id, b[:size], b[size:]
+}
+
+func TestEBMLSize(t *testing.T) {
+	for _, size := range []uint64{0, 1, 126, 127, 128, 16382, 16383, 1 << 20} {
+		b := ebmlElement(nil, mkvVoid, make([]byte, size))
+		id, data, rest := readEBMLElement(t, b)
+		if id != mkvVoid || uint64(len(data)) != size || len(rest) != 0 {
+			t.Errorf("size %d: id 0x%X data %d rest %d", size, id, len(data), len(rest))
+		}
+	}
+}
+
+func TestMKVSeekHeadBlock(t *testing.T) {
+	var seekHead []byte
+	for i, pos := range []int64{0x40, 0x1234, 0x12345678} {
+		var idData, entry []byte
+		idData = ebmlID(idData, []uint32{mkvInfo, mkvTracks, mkvCues}[i])
+		entry = ebmlElement(entry, mkvSeekID, idData)
+		entry = ebmlUint(entry, mkvSeekPosition, uint64(pos))
+		seekHead = ebmlElement(seekHead, mkvSeek, entry)
+	}
+	b := mkvSeekHeadBlock(seekHead)
+	if len(b) != mkvSeekHeadReserved {
+		t.Fatalf("block length %d, want %d", len(b), mkvSeekHeadReserved)
+	}
+	// 后面紧接着Info，预留空间必须恰好由SeekHead和Void组成
+	b = append(b, ebmlElement(nil, mkvInfo, ebmlUint(nil, mkvTimestampScale, 1000000))...)
+	var ids []uint32
+	for rest := b; len(rest) > 0; {
+		var id uint32
+		var data []byte
+		id, data, rest = readEBMLElement(t, rest)
+		ids = append(ids, id)
+		if id == mkvSeekHead && !bytes.Equal(data, seekHead) {
+			t.Errorf("seek head mismatch")
+		}
+		if id == mkvVoid && len(bytes.Trim(data, "\x00")) != 0 {
+			t.Errorf("void not zero")
+		}
+	}
+	if len(ids) != 3 || ids[0] != mkvSeekHead || ids[1] != mkvVoid || ids[2] != mkvInfo {
+		t.Fatalf("elements %X", ids)
+	}
+}
@@ -42,7 +42,7 @@ func (r *MP4Recorder) UpdateTimeout(timeout time.Duration) {
 
 func NewMP4Recorder() *MP4Recorder {
 	r := &MP4Recorder{}
-	r.Record = RecordPluginConfig.Mp4
+	r.Record = *RecordPluginConfig.getRecorderConfigByType("mp4")
 	return r
 }
 
@@ -122,13 +122,18 @@ func (r *MP4Recorder) OnEvent(event any) {
 			} else {
 				audioData = util.ConcatBuffers(append(net.Buffers{v.ADTS.Value}, v.AUList.ToBuffers()...))
 			}
-			if err = r.Write(r.audioId, audioData, uint64(v.AbsTime+(v.PTS-v.DTS)/90), uint64(v.AbsTime)); err != nil {
+			if err = r.Write(r.audioId, audioData, uint64(r.frameTs+(v.PTS-v.DTS)/90), uint64(r.frameTs)); err != nil {
 				r.Stop(zap.Error(err))
 			}
 		}
 	case VideoFrame:
 		if r.videoId != 0 {
-			if err = r.Write(r.videoId, util.ConcatBuffers(v.GetAnnexB()), uint64(v.AbsTime+(v.PTS-v.DTS)/90), uint64(v.AbsTime)); err != nil {
+			// B帧的显示时间晚于解码时间，写入ctts；ctts版本0不能表示负数，显示时间早于解码时间时按解码时间显示
+			cto := int32(v.PTS-v.DTS) / 90
+			if cto < 0 {
+				cto = 0
+			}
+			if err = r.Write(r.videoId, util.ConcatBuffers(v.GetAnnexB()), uint64(r.frameTs+uint32(cto)), uint64(r.frameTs)); err != nil {
 				r.Stop(zap.Error(err))
 			}
 		}
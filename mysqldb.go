@@ -24,6 +24,12 @@ func initMysqlDB(MysqlDSN string) *gorm.DB {
 	mysqldb.Exec(useDataBaseSql)
 	mysqldb.AutoMigrate(&EventRecord{})
 	mysqldb.AutoMigrate(&Exception{})
+	mysqldb.AutoMigrate(&ExportJob{})
+	mysqldb.AutoMigrate(&Discontinuity{})
+	mysqldb.AutoMigrate(&ActiveRecording{})
+	mysqldb.AutoMigrate(&RecordPlan{})
+	mysqldb.AutoMigrate(&RecordSetting{})
+	mysqldb.AutoMigrate(&HLSKey{})
 	return mysqldb
 }
 
@@ -0,0 +1,109 @@
+package record
+
+import (
+	"time"
+
+	"go.uber.org/zap"
+	"m7s.live/plugin/record/v4/recordfile"
+)
+
+// 所有支持自动录制的录像类型
+var recordTypes = []string{"flv", "mp4", "fmp4", "hls", "ts", "mkv", "ps", "rtp", "raw", "raw_audio"}
+
+// 根据类型创建录像
+func newRecorderByType(t string) IRecorder {
+	switch t {
+	case "flv":
+		return NewFLVRecorder(OrdinaryMode)
+	case "mp4":
+		return NewMP4Recorder()
+	case "fmp4":
+		return NewFMP4Recorder()
+	case "hls":
+		return NewHLSRecorder()
+	case "ts":
+		return NewTSRecorder()
+	case "mkv":
+		return NewMKVRecorder()
+	case "ps":
+		return NewPSRecorder()
+	case "rtp":
+		return NewRTPRecorder()
+	case "raw":
+		return NewRawRecorder()
+	case "raw_audio":
+		return NewRawAudioRecorder()
+	}
+	return nil
+}
+
+// 保存通过API启动的录像，重复启动时覆盖原来的记录
+func saveActiveRecording(recording *ActiveRecording) {
+	recording.CreateTime = time.Now().Format("2006-01-02 15:04:05")
+	db.Where("recorder_id = ?", recording.RecorderId).Delete(&ActiveRecording{})
+	if err := db.Omit("id").Create(recording).Error; err != nil {
+		plugin.Error("save active recording", zap.String("id", recording.RecorderId), zap.Error(err))
+	}
+}
+
+// 主动停止录像后不再恢复
+func removeActiveRecording(recorderId string) {
+	db.Where("recorder_id = ?", recorderId).Delete(&ActiveRecording{})
+}
+
+// 启动一个保存的录像
+func (recording *ActiveRecording) start() (err error) {
+	irecorder := newRecorderByType(recording.Type)
+	if irecorder == nil {
+		return recordfile.ErrUnsupportedFile
+	}
+	recorder := irecorder.GetRecorder()
+	if recording.Fragment != "" {
+		if f, err := time.ParseDuration(recording.Fragment); err == nil {
+			recorder.Fragment = f
+		}
+	}
+	recorder.FileName = recording.FileName
+	recorder.setTracks(recording.Tracks, recording.DropAudio)
+	recorder.append = recording.Append
+	if recording.Deadline != "" {
+		deadline, err := time.ParseInLocation("2006-01-02 15:04:05", recording.Deadline, time.Local)
+		if err != nil {
+			return err
+		}
+		return irecorder.StartWithDynamicTimeout(recording.StreamPath, recording.FileName, time.Until(deadline))
+	}
+	if recording.FileName != "" {
+		return irecorder.StartWithFileName(recording.StreamPath, recording.FileName)
+	}
+	return irecorder.Start(recording.StreamPath)
+}
+
+// 流发布时恢复保存的录像，恢复的录像类型记录到restored中
+// 在发布事件中调用，录像在协程中启动，避免订阅时阻塞引擎的事件处理
+// resumedIds为断流等待后继续写入原文件的录像，它们的协程可能还没有注册到recordings中，不能重复启动
+func (conf *RecordConfig) restoreRecordings(streamPath string, restored map[string]bool, resumedIds map[string]bool) {
+	var recordings []ActiveRecording
+	db.Where("stream_path = ?", streamPath).Find(&recordings)
+	now := time.Now().Format("2006-01-02 15:04:05")
+	for _, recording := range recordings {
+		if _, ok := conf.recordings.Load(recording.RecorderId); ok || resumedIds[recording.RecorderId] {
+			continue
+		}
+		if _, ok := conf.waitingRecorders.Load(recording.RecorderId); ok {
+			continue
+		}
+		if recording.Deadline != "" && recording.Deadline <= now {
+			removeActiveRecording(recording.RecorderId)
+			continue
+		}
+		restored[recording.Type] = true
+		go func(recording ActiveRecording) {
+			if err := recording.start(); err != nil {
+				plugin.Error("restore recording", zap.String("id", recording.RecorderId), zap.Error(err))
+				return
+			}
+			plugin.Info("restore recording", zap.String("id", recording.RecorderId))
+		}(recording)
+	}
+}
@@ -0,0 +1,297 @@
+package record
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"go.uber.org/zap"
+	"m7s.live/engine/v4/codec"
+	"m7s.live/engine/v4/util"
+	"m7s.live/plugin/record/v4/recordfile"
+)
+
+var errPlaybackEnd = errors.New("playback end")
+
+// 回放控制指令
+type PlaybackCommand struct {
+	Action  string  `json:"action"` // pause、resume、seek、speed
+	Time    string  `json:"time"`   // seek的目标时间，格式为20060102150405
+	Speed   float64 `json:"speed"`  // speed的目标倍速
+	invalid bool    // 不是合法的json，交给播放协程应答，speed和paused只在播放协程中读写
+}
+
+// 回放控制指令的应答
+type PlaybackStatus struct {
+	Action string  `json:"action"`
+	Code   int     `json:"code"`
+	Msg    string  `json:"msg"`
+	Speed  float64 `json:"speed"`
+	Paused bool    `json:"paused"`
+}
+
+// 基于websocket-flv的可交互回放会话，二进制消息为flv数据，文本消息为控制指令
+type FLVPlaybackSession struct {
+	conn     *wsConn
+	dir      string
+	endTime  time.Time
+	speed    float64
+	paused   bool
+	commands chan PlaybackCommand
+	closed   chan struct{} // 客户端断开
+	done     chan struct{} // 会话结束
+	outTs    uint32        // 已经输出的最后一个时间戳，seek后输出的时间戳在此基础上继续递增
+	clockTs  uint32        // 倍速控制的基准时间戳
+	clock    time.Time     // 倍速控制的基准时间
+}
+
+func (s *FLVPlaybackSession) resetClock() {
+	s.clockTs = s.outTs
+	s.clock = time.Now()
+}
+
+func (s *FLVPlaybackSession) reply(status PlaybackStatus) {
+	status.Speed = s.speed
+	status.Paused = s.paused
+	if data, err := json.Marshal(status); err == nil {
+		s.conn.WriteMessage(wsOpText, data)
+	}
+}
+
+// 读取客户端发来的控制指令
+func (s *FLVPlaybackSession) readCommands() {
+	defer close(s.closed)
+	for {
+		opcode, data, err := s.conn.ReadMessage()
+		if err != nil {
+			return
+		}
+		if opcode != wsOpText {
+			continue
+		}
+		var cmd PlaybackCommand
+		if err = json.Unmarshal(data, &cmd); err != nil {
+			cmd = PlaybackCommand{invalid: true}
+		}
+		select {
+		case s.commands <- cmd:
+		case <-s.done:
+			return
+		}
+	}
+}
+
+// 处理控制指令，返回seek的目标时间
+func (s *FLVPlaybackSession) handle(cmd PlaybackCommand) (seekTo time.Time, err error) {
+	if cmd.invalid {
+		s.reply(PlaybackStatus{Code: -1, Msg: "Invalid JSON format"})
+		return
+	}
+	switch cmd.Action {
+	case "pause":
+		s.paused = true
+	case "resume":
+		s.paused = false
+		s.resetClock()
+	case "speed":
+		if cmd.Speed <= 0 {
+			s.reply(PlaybackStatus{Action: cmd.Action, Code: -1, Msg: "speed error"})
+			return
+		}
+		s.speed = cmd.Speed
+		s.resetClock()
+	case "seek":
+		if seekTo, err = time.ParseInLocation("20060102150405", cmd.Time, time.Local); err != nil {
+			s.reply(PlaybackStatus{Action: cmd.Action, Code: -1, Msg: err.Error()})
+			return seekTo, nil
+		}
+		s.paused = false
+	default:
+		s.reply(PlaybackStatus{Action: cmd.Action, Code: -1, Msg: "action not supported"})
+		return
+	}
+	s.reply(PlaybackStatus{Action: cmd.Action})
+	return
+}
+
+// 检查控制指令，暂停时阻塞等待
+func (s *FLVPlaybackSession) checkCommands() (seekTo time.Time, err error) {
+	for {
+		if s.paused {
+			select {
+			case cmd := <-s.commands:
+				if seekTo, err = s.handle(cmd); !seekTo.IsZero() || err != nil {
+					return
+				}
+			case <-s.closed:
+				return seekTo, io.EOF
+			}
+			continue
+		}
+		select {
+		case cmd := <-s.commands:
+			if seekTo, err = s.handle(cmd); !seekTo.IsZero() || err != nil {
+				return
+			}
+		case <-s.closed:
+			return seekTo, io.EOF
+		default:
+			return
+		}
+	}
+}
+
+func (s *FLVPlaybackSession) writeTag(tagHead util.Buffer, data []byte, timestamp uint32) error {
+	putFlvTimestamp(tagHead, timestamp)
+	return s.conn.WriteMessage(wsOpBinary, append(append([]byte{}, tagHead...), data...))
+}
+
+// 从startTime开始播放，收到seek指令时返回目标时间
+func (s *FLVPlaybackSession) play(startTime time.Time) (seekTo time.Time, err error) {
+	fileList, offsetTime, found := findFLVFiles(s.dir, startTime, s.endTime)
+	if !found {
+		return seekTo, errPlaybackEnd
+	}
+	skip := uint32(offsetTime.Milliseconds())
+	base := s.outTs
+	s.resetClock()
+	var fileBase, lastTimestamp, origin uint32
+	var init, hasVideo bool
+	tagHead := make(util.Buffer, 11)
+	for _, info := range fileList {
+		filePath := filepath.Join(s.dir, info.Name())
+		plugin.Debug("read", zap.String("file", filePath))
+		file, err := os.Open(filePath)
+		if err != nil {
+			return seekTo, err
+		}
+		reader := bufio.NewReader(file)
+		_, err = reader.Discard(len(codec.FLVHeader))
+		for err == nil {
+			if seekTo, err = s.checkCommands(); !seekTo.IsZero() || err != nil {
+				file.Close()
+				return seekTo, err
+			}
+			if _, err = io.ReadFull(reader, tagHead); err != nil {
+				break
+			}
+			tmp := tagHead
+			t := tmp.ReadByte()
+			dataLen := tmp.ReadUint24()
+			lastTimestamp = fileBase + (tmp.ReadUint24() | uint32(tmp.ReadByte())<<24)
+			data := make([]byte, dataLen+4)
+			if _, err = io.ReadFull(reader, data); err != nil {
+				break
+			}
+			if t == codec.FLV_TAG_TYPE_SCRIPT || dataLen < 2 {
+				continue
+			}
+			// 序列头在每次seek后都重新发送
+			if t == codec.FLV_TAG_TYPE_VIDEO && recordfile.IsFLVVideoSequenceHead(data) {
+				hasVideo = true
+				err = s.writeTag(tagHead, data, s.outTs)
+				continue
+			}
+			if t == codec.FLV_TAG_TYPE_AUDIO && codec.AudioCodecID(data[0]>>4) == codec.CodecID_AAC && data[1] == 0 {
+				err = s.writeTag(tagHead, data, s.outTs)
+				continue
+			}
+			if !init {
+				if lastTimestamp < skip || (hasVideo && (t != codec.FLV_TAG_TYPE_VIDEO || !recordfile.IsFLVKeyFrame(data))) {
+					continue
+				}
+				init = true
+				origin = lastTimestamp
+			}
+			s.outTs = base + lastTimestamp - origin
+			if err = s.writeTag(tagHead, data, s.outTs); err != nil {
+				break
+			}
+			if sleepTime := time.Duration(float64(s.outTs-s.clockTs)/s.speed)*time.Millisecond - time.Since(s.clock); sleepTime > 0 {
+				time.Sleep(sleepTime)
+			}
+		}
+		file.Close()
+		if err != nil && err != io.EOF && err != io.ErrUnexpectedEOF {
+			return seekTo, err
+		}
+		fileBase = lastTimestamp
+	}
+	return seekTo, errPlaybackEnd
+}
+
+func (s *FLVPlaybackSession) Run(startTime time.Time) {
+	defer func() {
+		close(s.done)
+		s.conn.Close()
+	}()
+	go s.readCommands()
+	if err := s.conn.WriteMessage(wsOpBinary, codec.FLVHeader); err != nil {
+		return
+	}
+	for {
+		seekTo, err := s.play(startTime)
+		if err == errPlaybackEnd {
+			s.reply(PlaybackStatus{Action: "end"})
+			// 播放结束后只能seek，resume和speed不会重新开始播放
+			for err = nil; err == nil && seekTo.IsZero(); {
+				s.paused = true
+				seekTo, err = s.checkCommands()
+			}
+		}
+		if err != nil {
+			plugin.Debug("playback session end", zap.String("dir", s.dir), zap.Error(err))
+			return
+		}
+		startTime = seekTo
+	}
+}
+
+// websocket-flv回放，支持暂停、恢复、seek和倍速切换
+func (conf *RecordConfig) Play_wsflv_(w http.ResponseWriter, r *http.Request) {
+	streamPath := strings.TrimSuffix(strings.TrimPrefix(r.URL.Path, "/play/wsflv/"), ".flv")
+	query := r.URL.Query()
+	startTime, err := time.ParseInLocation("20060102150405", query.Get("start"), time.Local)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	endTime := time.Now().AddDate(100, 0, 0)
+	if endTimeStr := query.Get("end"); endTimeStr != "" {
+		if endTime, err = time.ParseInLocation("20060102150405", endTimeStr, time.Local); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+	}
+	speed, err := strconv.ParseFloat(query.Get("speed"), 64)
+	if err != nil || speed <= 0 {
+		speed = 1
+	}
+	dir := filepath.Join(conf.getRecorderConfigByType("flv").Path, streamPath)
+	if !util.Exist(dir) {
+		http.NotFound(w, r)
+		return
+	}
+	conn, err := upgradeWebSocket(w, r)
+	if err != nil {
+		return
+	}
+	plugin.Info("playback session", zap.String("stream", streamPath), zap.Time("start", startTime), zap.Float64("speed", speed))
+	session := &FLVPlaybackSession{
+		conn:     conn,
+		dir:      dir,
+		endTime:  endTime,
+		speed:    speed,
+		commands: make(chan PlaybackCommand),
+		closed:   make(chan struct{}),
+		done:     make(chan struct{}),
+	}
+	session.Run(startTime)
+}
@@ -0,0 +1,198 @@
+package record
+
+import (
+	"errors"
+	"io"
+	"net/http"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/yapingcat/gomedia/go-mpeg2"
+	"go.uber.org/zap"
+	. "m7s.live/engine/v4"
+	"m7s.live/engine/v4/codec"
+	"m7s.live/engine/v4/util"
+	"m7s.live/plugin/record/v4/recordfile"
+)
+
+// 录制ps文件，用于和gb28181平台交换录像，开启分片时在关键帧切分
+type PSRecorder struct {
+	Recorder
+	muxer    *mpeg2.PSMuxer
+	videoSid uint8
+	audioSid uint8
+	hasVideo bool
+	hasAudio bool
+	err      error
+}
+
+func (r *PSRecorder) SetId(streamPath string) {
+	r.ID = streamPath + "/ps"
+}
+
+// ps录制只有普通录像
+func (r *PSRecorder) GetRecordModeString(mode RecordMode) string {
+	return recordModeString(mode)
+}
+
+// 定时停止的录像只支持flv
+func (r *PSRecorder) StartWithDynamicTimeout(streamPath, fileName string, timeout time.Duration) error {
+	return errors.ErrUnsupported
+}
+
+// 没有定时器，不需要处理
+func (r *PSRecorder) UpdateTimeout(timeout time.Duration) {
+}
+
+func NewPSRecorder() (r *PSRecorder) {
+	r = &PSRecorder{}
+	r.Record = *RecordPluginConfig.getRecorderConfigByType("ps")
+	return r
+}
+
+func (r *PSRecorder) Start(streamPath string) error {
+	r.ID = streamPath + "/ps"
+	return r.start(r, streamPath, SUBTYPE_RAW)
+}
+
+func (r *PSRecorder) StartWithFileName(streamPath string, fileName string) error {
+	r.ID = streamPath + "/ps/" + fileName
+	return r.start(r, streamPath, SUBTYPE_RAW)
+}
+
+func (r *PSRecorder) Close() (err error) {
+	if r.File != nil {
+		err = r.File.Close()
+	}
+	return
+}
+
+// 每个文件使用新的muxer，保证文件开头有完整的系统头和节目流映射
+func (r *PSRecorder) createMuxer() {
+	r.muxer = mpeg2.NewPsMuxer()
+	r.muxer.OnPacket = func(pkg []byte) {
+		// pkg在回调返回后会被复用，需要立即写入
+		if r.err == nil {
+			_, r.err = r.File.Write(pkg)
+		}
+	}
+	r.hasVideo, r.hasAudio = false, false
+	if r.VideoReader != nil {
+		switch r.Video.CodecID {
+		case codec.CodecID_H264:
+			r.videoSid = r.muxer.AddStream(mpeg2.PS_STREAM_H264)
+			r.hasVideo = true
+		case codec.CodecID_H265:
+			r.videoSid = r.muxer.AddStream(mpeg2.PS_STREAM_H265)
+			r.hasVideo = true
+		}
+	}
+	if r.AudioReader != nil {
+		switch r.Audio.CodecID {
+		case codec.CodecID_AAC:
+			r.audioSid = r.muxer.AddStream(mpeg2.PS_STREAM_AAC)
+			r.hasAudio = len(r.Audio.SequenceHead) > 2
+		case codec.CodecID_PCMA:
+			r.audioSid = r.muxer.AddStream(mpeg2.PS_STREAM_G711A)
+			r.hasAudio = true
+		case codec.CodecID_PCMU:
+			r.audioSid = r.muxer.AddStream(mpeg2.PS_STREAM_G711U)
+			r.hasAudio = true
+		}
+	}
+}
+
+func (r *PSRecorder) OnEvent(event any) {
+	var err error
+	r.Recorder.OnEvent(event)
+	switch v := event.(type) {
+	case FileWr:
+		r.createMuxer()
+	case AudioFrame:
+		if !r.hasAudio {
+			return
+		}
+		ts := uint64(r.frameTs) + recordfile.PSTimestampBase
+		data := v.AUList.ToBytes()
+		if r.Audio.CodecID == codec.CodecID_AAC {
+			data = append(recordfile.ADTSHeader(r.Audio.SequenceHead[2:], len(data)), data...)
+		}
+		err = r.muxer.Write(r.audioSid, data, ts, ts)
+	case VideoFrame:
+		if !r.hasVideo {
+			return
+		}
+		dts := uint64(r.frameTs) + recordfile.PSTimestampBase
+		data := util.ConcatBuffers(v.GetAnnexB())
+		if v.IFrame {
+			// 关键帧前插入参数集，从任意分片开始都可以解码
+			data = append(recordfile.VideoParamSets(r.Video.SequenceHead), data...)
+		}
+		err = r.muxer.Write(r.videoSid, data, dts+uint64((v.PTS-v.DTS)/90), dts)
+	}
+	if err == nil {
+		err = r.err
+	}
+	if err != nil {
+		r.Stop(zap.Error(err))
+	}
+}
+
+// 按时间段点播ps录像，/record/play/ps/{streamPath}.ps?start=20060102150405&end=20060102150405&speed=1
+// 多个分片合并为连续的ps流输出，时间戳从0开始
+func (conf *RecordConfig) Play_ps_(w http.ResponseWriter, r *http.Request) {
+	streamPath := strings.TrimSuffix(strings.TrimPrefix(r.URL.Path, "/play/ps/"), ".ps")
+	query := r.URL.Query()
+	startTime, err := time.ParseInLocation("20060102150405", query.Get("start"), time.Local)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	endTime, err := time.ParseInLocation("20060102150405", query.Get("end"), time.Local)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	speed, err := strconv.ParseFloat(query.Get("speed"), 64)
+	if err != nil || speed <= 0 {
+		speed = 1
+	}
+	recorder := conf.getRecorderConfigByType("ps")
+	dir := filepath.Join(recorder.Path, streamPath)
+	fileList, offsetTime, found := findRecordFiles(dir, recorder.Ext, startTime, endTime)
+	if !found {
+		http.NotFound(w, r)
+		return
+	}
+	reader := &recordfile.ConcatTagReader{Offset: offsetTime, Duration: endTime.Sub(startTime)}
+	for _, info := range fileList {
+		reader.Files = append(reader.Files, filepath.Join(dir, info.Name()))
+	}
+	defer reader.Close()
+	w.Header().Set("Content-Type", "video/mp2p")
+	w.WriteHeader(http.StatusOK)
+	writer := recordfile.NewPSTagWriter(w)
+	flusher, _ := w.(http.Flusher)
+	start := time.Now()
+	for r.Context().Err() == nil {
+		var tag *recordfile.FLVTag
+		if tag, err = reader.ReadTag(); err != nil {
+			break
+		}
+		// 按照倍速控制发送速度
+		if sleepTime := time.Duration(float64(tag.Timestamp)/speed)*time.Millisecond - time.Since(start); sleepTime > 0 {
+			time.Sleep(sleepTime)
+		}
+		if err = writer.WriteTag(tag); err != nil {
+			break
+		}
+		if flusher != nil {
+			flusher.Flush()
+		}
+	}
+	if err != nil && err != io.EOF {
+		plugin.Debug("play ps", zap.String("stream", streamPath), zap.Error(err))
+	}
+}
@@ -0,0 +1,248 @@
+package record
+
+import (
+	"errors"
+	"io"
+	"net/http"
+	"path/filepath"
+	"strconv"
+	"time"
+
+	"go.uber.org/zap"
+	. "m7s.live/engine/v4"
+	"m7s.live/engine/v4/codec"
+	"m7s.live/engine/v4/util"
+	"m7s.live/plugin/record/v4/recordfile"
+)
+
+var ErrNoRecordFile = errors.New("no record file")
+var errPublishRangeEnd = errors.New("publish range end")
+
+// 将录像文件作为直播流发布到引擎中，支持flv、mp4、ts、ps文件和rtp抓包文件
+type FilePublisher struct {
+	Publisher
+	Files     []string      `json:"-" yaml:"-"` // 按顺序发布的文件
+	Offset    time.Duration // 第一个文件中跳过的时长
+	Duration  time.Duration // 发布的总时长，0表示发布到文件结束
+	Speed     float64       // 倍速
+	Loop      bool          // 是否循环发布
+	LoopCount int           // 已经循环的次数
+	pool      util.BytesPool
+	tsBase    uint32 // 换文件和循环时保证时间戳单调递增
+	loopBase  uint32 // 本次循环的起始时间戳
+	lastTs    uint32
+	frames    int // 已经发布的帧数，循环发布时一轮没有发布任何帧说明文件都不可用
+}
+
+func NewFilePublisher(files ...string) *FilePublisher {
+	return &FilePublisher{
+		Files: files,
+		Speed: 1,
+		pool:  make(util.BytesPool, 17),
+	}
+}
+
+func (p *FilePublisher) Start(streamPath string) (err error) {
+	if len(p.Files) == 0 {
+		return ErrNoRecordFile
+	}
+	if p.Speed <= 0 {
+		p.Speed = 1
+	}
+	if err = plugin.Publish(streamPath, p); err != nil {
+		return
+	}
+	RecordPluginConfig.publishers.Store(streamPath, p)
+	go func() {
+		p.run()
+		RecordPluginConfig.publishers.Delete(streamPath)
+	}()
+	return
+}
+
+func (p *FilePublisher) writeTag(tag *recordfile.FLVTag, timestamp uint32) {
+	p.frames++
+	var frame util.BLL
+	mem := p.pool.Get(len(tag.Data))
+	copy(mem.Value, tag.Data)
+	frame.Push(mem)
+	switch tag.Type {
+	case codec.FLV_TAG_TYPE_AUDIO:
+		p.WriteAVCCAudio(timestamp, &frame, p.pool)
+	case codec.FLV_TAG_TYPE_VIDEO:
+		p.WriteAVCCVideo(timestamp, &frame, p.pool)
+	}
+}
+
+// 发布一个文件，skip为需要跳过的时长(毫秒)
+func (p *FilePublisher) publishFile(filePath string, skip uint32, start time.Time) (err error) {
+	if filepath.Ext(filePath) == ".pcap" {
+		return p.publishRTPFile(filePath, skip, start)
+	}
+	reader, err := recordfile.OpenTagReader(filePath)
+	if err != nil {
+		return
+	}
+	defer reader.Close()
+	p.Info("publish file", zap.String("file", filePath), zap.Int("loop", p.LoopCount))
+	var first uint32
+	var init bool
+	for p.Err() == nil {
+		var tag *recordfile.FLVTag
+		if tag, err = reader.ReadTag(); err != nil {
+			break
+		}
+		if tag.Type == codec.FLV_TAG_TYPE_SCRIPT {
+			continue
+		}
+		if !init {
+			first = tag.Timestamp
+			init = true
+		}
+		// 音频可能比第一帧早几毫秒，按0处理，避免相减溢出
+		var relative uint32
+		if tag.Timestamp > first {
+			relative = tag.Timestamp - first
+		}
+		if tag.IsSequenceHead() {
+			p.writeTag(tag, p.tsBase)
+			continue
+		}
+		if relative < skip {
+			continue
+		}
+		timestamp := p.tsBase + relative - skip
+		if p.Duration > 0 && time.Duration(timestamp-p.loopBase)*time.Millisecond > p.Duration {
+			err = errPublishRangeEnd
+			break
+		}
+		if timestamp > p.lastTs {
+			p.lastTs = timestamp
+		}
+		p.writeTag(tag, timestamp)
+		if sleepTime := time.Duration(float64(timestamp)/p.Speed)*time.Millisecond - time.Since(start); sleepTime > 0 {
+			time.Sleep(sleepTime)
+		}
+	}
+	if err == io.EOF || err == io.ErrUnexpectedEOF {
+		err = nil
+	}
+	// 下一个文件紧接着当前文件的最后一帧
+	p.tsBase = p.lastTs + recordfile.FileJoinGap
+	return
+}
+
+func (p *FilePublisher) run() {
+	start := time.Now()
+	defer p.Stop(zap.String("reason", "publish end"))
+	for p.Err() == nil {
+		p.loopBase = p.tsBase
+		frames := p.frames
+		for i, filePath := range p.Files {
+			var skip uint32
+			if i == 0 {
+				skip = uint32(p.Offset.Milliseconds())
+			}
+			err := p.publishFile(filePath, skip, start)
+			if err == errPublishRangeEnd {
+				break
+			} else if err != nil {
+				p.Error("publish file failed", zap.String("file", filePath), zap.Error(err))
+			}
+			if p.Err() != nil {
+				return
+			}
+		}
+		if !p.Loop {
+			return
+		}
+		// 否则会不停地重新打开文件
+		if p.frames == frames {
+			p.Error("no frame published in a loop, stop publishing", zap.Strings("files", p.Files))
+			return
+		}
+		p.LoopCount++
+	}
+}
+
+// 发布录像文件，file为录像目录下的相对路径，可以有多个；或者用source指定录像的流，用start和end指定时间范围
+func (conf *RecordConfig) API_publish(w http.ResponseWriter, r *http.Request) {
+	query := r.URL.Query()
+	streamPath := query.Get("streamPath")
+	if streamPath == "" {
+		http.Error(w, "no streamPath", http.StatusBadRequest)
+		return
+	}
+	t := query.Get("type")
+	if t == "" {
+		t = "flv"
+	}
+	recorder := conf.getRecorderConfigByType(t)
+	if recorder == nil || (t != "flv" && t != "mp4" && t != "ts" && t != "ps" && t != "rtp") {
+		http.Error(w, "type not supported", http.StatusBadRequest)
+		return
+	}
+	var files []string
+	var offsetTime, duration time.Duration
+	if fileNames := query["file"]; len(fileNames) > 0 {
+		for _, fileName := range fileNames {
+			files = append(files, filepath.Join(recorder.Path, filepath.Clean("/"+fileName)))
+		}
+	} else if source := query.Get("source"); source != "" {
+		startTime, err := time.ParseInLocation("20060102150405", query.Get("start"), time.Local)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		endTime, err := time.ParseInLocation("20060102150405", query.Get("end"), time.Local)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		dir := filepath.Join(recorder.Path, source)
+		fileList, offset, found := findRecordFiles(dir, recorder.Ext, startTime, endTime)
+		if !found {
+			util.ReturnError(util.APIErrorNotFound, ErrNoRecordFile.Error(), w, r)
+			return
+		}
+		for _, info := range fileList {
+			files = append(files, filepath.Join(dir, info.Name()))
+		}
+		offsetTime = offset
+		duration = endTime.Sub(startTime)
+	} else {
+		http.Error(w, "no file or source", http.StatusBadRequest)
+		return
+	}
+	publisher := NewFilePublisher(files...)
+	publisher.Offset = offsetTime
+	publisher.Duration = duration
+	publisher.Loop = query.Get("loop") != ""
+	if speed, err := strconv.ParseFloat(query.Get("speed"), 64); err == nil && speed > 0 {
+		publisher.Speed = speed
+	}
+	if err := publisher.Start(streamPath); err != nil {
+		util.ReturnError(util.APIErrorInternal, err.Error(), w, r)
+		return
+	}
+	util.ReturnError(util.APIErrorNone, streamPath, w, r)
+}
+
+func (conf *RecordConfig) API_list_publishing(w http.ResponseWriter, r *http.Request) {
+	util.ReturnFetchValue(func() (publishers []any) {
+		conf.publishers.Range(func(key, value any) bool {
+			publishers = append(publishers, value)
+			return true
+		})
+		return
+	}, w, r)
+}
+
+func (conf *RecordConfig) API_publish_stop(w http.ResponseWriter, r *http.Request) {
+	if publisher, ok := conf.publishers.Load(r.URL.Query().Get("streamPath")); ok {
+		publisher.(*FilePublisher).Stop(zap.String("reason", "api"))
+		util.ReturnOK(w, r)
+		return
+	}
+	util.ReturnError(util.APIErrorNotFound, "no such publisher", w, r)
+}
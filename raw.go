@@ -35,13 +35,13 @@ func (r *RawRecorder) UpdateTimeout(timeout time.Duration) {
 
 func NewRawRecorder() (r *RawRecorder) {
 	r = &RawRecorder{}
-	r.Record = RecordPluginConfig.Raw
+	r.Record = *RecordPluginConfig.getRecorderConfigByType("raw")
 	return r
 }
 
 func NewRawAudioRecorder() (r *RawRecorder) {
 	r = &RawRecorder{IsAudio: true}
-	r.Record = RecordPluginConfig.RawAudio
+	r.Record = *RecordPluginConfig.getRecorderConfigByType("raw_audio")
 	return r
 }
 
@@ -84,7 +84,9 @@ func (r *RawRecorder) OnEvent(event any) {
 				r.Ext = ".h265"
 			}
 		}
-		r.AddTrack(v)
+		if r.acceptTrack(v) {
+			r.AddTrack(v)
+		}
 	case *track.Audio:
 		if !r.IsAudio {
 			break
@@ -99,7 +101,9 @@ func (r *RawRecorder) OnEvent(event any) {
 				r.Ext = ".pcmu"
 			}
 		}
-		r.AddTrack(v)
+		if r.acceptTrack(v) {
+			r.AddTrack(v)
+		}
 	case AudioFrame:
 		r.Recorder.OnEvent(event)
 		if _, err := v.WriteRawTo(r); err != nil {
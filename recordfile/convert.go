@@ -0,0 +1,40 @@
+package recordfile
+
+import (
+	"io"
+	"os"
+	"time"
+)
+
+// 将多个录像文件按顺序转换成一个指定格式的文件，时间戳连续
+// offset为第一个文件中跳过的时长，duration为截取的总时长，0表示到最后一个文件结束
+func ConvertFile(files []string, output string, format string, offset, duration time.Duration) (lastTs uint32, err error) {
+	reader := &ConcatTagReader{Files: files, Offset: offset, Duration: duration}
+	defer reader.Close()
+	tempPath := output + ".tmp"
+	writer, err := CreateTagWriter(tempPath, format)
+	if err != nil {
+		return
+	}
+	for {
+		var tag *FLVTag
+		if tag, err = reader.ReadTag(); err != nil {
+			break
+		}
+		if err = writer.WriteTag(tag); err != nil {
+			break
+		}
+		if tag.Timestamp > lastTs {
+			lastTs = tag.Timestamp
+		}
+	}
+	if closeErr := writer.Close(); err == nil || err == io.EOF {
+		err = closeErr
+	}
+	if err != nil {
+		os.Remove(tempPath)
+		return
+	}
+	err = os.Rename(tempPath, output)
+	return
+}
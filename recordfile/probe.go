@@ -0,0 +1,180 @@
+package recordfile
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"m7s.live/engine/v4/codec"
+)
+
+// 录像文件的基本信息
+type ProbeInfo struct {
+	File        string `json:"file"`
+	Format      string `json:"format"`
+	Size        int64  `json:"size"`
+	StartTime   uint32 `json:"startTime"` // 第一个tag的时间戳(毫秒)
+	Duration    uint32 `json:"duration"`  // 毫秒
+	VideoCodec  string `json:"videoCodec,omitempty"`
+	AudioCodec  string `json:"audioCodec,omitempty"`
+	VideoFrames int    `json:"videoFrames"`
+	AudioFrames int    `json:"audioFrames"`
+	Keyframes   int    `json:"keyframes"`
+	Error       string `json:"error,omitempty"` // 读取中途出错，文件可能不完整
+}
+
+// 根据扩展名判断录像格式
+func FormatByExt(filePath string) string {
+	switch strings.ToLower(filepath.Ext(filePath)) {
+	case ".flv":
+		return "flv"
+	case ".mp4":
+		return "mp4"
+	case ".ts":
+		return "ts"
+	case ".ps":
+		return "ps"
+	}
+	return ""
+}
+
+func videoCodecName(data []byte) string {
+	switch codec.VideoCodecID(data[0] & 0x0f) {
+	case codec.CodecID_H264:
+		return "h264"
+	case codec.CodecID_H265:
+		return "h265"
+	}
+	return fmt.Sprintf("unknown(%d)", data[0]&0x0f)
+}
+
+func audioCodecName(data []byte) string {
+	switch codec.AudioCodecID(data[0] >> 4) {
+	case codec.CodecID_AAC:
+		return "aac"
+	case codec.CodecID_PCMA:
+		return "pcma"
+	case codec.CodecID_PCMU:
+		return "pcmu"
+	}
+	return fmt.Sprintf("unknown(%d)", data[0]>>4)
+}
+
+// 读取整个文件，统计帧数、关键帧数、编码和时长
+func ProbeFile(filePath string) (info *ProbeInfo, err error) {
+	stat, err := os.Stat(filePath)
+	if err != nil {
+		return
+	}
+	reader, err := OpenTagReader(filePath)
+	if err != nil {
+		return
+	}
+	defer reader.Close()
+	info = &ProbeInfo{File: filePath, Format: FormatByExt(filePath), Size: stat.Size()}
+	var init bool
+	var lastTs uint32
+	for {
+		tag, err := reader.ReadTag()
+		if err != nil {
+			if err != io.EOF {
+				info.Error = err.Error()
+			}
+			break
+		}
+		if tag.Type == codec.FLV_TAG_TYPE_SCRIPT || len(tag.Data) == 0 {
+			continue
+		}
+		if !init {
+			info.StartTime = tag.Timestamp
+			init = true
+		}
+		if tag.Timestamp > lastTs {
+			lastTs = tag.Timestamp
+		}
+		switch tag.Type {
+		case codec.FLV_TAG_TYPE_VIDEO:
+			info.VideoCodec = videoCodecName(tag.Data)
+			if tag.IsSequenceHead() {
+				continue
+			}
+			info.VideoFrames++
+			if tag.IsKeyFrame() {
+				info.Keyframes++
+			}
+		case codec.FLV_TAG_TYPE_AUDIO:
+			info.AudioCodec = audioCodecName(tag.Data)
+			if !tag.IsSequenceHead() {
+				info.AudioFrames++
+			}
+		}
+	}
+	if init {
+		info.Duration = lastTs - info.StartTime
+	}
+	return info, nil
+}
+
+// mp4在关闭时才写入moov，录制中断的文件只有mdat，其中的帧没有编码参数和边界信息，无法恢复
+var ErrMP4NoMoov = errors.New("mp4 has no moov box (recording was interrupted before the file was closed), frames cannot be recovered; record fmp4 to keep interrupted files playable")
+
+// 检查mp4文件的顶层box中是否有moov
+func hasMP4Moov(filePath string) (found bool, err error) {
+	file, err := os.Open(filePath)
+	if err != nil {
+		return
+	}
+	defer file.Close()
+	var offset int64
+	head := make([]byte, 16)
+	for {
+		if _, err = file.ReadAt(head[:8], offset); err != nil {
+			if err == io.EOF {
+				err = nil
+			}
+			return
+		}
+		if string(head[4:8]) == "moov" {
+			return true, nil
+		}
+		size := int64(binary.BigEndian.Uint32(head))
+		switch size {
+		case 0:
+			return
+		case 1:
+			if _, err = file.ReadAt(head[8:16], offset+8); err != nil {
+				if err == io.EOF {
+					err = nil
+				}
+				return
+			}
+			size = int64(binary.BigEndian.Uint64(head[8:]))
+		}
+		if size < 8 {
+			return
+		}
+		offset += size
+	}
+}
+
+// 修复录像文件：重新封装可读的部分，丢弃文件尾部不完整的数据，flv会重建关键帧索引
+// mp4文件需要moov可读(或者是fmp4)，没有moov时返回ErrMP4NoMoov
+func RepairFile(input, output string) (duration uint32, err error) {
+	if FormatByExt(input) == "mp4" {
+		var found bool
+		if found, err = hasMP4Moov(input); err != nil {
+			return
+		} else if !found {
+			return 0, ErrMP4NoMoov
+		}
+	}
+	format := FormatByExt(output)
+	if format == "" {
+		format = FormatByExt(input)
+	}
+	return ConvertFile([]string{input}, output, format, 0, 0)
+}
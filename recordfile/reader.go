@@ -0,0 +1,550 @@
+// Package recordfile 读取、写入、检查和修复录像文件，不依赖插件的配置、数据库和引擎实例，
+// 插件和命令行工具recordtool共用，导入时没有副作用
+package recordfile
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"io"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/yapingcat/gomedia/go-mp4"
+	"github.com/yapingcat/gomedia/go-mpeg2"
+	"m7s.live/engine/v4/codec"
+	"m7s.live/engine/v4/util"
+)
+
+var ErrUnsupportedFile = errors.New("unsupported file")
+
+// 换文件时，下一个文件的第一帧与上一个文件最后一帧之间的间隔(毫秒)
+const FileJoinGap uint32 = 40
+
+// 判断flv视频tag是否为关键帧
+func IsFLVKeyFrame(data []byte) bool {
+	frameType := (data[0] >> 4) & 0b0111
+	return frameType == 1 || frameType == 4
+}
+
+// 判断flv视频tag是否为序列头
+func IsFLVVideoSequenceHead(data []byte) bool {
+	if data[0]&0b1000_0000 != 0 { // 增强型rtmp
+		return data[0]&0x0f == 0
+	}
+	return len(data) > 1 && data[1] == 0
+}
+
+// 统一的flv格式tag，Data不包含tag头和PreviousTagSize
+type FLVTag struct {
+	Type      byte
+	Timestamp uint32
+	Data      []byte
+}
+
+func (tag *FLVTag) IsSequenceHead() bool {
+	switch tag.Type {
+	case codec.FLV_TAG_TYPE_VIDEO:
+		return len(tag.Data) > 1 && IsFLVVideoSequenceHead(tag.Data)
+	case codec.FLV_TAG_TYPE_AUDIO:
+		return len(tag.Data) > 1 && codec.AudioCodecID(tag.Data[0]>>4) == codec.CodecID_AAC && tag.Data[1] == 0
+	}
+	return false
+}
+
+func (tag *FLVTag) IsKeyFrame() bool {
+	return tag.Type == codec.FLV_TAG_TYPE_VIDEO && len(tag.Data) > 1 && IsFLVKeyFrame(tag.Data)
+}
+
+// 写入完整的tag，包括tag头和PreviousTagSize
+func (tag *FLVTag) WriteTo(w io.Writer) (n int64, err error) {
+	dataLen := len(tag.Data)
+	ts := tag.Timestamp
+	head := []byte{tag.Type, byte(dataLen >> 16), byte(dataLen >> 8), byte(dataLen), byte(ts >> 16), byte(ts >> 8), byte(ts), byte(ts >> 24), 0, 0, 0}
+	tail := make([]byte, 4)
+	binary.BigEndian.PutUint32(tail, uint32(dataLen+11))
+	buffers := net.Buffers{head, tag.Data, tail}
+	return buffers.WriteTo(w)
+}
+
+// 录像文件读取器，不同格式的文件统一转换成flv格式的tag输出
+type TagReader interface {
+	ReadTag() (*FLVTag, error)
+	io.Closer
+}
+
+// 根据扩展名打开录像文件
+func OpenTagReader(filePath string) (TagReader, error) {
+	switch strings.ToLower(filepath.Ext(filePath)) {
+	case ".flv":
+		return OpenFLVTagReader(filePath)
+	case ".mp4":
+		return OpenMP4TagReader(filePath)
+	case ".ts":
+		return OpenTSTagReader(filePath)
+	case ".ps":
+		return OpenPSTagReader(filePath)
+	}
+	return nil, ErrUnsupportedFile
+}
+
+type FLVTagReader struct {
+	file    *os.File
+	reader  *bufio.Reader
+	tagHead util.Buffer
+}
+
+func OpenFLVTagReader(filePath string) (r *FLVTagReader, err error) {
+	var file *os.File
+	if file, err = os.Open(filePath); err != nil {
+		return
+	}
+	r = &FLVTagReader{
+		file:    file,
+		reader:  bufio.NewReader(file),
+		tagHead: make(util.Buffer, 11),
+	}
+	if _, err = r.reader.Discard(len(codec.FLVHeader)); err != nil {
+		file.Close()
+		return nil, err
+	}
+	return
+}
+
+func (r *FLVTagReader) ReadTag() (tag *FLVTag, err error) {
+	if _, err = io.ReadFull(r.reader, r.tagHead); err != nil {
+		return
+	}
+	tmp := r.tagHead
+	tag = &FLVTag{Type: tmp.ReadByte()}
+	dataLen := tmp.ReadUint24()
+	tag.Timestamp = tmp.ReadUint24() | uint32(tmp.ReadByte())<<24
+	tag.Data = make([]byte, dataLen)
+	if _, err = io.ReadFull(r.reader, tag.Data); err != nil {
+		return nil, err
+	}
+	_, err = r.reader.Discard(4)
+	return
+}
+
+func (r *FLVTagReader) Close() error {
+	return r.file.Close()
+}
+
+// 将annexb格式的视频和adts格式的音频转换成flv格式的tag
+type annexBConverter struct {
+	pending                          []*FLVTag
+	sps                              []byte
+	pps                              []byte
+	vps                              []byte
+	videoSeqWritten, audioSeqWritten bool
+}
+
+// 切分annexb格式的nalu
+func splitAnnexB(data []byte) (nalus [][]byte) {
+	start := -1
+	for i := 0; i+2 < len(data); i++ {
+		if data[i] == 0 && data[i+1] == 0 && data[i+2] == 1 {
+			if start >= 0 {
+				end := i
+				if end > start && data[end-1] == 0 {
+					end--
+				}
+				nalus = append(nalus, data[start:end])
+			}
+			start = i + 3
+			i += 2
+		}
+	}
+	if start >= 0 && start < len(data) {
+		nalus = append(nalus, data[start:])
+	} else if start < 0 && len(data) > 0 {
+		nalus = append(nalus, data)
+	}
+	return
+}
+
+func (r *annexBConverter) videoTag(annexb []byte, pts, dts uint32, codecID codec.VideoCodecID) {
+	var keyFrame bool
+	cts := pts - dts
+	avcc := net.Buffers{nil}
+	for _, nalu := range splitAnnexB(annexb) {
+		if len(nalu) == 0 {
+			continue
+		}
+		if codecID == codec.CodecID_H264 {
+			switch nalu[0] & 0x1f {
+			case 7:
+				r.sps = nalu
+				continue
+			case 8:
+				r.pps = nalu
+				continue
+			case 9:
+				continue
+			case 5:
+				keyFrame = true
+			}
+		} else {
+			switch t := (nalu[0] >> 1) & 0x3f; {
+			case t == 32:
+				r.vps = nalu
+				continue
+			case t == 33:
+				r.sps = nalu
+				continue
+			case t == 34:
+				r.pps = nalu
+				continue
+			case t == 35:
+				continue
+			case t >= 16 && t <= 21:
+				keyFrame = true
+			}
+		}
+		naluLen := make([]byte, 4)
+		binary.BigEndian.PutUint32(naluLen, uint32(len(nalu)))
+		avcc = append(avcc, naluLen, nalu)
+	}
+	if !r.videoSeqWritten && r.sps != nil && r.pps != nil {
+		var seqHead []byte
+		if codecID == codec.CodecID_H264 {
+			seqHead = codec.BuildH264SeqHeaderFromSpsPps(r.sps, r.pps)
+		} else if r.vps != nil {
+			seqHead, _ = codec.BuildH265SeqHeaderFromVpsSpsPps(r.vps, r.sps, r.pps)
+		}
+		if seqHead != nil {
+			r.videoSeqWritten = true
+			r.pending = append(r.pending, &FLVTag{Type: codec.FLV_TAG_TYPE_VIDEO, Timestamp: dts, Data: seqHead})
+		}
+	}
+	if len(avcc) == 1 || !r.videoSeqWritten {
+		return
+	}
+	head := []byte{byte(codecID), 1, byte(cts >> 16), byte(cts >> 8), byte(cts)}
+	if keyFrame {
+		head[0] |= 0x10
+	} else {
+		head[0] |= 0x20
+	}
+	avcc[0] = head
+	r.pending = append(r.pending, &FLVTag{Type: codec.FLV_TAG_TYPE_VIDEO, Timestamp: dts, Data: util.ConcatBuffers(avcc)})
+}
+
+// 一个adts数据中可能包含多个aac帧
+func (r *annexBConverter) aacTag(adts []byte, dts uint32) {
+	for len(adts) >= 7 {
+		frameLen := int(adts[3]&0x03)<<11 | int(adts[4])<<3 | int(adts[5])>>5
+		if frameLen < 7 || frameLen > len(adts) {
+			frameLen = len(adts)
+		}
+		headLen := 7
+		if adts[1]&1 == 0 {
+			headLen = 9
+		}
+		if !r.audioSeqWritten {
+			r.audioSeqWritten = true
+			profile := (adts[2] >> 6) + 1
+			sampleRateIndex := (adts[2] >> 2) & 0x0f
+			channels := (adts[2]&1)<<2 | adts[3]>>6
+			r.pending = append(r.pending, &FLVTag{Type: codec.FLV_TAG_TYPE_AUDIO, Timestamp: dts, Data: []byte{
+				0xAF, 0, profile<<3 | sampleRateIndex>>1, (sampleRateIndex&1)<<7 | channels<<3,
+			}})
+		}
+		if headLen < frameLen {
+			r.pending = append(r.pending, &FLVTag{Type: codec.FLV_TAG_TYPE_AUDIO, Timestamp: dts, Data: append([]byte{0xAF, 1}, adts[headLen:frameLen]...)})
+		}
+		adts = adts[frameLen:]
+	}
+}
+
+func (r *annexBConverter) g711Tag(codecID codec.AudioCodecID, data []byte, dts uint32) {
+	r.pending = append(r.pending, &FLVTag{Type: codec.FLV_TAG_TYPE_AUDIO, Timestamp: dts, Data: append([]byte{byte(codecID)<<4 | 0x02}, data...)})
+}
+
+// 读取mp4文件
+type MP4TagReader struct {
+	annexBConverter
+	file    *os.File
+	demuxer *mp4.MovDemuxer
+}
+
+func OpenMP4TagReader(filePath string) (r *MP4TagReader, err error) {
+	var file *os.File
+	if file, err = os.Open(filePath); err != nil {
+		return
+	}
+	r = &MP4TagReader{
+		file:    file,
+		demuxer: mp4.CreateMp4Demuxer(file),
+	}
+	if _, err = r.demuxer.ReadHead(); err != nil {
+		file.Close()
+		return nil, err
+	}
+	return
+}
+
+func (r *MP4TagReader) ReadTag() (tag *FLVTag, err error) {
+	for len(r.pending) == 0 {
+		var pkt *mp4.AVPacket
+		if pkt, err = r.demuxer.ReadPacket(); err != nil {
+			return
+		}
+		switch pkt.Cid {
+		case mp4.MP4_CODEC_H264:
+			r.videoTag(pkt.Data, uint32(pkt.Pts), uint32(pkt.Dts), codec.CodecID_H264)
+		case mp4.MP4_CODEC_H265:
+			r.videoTag(pkt.Data, uint32(pkt.Pts), uint32(pkt.Dts), codec.CodecID_H265)
+		case mp4.MP4_CODEC_AAC:
+			r.aacTag(pkt.Data, uint32(pkt.Dts))
+		case mp4.MP4_CODEC_G711A:
+			r.g711Tag(codec.CodecID_PCMA, pkt.Data, uint32(pkt.Dts))
+		case mp4.MP4_CODEC_G711U:
+			r.g711Tag(codec.CodecID_PCMU, pkt.Data, uint32(pkt.Dts))
+		}
+	}
+	tag = r.pending[0]
+	r.pending = r.pending[1:]
+	return
+}
+
+func (r *MP4TagReader) Close() error {
+	return r.file.Close()
+}
+
+// gomedia的解复用是推模式，在协程中解析后通过通道输出
+type pushTagReader struct {
+	annexBConverter
+	file  *os.File
+	tags  chan *FLVTag
+	done  chan struct{}
+	err   error
+	close sync.Once
+}
+
+func openPushTagReader(filePath string) (r pushTagReader, err error) {
+	var file *os.File
+	if file, err = os.Open(filePath); err != nil {
+		return
+	}
+	return pushTagReader{
+		file: file,
+		tags: make(chan *FLVTag, 64),
+		done: make(chan struct{}),
+	}, nil
+}
+
+// 输出解析出的tag，读取端关闭后丢弃
+func (r *pushTagReader) flush() {
+	for _, tag := range r.pending {
+		select {
+		case r.tags <- tag:
+		case <-r.done:
+		}
+	}
+	r.pending = r.pending[:0]
+}
+
+func (r *pushTagReader) ReadTag() (tag *FLVTag, err error) {
+	select {
+	case tag, ok := <-r.tags:
+		if ok {
+			return tag, nil
+		}
+	case <-r.done:
+		return nil, os.ErrClosed
+	}
+	if r.err != nil {
+		return nil, r.err
+	}
+	return nil, io.EOF
+}
+
+func (r *pushTagReader) Close() (err error) {
+	r.close.Do(func() {
+		close(r.done)
+		err = r.file.Close()
+	})
+	return
+}
+
+// 读取ts文件
+type TSTagReader struct {
+	pushTagReader
+}
+
+func OpenTSTagReader(filePath string) (r *TSTagReader, err error) {
+	r = &TSTagReader{}
+	if r.pushTagReader, err = openPushTagReader(filePath); err != nil {
+		return nil, err
+	}
+	go r.demux()
+	return
+}
+
+func (r *TSTagReader) demux() {
+	defer close(r.tags)
+	demuxer := mpeg2.NewTSDemuxer()
+	demuxer.OnFrame = func(cid mpeg2.TS_STREAM_TYPE, frame []byte, pts uint64, dts uint64) {
+		frame = append([]byte(nil), frame...)
+		switch cid {
+		case mpeg2.TS_STREAM_H264:
+			r.videoTag(frame, uint32(pts), uint32(dts), codec.CodecID_H264)
+		case mpeg2.TS_STREAM_H265:
+			r.videoTag(frame, uint32(pts), uint32(dts), codec.CodecID_H265)
+		case mpeg2.TS_STREAM_AAC:
+			r.aacTag(frame, uint32(dts))
+		}
+		r.flush()
+	}
+	if err := demuxer.Input(bufio.NewReader(r.file)); err != nil && err != io.EOF {
+		r.err = err
+	}
+}
+
+// 读取ps文件
+type PSTagReader struct {
+	pushTagReader
+}
+
+func OpenPSTagReader(filePath string) (r *PSTagReader, err error) {
+	r = &PSTagReader{}
+	if r.pushTagReader, err = openPushTagReader(filePath); err != nil {
+		return nil, err
+	}
+	go r.demux()
+	return
+}
+
+func (r *PSTagReader) demux() {
+	defer close(r.tags)
+	demuxer := mpeg2.NewPSDemuxer()
+	demuxer.OnFrame = func(frame []byte, cid mpeg2.PS_STREAM_TYPE, pts uint64, dts uint64) {
+		frame = append([]byte(nil), frame...)
+		switch cid {
+		case mpeg2.PS_STREAM_H264:
+			r.videoTag(frame, uint32(pts), uint32(dts), codec.CodecID_H264)
+		case mpeg2.PS_STREAM_H265:
+			r.videoTag(frame, uint32(pts), uint32(dts), codec.CodecID_H265)
+		case mpeg2.PS_STREAM_AAC:
+			r.aacTag(frame, uint32(dts))
+		case mpeg2.PS_STREAM_G711A:
+			r.g711Tag(codec.CodecID_PCMA, frame, uint32(dts))
+		case mpeg2.PS_STREAM_G711U:
+			r.g711Tag(codec.CodecID_PCMU, frame, uint32(dts))
+		}
+		r.flush()
+	}
+	buf := make([]byte, 64*1024)
+	for {
+		n, err := r.file.Read(buf)
+		if n > 0 {
+			if err := demuxer.Input(buf[:n]); err != nil {
+				r.err = err
+				return
+			}
+		}
+		if err != nil {
+			if err != io.EOF {
+				r.err = err
+			}
+			break
+		}
+		select {
+		case <-r.done:
+			return
+		default:
+		}
+	}
+	// 最后一帧没有后续的包来结束
+	demuxer.Flush()
+}
+
+// 按顺序读取多个录像文件，输出的时间戳从0开始连续递增，从第一个关键帧开始输出
+type ConcatTagReader struct {
+	Files    []string
+	Offset   time.Duration // 第一个文件中跳过的时长
+	Duration time.Duration // 读取的总时长，0表示读到最后一个文件结束
+	index    int
+	reader   TagReader
+	first    uint32 // 当前文件的第一个时间戳
+	tsBase   uint32 // 当前文件在输出时间轴上的起始时间戳
+	lastTs   uint32
+	init     bool // 当前文件已经读到第一个tag
+	started  bool // 已经开始输出
+	hasVideo bool
+}
+
+func (r *ConcatTagReader) ReadTag() (tag *FLVTag, err error) {
+	for {
+		if r.reader == nil {
+			if r.index >= len(r.Files) {
+				return nil, io.EOF
+			}
+			if r.reader, err = OpenTagReader(r.Files[r.index]); err != nil {
+				return
+			}
+			r.init = false
+		}
+		if tag, err = r.reader.ReadTag(); err != nil {
+			r.reader.Close()
+			r.reader = nil
+			if err != io.EOF && err != io.ErrUnexpectedEOF {
+				return
+			}
+			r.index++
+			if r.started {
+				// 下一个文件紧接着当前文件的最后一帧
+				r.tsBase = r.lastTs + FileJoinGap
+			}
+			continue
+		}
+		if tag.Type == codec.FLV_TAG_TYPE_SCRIPT {
+			continue
+		}
+		if !r.init {
+			r.first = tag.Timestamp
+			r.init = true
+		}
+		relative := tag.Timestamp - r.first
+		if tag.IsSequenceHead() {
+			if tag.Type == codec.FLV_TAG_TYPE_VIDEO {
+				r.hasVideo = true
+			}
+			tag.Timestamp = r.lastTs
+			return
+		}
+		if !r.started {
+			if r.index == 0 && time.Duration(relative)*time.Millisecond < r.Offset {
+				continue
+			}
+			if r.hasVideo && !tag.IsKeyFrame() {
+				continue
+			}
+			r.started = true
+			r.tsBase = 0
+			r.first = tag.Timestamp
+			relative = 0
+		}
+		tag.Timestamp = r.tsBase + relative
+		if r.Duration > 0 && time.Duration(tag.Timestamp)*time.Millisecond > r.Duration {
+			return nil, io.EOF
+		}
+		if tag.Timestamp > r.lastTs {
+			r.lastTs = tag.Timestamp
+		}
+		return
+	}
+}
+
+func (r *ConcatTagReader) Close() error {
+	if r.reader != nil {
+		return r.reader.Close()
+	}
+	return nil
+}
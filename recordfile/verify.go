@@ -0,0 +1,411 @@
+package recordfile
+
+import (
+	"bufio"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"os"
+
+	"m7s.live/engine/v4/codec"
+	"m7s.live/engine/v4/util"
+)
+
+const (
+	VerifyIssueTruncated        = "truncated"           // 文件尾部的tag、box或ts包不完整
+	VerifyIssueCorrupt          = "corrupt"             // 数据无法解析
+	VerifyIssueRegression       = "regression"          // 时间戳回退
+	VerifyIssueGap              = "gap"                 // 时间戳跳跃
+	VerifyIssueMissingSeqHead   = "missingSequenceHead" // 帧之前没有序列头
+	VerifyIssueNoKeyframe       = "noKeyframe"          // 有视频但没有关键帧
+	VerifyIssueMissingMoov      = "missingMoov"         // mp4没有moov，通常是录制中断导致
+	VerifyIssueDurationMismatch = "durationMismatch"    // 文件头中声明的时长和实际时长不一致
+)
+
+// 最多记录的问题数，超过后只计数
+const maxVerifyIssues = 100
+
+type VerifyIssue struct {
+	Type    string `json:"type"`
+	Track   string `json:"track,omitempty"`
+	Offset  int64  `json:"offset,omitempty"` // 问题在文件中的位置
+	Time    uint32 `json:"time,omitempty"`   // 问题处的时间戳(毫秒)
+	Message string `json:"message"`
+}
+
+// 关键帧间隔统计(毫秒)
+type KeyframeStats struct {
+	Count       int     `json:"count"`
+	MinInterval uint32  `json:"minInterval"`
+	MaxInterval uint32  `json:"maxInterval"`
+	AvgInterval float64 `json:"avgInterval"`
+}
+
+type VerifyReport struct {
+	File             string        `json:"file"`
+	Format           string        `json:"format"`
+	Size             int64         `json:"size"`
+	ValidSize        int64         `json:"validSize"` // 可以完整解析的数据长度
+	Healthy          bool          `json:"healthy"`
+	StartTime        uint32        `json:"startTime"`        // 第一个时间戳(毫秒)
+	Duration         uint32        `json:"duration"`         // 根据时间戳计算的实际时长(毫秒)
+	DeclaredDuration uint32        `json:"declaredDuration"` // flv的onMetaData或mp4的mvhd中声明的时长(毫秒)
+	VideoFrames      int           `json:"videoFrames"`
+	AudioFrames      int           `json:"audioFrames"`
+	Keyframes        KeyframeStats `json:"keyframes"`
+	Regressions      int           `json:"regressions"`
+	Gaps             int           `json:"gaps"`
+	IssueCount       int           `json:"issueCount"`
+	Issues           []VerifyIssue `json:"issues"`
+}
+
+func (report *VerifyReport) addIssue(issue VerifyIssue) {
+	report.IssueCount++
+	if len(report.Issues) < maxVerifyIssues {
+		report.Issues = append(report.Issues, issue)
+	}
+}
+
+// 逐个检查tag的时间戳、序列头和关键帧
+type tagVerifier struct {
+	*VerifyReport
+	gapThreshold    uint32
+	init            bool
+	endTime         uint32
+	lastTs          [2]uint32 // 0为视频，1为音频
+	hasTs           [2]bool
+	videoSeqHead    bool
+	audioSeqHead    bool
+	seqHeadReported [2]bool
+	lastKeyframe    uint32
+	intervalSum     uint64
+}
+
+func (v *tagVerifier) check(tag *FLVTag, offset int64) {
+	if tag.Type == codec.FLV_TAG_TYPE_SCRIPT || len(tag.Data) == 0 {
+		return
+	}
+	var track int
+	trackName := "video"
+	if tag.Type == codec.FLV_TAG_TYPE_AUDIO {
+		track, trackName = 1, "audio"
+	}
+	if !v.init {
+		v.init = true
+		v.StartTime = tag.Timestamp
+		v.endTime = tag.Timestamp
+	}
+	if tag.Timestamp < v.StartTime {
+		v.StartTime = tag.Timestamp
+	}
+	if tag.Timestamp > v.endTime {
+		v.endTime = tag.Timestamp
+	}
+	if tag.IsSequenceHead() {
+		if track == 0 {
+			v.videoSeqHead = true
+		} else {
+			v.audioSeqHead = true
+		}
+		return
+	}
+	if v.hasTs[track] {
+		last := v.lastTs[track]
+		if tag.Timestamp < last {
+			v.Regressions++
+			v.addIssue(VerifyIssue{Type: VerifyIssueRegression, Track: trackName, Offset: offset, Time: tag.Timestamp, Message: fmt.Sprintf("timestamp %d < %d", tag.Timestamp, last)})
+		} else if v.gapThreshold > 0 && tag.Timestamp-last > v.gapThreshold {
+			v.Gaps++
+			v.addIssue(VerifyIssue{Type: VerifyIssueGap, Track: trackName, Offset: offset, Time: tag.Timestamp, Message: fmt.Sprintf("timestamp jump %dms", tag.Timestamp-last)})
+		}
+	}
+	v.lastTs[track], v.hasTs[track] = tag.Timestamp, true
+	if track == 0 {
+		v.VideoFrames++
+		if !v.videoSeqHead && !v.seqHeadReported[0] {
+			if codecID := codec.VideoCodecID(tag.Data[0] & 0x0f); codecID == codec.CodecID_H264 || codecID == codec.CodecID_H265 {
+				v.seqHeadReported[0] = true
+				v.addIssue(VerifyIssue{Type: VerifyIssueMissingSeqHead, Track: trackName, Offset: offset, Time: tag.Timestamp, Message: "video frame before sequence header"})
+			}
+		}
+		if tag.IsKeyFrame() {
+			if v.Keyframes.Count > 0 && tag.Timestamp >= v.lastKeyframe {
+				interval := tag.Timestamp - v.lastKeyframe
+				if v.Keyframes.Count == 1 || interval < v.Keyframes.MinInterval {
+					v.Keyframes.MinInterval = interval
+				}
+				if interval > v.Keyframes.MaxInterval {
+					v.Keyframes.MaxInterval = interval
+				}
+				v.intervalSum += uint64(interval)
+			}
+			v.Keyframes.Count++
+			v.lastKeyframe = tag.Timestamp
+		}
+	} else {
+		v.AudioFrames++
+		if !v.audioSeqHead && !v.seqHeadReported[1] && codec.AudioCodecID(tag.Data[0]>>4) == codec.CodecID_AAC {
+			v.seqHeadReported[1] = true
+			v.addIssue(VerifyIssue{Type: VerifyIssueMissingSeqHead, Track: trackName, Offset: offset, Time: tag.Timestamp, Message: "aac frame before sequence header"})
+		}
+	}
+}
+
+func (v *tagVerifier) finish() {
+	if v.init {
+		v.Duration = v.endTime - v.StartTime
+	}
+	if v.Keyframes.Count > 1 {
+		v.Keyframes.AvgInterval = float64(v.intervalSum) / float64(v.Keyframes.Count-1)
+	}
+	if v.VideoFrames > 0 && v.Keyframes.Count == 0 {
+		v.addIssue(VerifyIssue{Type: VerifyIssueNoKeyframe, Track: "video", Message: "no keyframe"})
+	}
+	// 声明的时长和实际时长相差超过1秒
+	if v.DeclaredDuration > 0 {
+		diff := int64(v.DeclaredDuration) - int64(v.Duration)
+		if diff > 1000 || diff < -1000 {
+			v.addIssue(VerifyIssue{Type: VerifyIssueDurationMismatch, Message: fmt.Sprintf("declared %dms, actual %dms", v.DeclaredDuration, v.Duration)})
+		}
+	}
+	v.Healthy = v.IssueCount == 0
+}
+
+// 检查录像文件是否完整，gapThreshold为判断时间戳跳跃的阈值(毫秒)，0表示不检查
+func VerifyFile(filePath string, gapThreshold uint32) (report *VerifyReport, err error) {
+	file, err := os.Open(filePath)
+	if err != nil {
+		return
+	}
+	defer file.Close()
+	stat, err := file.Stat()
+	if err != nil {
+		return
+	}
+	report = &VerifyReport{File: filePath, Format: FormatByExt(filePath), Size: stat.Size(), Issues: []VerifyIssue{}}
+	v := &tagVerifier{VerifyReport: report, gapThreshold: gapThreshold}
+	switch report.Format {
+	case "flv":
+		err = verifyFLV(file, v)
+	case "mp4":
+		err = verifyMP4(file, v)
+	case "ts":
+		err = verifyTS(file, v)
+	default:
+		return nil, ErrUnsupportedFile
+	}
+	if err != nil {
+		return nil, err
+	}
+	v.finish()
+	return
+}
+
+// 通过TagReader检查时间轴，用于mp4和ts
+func verifyTags(filePath string, v *tagVerifier) {
+	reader, err := OpenTagReader(filePath)
+	if err != nil {
+		v.addIssue(VerifyIssue{Type: VerifyIssueCorrupt, Message: err.Error()})
+		return
+	}
+	defer reader.Close()
+	for {
+		tag, err := reader.ReadTag()
+		if err != nil {
+			if err != io.EOF {
+				v.addIssue(VerifyIssue{Type: VerifyIssueCorrupt, Time: v.endTime, Message: err.Error()})
+			}
+			return
+		}
+		v.check(tag, 0)
+	}
+}
+
+// 直接解析flv的tag结构，检查tag长度和PreviousTagSize
+func verifyFLV(file *os.File, v *tagVerifier) (err error) {
+	reader := bufio.NewReader(file)
+	header := make([]byte, 13)
+	if n, _ := io.ReadFull(reader, header); n < 13 || header[0] != 'F' || header[1] != 'L' || header[2] != 'V' {
+		v.addIssue(VerifyIssue{Type: VerifyIssueCorrupt, Message: "invalid flv header"})
+		return
+	}
+	offset := int64(13)
+	tagHead := make(util.Buffer, 11)
+	for {
+		v.ValidSize = offset
+		n, err := io.ReadFull(reader, tagHead)
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			v.addIssue(VerifyIssue{Type: VerifyIssueTruncated, Offset: offset, Message: fmt.Sprintf("tag header truncated, %d bytes left", n)})
+			return nil
+		}
+		tmp := tagHead
+		t := tmp.ReadByte()
+		dataLen := tmp.ReadUint24()
+		timestamp := tmp.ReadUint24() | uint32(tmp.ReadByte())<<24
+		if t != codec.FLV_TAG_TYPE_AUDIO && t != codec.FLV_TAG_TYPE_VIDEO && t != codec.FLV_TAG_TYPE_SCRIPT {
+			v.addIssue(VerifyIssue{Type: VerifyIssueCorrupt, Offset: offset, Message: fmt.Sprintf("invalid tag type %d", t)})
+			return nil
+		}
+		data := make([]byte, dataLen+4)
+		if n, err = io.ReadFull(reader, data); err != nil {
+			v.addIssue(VerifyIssue{Type: VerifyIssueTruncated, Offset: offset, Time: timestamp, Message: fmt.Sprintf("tag data truncated, %d of %d bytes", n, dataLen+4)})
+			return nil
+		}
+		if prevSize := binary.BigEndian.Uint32(data[dataLen:]); prevSize != dataLen+11 {
+			v.addIssue(VerifyIssue{Type: VerifyIssueCorrupt, Offset: offset, Time: timestamp, Message: fmt.Sprintf("PreviousTagSize %d, expect %d", prevSize, dataLen+11)})
+		}
+		tag := &FLVTag{Type: t, Timestamp: timestamp, Data: data[:dataLen]}
+		if t == codec.FLV_TAG_TYPE_SCRIPT {
+			if duration, ok := parseMetaDataDuration(tag.Data); ok {
+				v.DeclaredDuration = uint32(duration * 1000)
+			}
+		}
+		v.check(tag, offset)
+		offset += int64(11 + dataLen + 4)
+	}
+}
+
+// 解析onMetaData中的duration(秒)
+func parseMetaDataDuration(data []byte) (duration float64, ok bool) {
+	if len(data) < 1+2+len("onMetaData") {
+		return
+	}
+	amf := &util.AMF{
+		Buffer: util.Buffer(data[1+2+len("onMetaData"):]),
+	}
+	obj, err := amf.Unmarshal()
+	if err != nil {
+		return
+	}
+	if metaData, isMap := obj.(map[string]any); isMap {
+		duration, ok = metaData["duration"].(float64)
+	}
+	return
+}
+
+// 检查mp4顶层box的长度，有moov时解析mvhd中的时长，再检查时间轴
+func verifyMP4(file *os.File, v *tagVerifier) (err error) {
+	var offset int64
+	var hasMoov, hasMoof bool
+	head := make([]byte, 16)
+boxes:
+	for offset < v.Size {
+		v.ValidSize = offset
+		if v.Size-offset < 8 {
+			v.addIssue(VerifyIssue{Type: VerifyIssueTruncated, Offset: offset, Message: "box header truncated"})
+			break boxes
+		}
+		if _, err = file.ReadAt(head[:8], offset); err != nil {
+			return
+		}
+		size := int64(binary.BigEndian.Uint32(head))
+		boxType := string(head[4:8])
+		headSize := int64(8)
+		switch size {
+		case 0:
+			size = v.Size - offset
+		case 1:
+			if _, err = file.ReadAt(head[8:16], offset+8); err != nil {
+				v.addIssue(VerifyIssue{Type: VerifyIssueTruncated, Offset: offset, Message: "box header truncated"})
+				err = nil
+				break boxes
+			}
+			size = int64(binary.BigEndian.Uint64(head[8:]))
+			headSize = 16
+		}
+		if size < headSize {
+			v.addIssue(VerifyIssue{Type: VerifyIssueCorrupt, Offset: offset, Message: fmt.Sprintf("invalid box %q size %d", boxType, size)})
+			break boxes
+		}
+		if offset+size > v.Size {
+			v.addIssue(VerifyIssue{Type: VerifyIssueTruncated, Offset: offset, Message: fmt.Sprintf("box %q truncated, %d of %d bytes", boxType, v.Size-offset, size)})
+			break boxes
+		}
+		switch boxType {
+		case "moov":
+			hasMoov = true
+			moov := make([]byte, size-headSize)
+			if _, err = file.ReadAt(moov, offset+headSize); err != nil {
+				return
+			}
+			v.DeclaredDuration = parseMvhdDuration(moov)
+		case "moof":
+			hasMoof = true
+		}
+		offset += size
+	}
+	if offset >= v.Size {
+		v.ValidSize = v.Size
+	}
+	if hasMoof {
+		v.Format = "fmp4"
+		// fmp4的mvhd中通常没有时长
+		v.DeclaredDuration = 0
+	}
+	if !hasMoov {
+		v.addIssue(VerifyIssue{Type: VerifyIssueMissingMoov, Message: "moov box not found"})
+		return
+	}
+	verifyTags(file.Name(), v)
+	return
+}
+
+// 从moov中找到mvhd，返回时长(毫秒)
+func parseMvhdDuration(moov []byte) uint32 {
+	for len(moov) >= 8 {
+		size := int(binary.BigEndian.Uint32(moov))
+		if size < 8 || size > len(moov) {
+			return 0
+		}
+		if string(moov[4:8]) == "mvhd" {
+			mvhd := moov[8:size]
+			var timescale, duration uint64
+			if len(mvhd) >= 32 && mvhd[0] == 1 {
+				timescale = uint64(binary.BigEndian.Uint32(mvhd[20:]))
+				duration = binary.BigEndian.Uint64(mvhd[24:])
+			} else if len(mvhd) >= 20 {
+				timescale = uint64(binary.BigEndian.Uint32(mvhd[12:]))
+				duration = uint64(binary.BigEndian.Uint32(mvhd[16:]))
+			}
+			if timescale == 0 {
+				return 0
+			}
+			return uint32(duration * 1000 / timescale)
+		}
+		moov = moov[size:]
+	}
+	return 0
+}
+
+// 检查ts包的同步字节和长度，再检查时间轴
+func verifyTS(file *os.File, v *tagVerifier) (err error) {
+	reader := bufio.NewReader(file)
+	packet := make([]byte, 188)
+	var offset int64
+	var syncErrors int
+	for {
+		n, err := io.ReadFull(reader, packet)
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			v.addIssue(VerifyIssue{Type: VerifyIssueTruncated, Offset: offset, Message: fmt.Sprintf("ts packet truncated, %d bytes", n)})
+			break
+		}
+		if packet[0] != 0x47 {
+			if syncErrors++; syncErrors == 1 {
+				v.addIssue(VerifyIssue{Type: VerifyIssueCorrupt, Offset: offset, Message: "ts sync byte lost"})
+			}
+		}
+		offset += 188
+	}
+	v.ValidSize = offset
+	if syncErrors > 1 {
+		v.addIssue(VerifyIssue{Type: VerifyIssueCorrupt, Message: fmt.Sprintf("%d ts packets without sync byte", syncErrors)})
+	}
+	verifyTags(file.Name(), v)
+	return nil
+}
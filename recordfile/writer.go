@@ -0,0 +1,540 @@
+package recordfile
+
+import (
+	"bufio"
+	"encoding/binary"
+	"io"
+	"os"
+
+	"github.com/yapingcat/gomedia/go-mp4"
+	"github.com/yapingcat/gomedia/go-mpeg2"
+	"m7s.live/engine/v4/codec"
+	"m7s.live/engine/v4/util"
+)
+
+// flv文件onMetaData中的MetaDataCreator，插件加载时设置为引擎的版本
+var MetaDataCreator = "m7s"
+
+// 录像文件写入器，将flv格式的tag写入不同格式的文件
+type TagWriter interface {
+	WriteTag(*FLVTag) error
+	io.Closer
+}
+
+// 根据格式创建录像文件，format支持flv、mp4、fmp4、ts、ps
+func CreateTagWriter(filePath string, format string) (TagWriter, error) {
+	switch format {
+	case "flv":
+		return CreateFLVTagWriter(filePath)
+	case "mp4":
+		return CreateMP4TagWriter(filePath, false)
+	case "fmp4":
+		return CreateMP4TagWriter(filePath, true)
+	case "ts":
+		return CreateTSTagWriter(filePath)
+	case "ps":
+		return CreatePSTagWriter(filePath)
+	}
+	return nil, ErrUnsupportedFile
+}
+
+type FLVTagWriter struct {
+	file          *os.File
+	offset        uint64
+	duration      uint32
+	filepositions []uint64
+	times         []float64
+	videoCodecID  int
+	audioCodecID  int
+	hasAudio      bool
+	hasVideo      bool
+}
+
+func CreateFLVTagWriter(filePath string) (w *FLVTagWriter, err error) {
+	var file *os.File
+	if file, err = os.Create(filePath); err != nil {
+		return
+	}
+	if _, err = file.Write(codec.FLVHeader); err != nil {
+		file.Close()
+		return
+	}
+	return &FLVTagWriter{file: file, offset: uint64(len(codec.FLVHeader))}, nil
+}
+
+func (w *FLVTagWriter) WriteTag(tag *FLVTag) (err error) {
+	if len(tag.Data) == 0 {
+		return
+	}
+	switch tag.Type {
+	case codec.FLV_TAG_TYPE_VIDEO:
+		w.hasVideo = true
+		w.videoCodecID = int(tag.Data[0] & 0x0f)
+		if tag.IsKeyFrame() && !tag.IsSequenceHead() {
+			w.filepositions = append(w.filepositions, w.offset)
+			w.times = append(w.times, float64(tag.Timestamp)/1000)
+		}
+	case codec.FLV_TAG_TYPE_AUDIO:
+		w.hasAudio = true
+		w.audioCodecID = int(tag.Data[0] >> 4)
+	}
+	n, err := tag.WriteTo(w.file)
+	w.offset += uint64(n)
+	if tag.Timestamp > w.duration {
+		w.duration = tag.Timestamp
+	}
+	return
+}
+
+// 关闭时在文件头部插入onMetaData，包含关键帧索引
+func (w *FLVTagWriter) Close() (err error) {
+	defer w.file.Close()
+	var flags byte
+	metaData := util.EcmaArray{
+		"MetaDataCreator": MetaDataCreator,
+		"hasVideo":        w.hasVideo,
+		"hasAudio":        w.hasAudio,
+		"hasMatadata":     true,
+		"canSeekToEnd":    true,
+		"duration":        float64(w.duration) / 1000,
+		"hasKeyFrames":    len(w.filepositions) > 0,
+		"filesize":        0,
+	}
+	if w.hasAudio {
+		flags |= (1 << 2)
+		metaData["audiocodecid"] = w.audioCodecID
+	}
+	if w.hasVideo {
+		flags |= 1
+		metaData["videocodecid"] = w.videoCodecID
+		metaData["keyframes"] = map[string]any{
+			"filepositions": w.filepositions,
+			"times":         w.times,
+		}
+	}
+	var amf util.AMF
+	amf.Marshals("onMetaData", metaData)
+	offset := uint64(amf.Len() + 15)
+	metaData["filesize"] = w.offset + offset
+	for i := range w.filepositions {
+		w.filepositions[i] += offset
+	}
+	amf.Reset()
+	tag := &FLVTag{Type: codec.FLV_TAG_TYPE_SCRIPT, Data: amf.Marshals("onMetaData", metaData)}
+	tempFile, err := os.CreateTemp("", "*.flv")
+	if err != nil {
+		return
+	}
+	defer func() {
+		tempFile.Close()
+		os.Remove(tempFile.Name())
+	}()
+	if _, err = tempFile.Write([]byte{'F', 'L', 'V', 0x01, flags, 0, 0, 0, 9, 0, 0, 0, 0}); err != nil {
+		return
+	}
+	if _, err = tag.WriteTo(tempFile); err != nil {
+		return
+	}
+	if _, err = w.file.Seek(int64(len(codec.FLVHeader)), io.SeekStart); err != nil {
+		return
+	}
+	if _, err = io.Copy(tempFile, w.file); err != nil {
+		return
+	}
+	if _, err = tempFile.Seek(0, io.SeekStart); err != nil {
+		return
+	}
+	if _, err = w.file.Seek(0, io.SeekStart); err != nil {
+		return
+	}
+	_, err = io.Copy(w.file, tempFile)
+	return
+}
+
+// 使用gomedia写入mp4或fmp4文件
+type MP4TagWriter struct {
+	file    *os.File
+	muxer   *mp4.Movmuxer
+	videoId uint32
+	audioId uint32
+	asc     []byte
+}
+
+func CreateMP4TagWriter(filePath string, fragment bool) (w *MP4TagWriter, err error) {
+	var file *os.File
+	if file, err = os.Create(filePath); err != nil {
+		return
+	}
+	w = &MP4TagWriter{file: file}
+	if fragment {
+		w.muxer, err = mp4.CreateMp4Muxer(file, mp4.WithMp4Flag(mp4.MP4_FLAG_FRAGMENT))
+	} else {
+		w.muxer, err = mp4.CreateMp4Muxer(file)
+	}
+	if err != nil {
+		file.Close()
+		return nil, err
+	}
+	return
+}
+
+// 根据AudioSpecificConfig生成adts头
+func ADTSHeader(asc []byte, frameLen int) []byte {
+	objectType := asc[0] >> 3
+	sampleRateIndex := (asc[0]&0x07)<<1 | asc[1]>>7
+	channels := (asc[1] >> 3) & 0x0f
+	fullLen := frameLen + 7
+	return []byte{
+		0xFF, 0xF1,
+		(objectType-1)<<6 | sampleRateIndex<<2 | (channels>>2)&1,
+		(channels&3)<<6 | byte(fullLen>>11)&3,
+		byte(fullLen >> 3),
+		byte(fullLen&7)<<5 | 0x1F,
+		0xFC,
+	}
+}
+
+// 将avcc格式的nalu转换为annexb格式
+func avccToAnnexB(avcc []byte) (annexb []byte) {
+	for len(avcc) > 4 {
+		naluLen := int(binary.BigEndian.Uint32(avcc))
+		avcc = avcc[4:]
+		if naluLen > len(avcc) {
+			naluLen = len(avcc)
+		}
+		annexb = append(annexb, 0, 0, 0, 1)
+		annexb = append(annexb, avcc[:naluLen]...)
+		avcc = avcc[naluLen:]
+	}
+	return
+}
+
+func (w *MP4TagWriter) WriteTag(tag *FLVTag) (err error) {
+	if len(tag.Data) < 2 {
+		return
+	}
+	switch tag.Type {
+	case codec.FLV_TAG_TYPE_VIDEO:
+		if len(tag.Data) < 5 {
+			return
+		}
+		if tag.IsSequenceHead() {
+			if w.videoId == 0 {
+				switch codec.VideoCodecID(tag.Data[0] & 0x0f) {
+				case codec.CodecID_H264:
+					w.videoId = w.muxer.AddVideoTrack(mp4.MP4_CODEC_H264, mp4.WithExtraData(tag.Data[5:]))
+				case codec.CodecID_H265:
+					w.videoId = w.muxer.AddVideoTrack(mp4.MP4_CODEC_H265, mp4.WithExtraData(tag.Data[5:]))
+				}
+			}
+			return
+		}
+		if w.videoId == 0 {
+			return
+		}
+		cts := int32(uint32(tag.Data[2])<<16|uint32(tag.Data[3])<<8|uint32(tag.Data[4])) << 8 >> 8
+		pts := int64(tag.Timestamp) + int64(cts)
+		if pts < 0 {
+			pts = 0
+		}
+		return w.muxer.Write(w.videoId, avccToAnnexB(tag.Data[5:]), uint64(pts), uint64(tag.Timestamp))
+	case codec.FLV_TAG_TYPE_AUDIO:
+		switch codec.AudioCodecID(tag.Data[0] >> 4) {
+		case codec.CodecID_AAC:
+			if tag.Data[1] == 0 {
+				if w.audioId == 0 && len(tag.Data) >= 4 {
+					w.asc = tag.Data[2:]
+					w.audioId = w.muxer.AddAudioTrack(mp4.MP4_CODEC_AAC)
+				}
+				return
+			}
+			if w.audioId == 0 {
+				return
+			}
+			raw := tag.Data[2:]
+			return w.muxer.Write(w.audioId, append(ADTSHeader(w.asc, len(raw)), raw...), uint64(tag.Timestamp), uint64(tag.Timestamp))
+		case codec.CodecID_PCMA:
+			if w.audioId == 0 {
+				w.audioId = w.muxer.AddAudioTrack(mp4.MP4_CODEC_G711A, mp4.WithAudioSampleRate(8000), mp4.WithAudioChannelCount(1), mp4.WithAudioSampleBits(16))
+			}
+			return w.muxer.Write(w.audioId, tag.Data[1:], uint64(tag.Timestamp), uint64(tag.Timestamp))
+		case codec.CodecID_PCMU:
+			if w.audioId == 0 {
+				w.audioId = w.muxer.AddAudioTrack(mp4.MP4_CODEC_G711U, mp4.WithAudioSampleRate(8000), mp4.WithAudioChannelCount(1), mp4.WithAudioSampleBits(16))
+			}
+			return w.muxer.Write(w.audioId, tag.Data[1:], uint64(tag.Timestamp), uint64(tag.Timestamp))
+		}
+	}
+	return
+}
+
+func (w *MP4TagWriter) Close() (err error) {
+	err = w.muxer.WriteTrailer()
+	if closeErr := w.file.Close(); err == nil {
+		err = closeErr
+	}
+	return
+}
+
+// 从flv视频序列头中解析出annexb格式的参数集(vps、sps、pps)
+func VideoParamSets(seqHead []byte) (annexb []byte) {
+	if len(seqHead) < 6 {
+		return
+	}
+	record := seqHead[5:]
+	appendNalus := func(data []byte, count int) []byte {
+		for i := 0; i < count && len(data) >= 2; i++ {
+			naluLen := int(binary.BigEndian.Uint16(data))
+			data = data[2:]
+			if naluLen > len(data) {
+				return nil
+			}
+			annexb = append(annexb, 0, 0, 0, 1)
+			annexb = append(annexb, data[:naluLen]...)
+			data = data[naluLen:]
+		}
+		return data
+	}
+	switch codec.VideoCodecID(seqHead[0] & 0x0f) {
+	case codec.CodecID_H264:
+		if len(record) < 6 {
+			return
+		}
+		data := appendNalus(record[6:], int(record[5]&0x1f))
+		if len(data) > 0 {
+			appendNalus(data[1:], int(data[0]))
+		}
+	case codec.CodecID_H265:
+		if len(record) < 23 {
+			return
+		}
+		data := record[23:]
+		for i := 0; i < int(record[22]) && len(data) >= 3; i++ {
+			data = appendNalus(data[3:], int(binary.BigEndian.Uint16(data[1:])))
+		}
+	}
+	return
+}
+
+// 使用gomedia写入ts文件，关键帧前插入参数集
+type TSTagWriter struct {
+	file      *os.File
+	writer    *bufio.Writer
+	muxer     *mpeg2.TSMuxer
+	videoPid  uint16
+	audioPid  uint16
+	hasVideo  bool
+	hasAudio  bool
+	paramSets []byte
+	asc       []byte
+	err       error
+}
+
+func CreateTSTagWriter(filePath string) (w *TSTagWriter, err error) {
+	var file *os.File
+	if file, err = os.Create(filePath); err != nil {
+		return
+	}
+	w = &TSTagWriter{file: file, writer: bufio.NewWriter(file), muxer: mpeg2.NewTSMuxer()}
+	w.muxer.OnPacket = func(pkg []byte) {
+		if w.err == nil {
+			_, w.err = w.writer.Write(pkg)
+		}
+	}
+	return
+}
+
+func (w *TSTagWriter) WriteTag(tag *FLVTag) (err error) {
+	if len(tag.Data) < 2 {
+		return
+	}
+	switch tag.Type {
+	case codec.FLV_TAG_TYPE_VIDEO:
+		if len(tag.Data) < 5 {
+			return
+		}
+		if tag.IsSequenceHead() {
+			if !w.hasVideo {
+				switch codec.VideoCodecID(tag.Data[0] & 0x0f) {
+				case codec.CodecID_H264:
+					w.videoPid = w.muxer.AddStream(mpeg2.TS_STREAM_H264)
+				case codec.CodecID_H265:
+					w.videoPid = w.muxer.AddStream(mpeg2.TS_STREAM_H265)
+				default:
+					return
+				}
+				w.hasVideo = true
+			}
+			w.paramSets = VideoParamSets(tag.Data)
+			return
+		}
+		if !w.hasVideo {
+			return
+		}
+		cts := int32(uint32(tag.Data[2])<<16|uint32(tag.Data[3])<<8|uint32(tag.Data[4])) << 8 >> 8
+		pts := int64(tag.Timestamp) + int64(cts)
+		if pts < 0 {
+			pts = 0
+		}
+		annexb := avccToAnnexB(tag.Data[5:])
+		if tag.IsKeyFrame() {
+			annexb = append(append([]byte(nil), w.paramSets...), annexb...)
+		}
+		err = w.muxer.Write(w.videoPid, annexb, uint64(pts), uint64(tag.Timestamp))
+	case codec.FLV_TAG_TYPE_AUDIO:
+		// ts只支持aac音频
+		if codec.AudioCodecID(tag.Data[0]>>4) != codec.CodecID_AAC {
+			return
+		}
+		if tag.Data[1] == 0 {
+			if !w.hasAudio && len(tag.Data) >= 4 {
+				w.asc = tag.Data[2:]
+				w.audioPid = w.muxer.AddStream(mpeg2.TS_STREAM_AAC)
+				w.hasAudio = true
+			}
+			return
+		}
+		if !w.hasAudio {
+			return
+		}
+		raw := tag.Data[2:]
+		err = w.muxer.Write(w.audioPid, append(ADTSHeader(w.asc, len(raw)), raw...), uint64(tag.Timestamp), uint64(tag.Timestamp))
+	}
+	if err == nil {
+		err = w.err
+	}
+	return
+}
+
+func (w *TSTagWriter) Close() (err error) {
+	err = w.writer.Flush()
+	if closeErr := w.file.Close(); err == nil {
+		err = closeErr
+	}
+	return
+}
+
+// gomedia打包ps时SCR为dts减去40毫秒，时间戳加上一个基数避免溢出
+const PSTimestampBase = 1000
+
+// 写入ps流，用于和gb28181平台交换录像，视频支持h264、h265，音频支持aac、g711
+type PSTagWriter struct {
+	writer    io.Writer
+	buffered  *bufio.Writer
+	file      *os.File
+	muxer     *mpeg2.PSMuxer
+	videoSid  uint8
+	audioSid  uint8
+	hasVideo  bool
+	hasAudio  bool
+	paramSets []byte
+	asc       []byte
+	err       error
+}
+
+func CreatePSTagWriter(filePath string) (w *PSTagWriter, err error) {
+	var file *os.File
+	if file, err = os.Create(filePath); err != nil {
+		return
+	}
+	buffered := bufio.NewWriter(file)
+	w = NewPSTagWriter(buffered)
+	w.buffered = buffered
+	w.file = file
+	return
+}
+
+// 写入到任意的writer，例如http响应
+func NewPSTagWriter(writer io.Writer) (w *PSTagWriter) {
+	w = &PSTagWriter{writer: writer, muxer: mpeg2.NewPsMuxer()}
+	w.muxer.OnPacket = func(pkg []byte) {
+		if w.err == nil {
+			_, w.err = w.writer.Write(pkg)
+		}
+	}
+	return
+}
+
+func (w *PSTagWriter) WriteTag(tag *FLVTag) (err error) {
+	if len(tag.Data) < 2 {
+		return
+	}
+	timestamp := uint64(tag.Timestamp) + PSTimestampBase
+	switch tag.Type {
+	case codec.FLV_TAG_TYPE_VIDEO:
+		if len(tag.Data) < 5 {
+			return
+		}
+		if tag.IsSequenceHead() {
+			if !w.hasVideo {
+				switch codec.VideoCodecID(tag.Data[0] & 0x0f) {
+				case codec.CodecID_H264:
+					w.videoSid = w.muxer.AddStream(mpeg2.PS_STREAM_H264)
+				case codec.CodecID_H265:
+					w.videoSid = w.muxer.AddStream(mpeg2.PS_STREAM_H265)
+				default:
+					return
+				}
+				w.hasVideo = true
+			}
+			w.paramSets = VideoParamSets(tag.Data)
+			return
+		}
+		if !w.hasVideo {
+			return
+		}
+		cts := int32(uint32(tag.Data[2])<<16|uint32(tag.Data[3])<<8|uint32(tag.Data[4])) << 8 >> 8
+		pts := int64(timestamp) + int64(cts)
+		if pts < 0 {
+			pts = 0
+		}
+		annexb := avccToAnnexB(tag.Data[5:])
+		if tag.IsKeyFrame() {
+			annexb = append(append([]byte(nil), w.paramSets...), annexb...)
+		}
+		err = w.muxer.Write(w.videoSid, annexb, uint64(pts), timestamp)
+	case codec.FLV_TAG_TYPE_AUDIO:
+		switch codec.AudioCodecID(tag.Data[0] >> 4) {
+		case codec.CodecID_AAC:
+			if tag.Data[1] == 0 {
+				if !w.hasAudio && len(tag.Data) >= 4 {
+					w.asc = tag.Data[2:]
+					w.audioSid = w.muxer.AddStream(mpeg2.PS_STREAM_AAC)
+					w.hasAudio = true
+				}
+				return
+			}
+			if !w.hasAudio || w.asc == nil {
+				return
+			}
+			raw := tag.Data[2:]
+			err = w.muxer.Write(w.audioSid, append(ADTSHeader(w.asc, len(raw)), raw...), timestamp, timestamp)
+		case codec.CodecID_PCMA, codec.CodecID_PCMU:
+			if !w.hasAudio {
+				if codec.AudioCodecID(tag.Data[0]>>4) == codec.CodecID_PCMA {
+					w.audioSid = w.muxer.AddStream(mpeg2.PS_STREAM_G711A)
+				} else {
+					w.audioSid = w.muxer.AddStream(mpeg2.PS_STREAM_G711U)
+				}
+				w.hasAudio = true
+			}
+			err = w.muxer.Write(w.audioSid, tag.Data[1:], timestamp, timestamp)
+		}
+	}
+	if err == nil {
+		err = w.err
+	}
+	return
+}
+
+func (w *PSTagWriter) Close() (err error) {
+	if w.buffered != nil {
+		err = w.buffered.Flush()
+	}
+	if w.file != nil {
+		if closeErr := w.file.Close(); err == nil {
+			err = closeErr
+		}
+	}
+	return
+}
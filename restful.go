@@ -21,7 +21,7 @@ func (conf *RecordConfig) API_list(w http.ResponseWriter, r *http.Request) {
 	var err error
 	recorder := conf.getRecorderConfigByType(t)
 	if recorder == nil {
-		for _, t = range []string{"flv", "mp4", "fmp4", "hls", "raw", "raw_audio"} {
+		for _, t = range recordTypes {
 			recorder = conf.getRecorderConfigByType(t)
 			var fs []*VideoFileInfo
 			if fs, err = recorder.Tree(recorder.Path, 0); err == nil {
@@ -53,29 +53,24 @@ func (conf *RecordConfig) API_start(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 	t := query.Get("type")
+	if t == "" {
+		t = "flv"
+	}
 	var id string
 	var err error
-	var irecorder IRecorder
-	switch t {
-	case "":
-		t = "flv"
-		fallthrough
-	case "flv":
-		irecorder = NewFLVRecorder(OrdinaryMode)
-	case "mp4":
-		irecorder = NewMP4Recorder()
-	case "fmp4":
-		irecorder = NewFMP4Recorder()
-	case "hls":
-		irecorder = NewHLSRecorder()
-	case "raw":
-		irecorder = NewRawRecorder()
-	case "raw_audio":
-		irecorder = NewRawAudioRecorder()
-	default:
+	irecorder := newRecorderByType(t)
+	if irecorder == nil {
 		http.Error(w, "type not supported", http.StatusBadRequest)
 		return
 	}
+	// timeout表示定时录像的时长，只支持flv
+	var timeout time.Duration
+	if query.Get("timeout") != "" {
+		if timeout, err = time.ParseDuration(query.Get("timeout")); err != nil || timeout <= 0 || t != "flv" {
+			http.Error(w, "timeout parameter error", http.StatusBadRequest)
+			return
+		}
+	}
 	recorder := irecorder.GetRecorder()
 	if fragment != "" {
 		if f, err := time.ParseDuration(fragment); err == nil {
@@ -84,7 +79,10 @@ func (conf *RecordConfig) API_start(w http.ResponseWriter, r *http.Request) {
 	}
 	recorder.FileName = fileName
 	recorder.append = query.Get("append") != ""
-	if fileName != "" {
+	recorder.setTracks(query.Get("tracks"), query.Get("dropAudio"))
+	if timeout > 0 {
+		err = irecorder.StartWithDynamicTimeout(streamPath, fileName, timeout)
+	} else if fileName != "" {
 		err = irecorder.StartWithFileName(streamPath, fileName)
 	} else {
 		err = irecorder.Start(streamPath)
@@ -94,6 +92,11 @@ func (conf *RecordConfig) API_start(w http.ResponseWriter, r *http.Request) {
 		util.ReturnError(util.APIErrorInternal, err.Error(), w, r)
 		return
 	}
+	recording := &ActiveRecording{RecorderId: id, Type: t, StreamPath: streamPath, Fragment: fragment, FileName: fileName, Append: recorder.append, Tracks: query.Get("tracks"), DropAudio: query.Get("dropAudio")}
+	if timeout > 0 {
+		recording.Deadline = time.Now().Add(timeout).Format("2006-01-02 15:04:05")
+	}
+	saveActiveRecording(recording)
 	util.ReturnError(util.APIErrorNone, id, w, r)
 }
 
@@ -109,7 +112,9 @@ func (conf *RecordConfig) API_list_recording(w http.ResponseWriter, r *http.Requ
 
 func (conf *RecordConfig) API_stop(w http.ResponseWriter, r *http.Request) {
 	if recorder, ok := conf.recordings.Load(r.URL.Query().Get("id")); ok {
+		recorder.(IRecorder).GetRecorder().closing = true
 		recorder.(ISubscriber).Stop(zap.String("reason", "api"))
+		removeActiveRecording(recorder.(IRecorder).GetRecorder().ID)
 		util.ReturnOK(w, r)
 		return
 	}
@@ -125,6 +130,7 @@ func (conf *RecordConfig) API_recordfile_delete(w http.ResponseWriter, r *http.R
 		util.ReturnError(1, "删除文件时出错", w, r)
 		return
 	}
+	removeSidecar(path)
 	util.ReturnOK(w, r)
 }
 
@@ -154,7 +160,7 @@ func (conf *RecordConfig) API_list_page(w http.ResponseWriter, r *http.Request)
 	var totalPageCount int = 1
 	recorder := conf.getRecorderConfigByType(t)
 	if recorder == nil {
-		for _, t = range []string{"flv", "mp4", "fmp4", "hls", "raw", "raw_audio"} {
+		for _, t = range recordTypes {
 			recorder = conf.getRecorderConfigByType(t)
 			var fs []*VideoFileInfo
 			if fs, err = recorder.Tree(recorder.Path, 0); err == nil {
@@ -2,11 +2,10 @@ package record
 
 import (
 	"encoding/json"
-	"fmt"
 	"io"
-	"io/ioutil"
 	"log"
 	"net/http"
+	"path/filepath"
 	"strconv"
 	"strings"
 	"sync"
@@ -51,33 +50,15 @@ func (conf *RecordConfig) API_event_pull(w http.ResponseWriter, r *http.Request)
 		if result.Error != nil {
 			log.Println("Error finding eventrecord:", result.Error)
 		}
-		fileUrlPath := eventRecord.Urlpath
-		if fileUrlPath != "" {
-			// 判断协议类型
-			scheme := "http"
-			if r.TLS != nil {
-				scheme = "https" // 如果 r.TLS 不为空，则表示是 HTTPS
+		if eventRecord.Filepath != "" {
+			newStreamPath := eventRecord.StreamPath + "/" + strings.TrimSuffix(eventRecord.Filename, filepath.Ext(eventRecord.Filename))
+			publisher := NewFilePublisher(eventRecord.Filepath)
+			if err = publisher.Start(newStreamPath); err != nil {
+				exceptionChannel <- &Exception{AlarmType: "read", AlarmDesc: "录像读取失败", StreamPath: eventRecord.StreamPath}
+				resultJsonData["msg"] = err.Error()
+				util.ReturnError(-1, errorJsonString(resultJsonData), w, r)
+				return
 			}
-			// 获取完整请求的地址：包含协议、主机和端口
-			requestHost := fmt.Sprintf("%s://%s", scheme, r.Host)
-			fileUrlPath = requestHost + "/" + fileUrlPath
-			newStreamPath := eventRecord.StreamPath + "/" + strings.TrimSuffix(eventRecord.Filename, ".flv")
-			requestFullPath := fmt.Sprintf(requestHost+"/hdl/api/pull?streamPath=%s&target=%s", newStreamPath, fileUrlPath)
-			resp, err := http.Get(requestFullPath)
-			if err != nil {
-				log.Fatal("Error while making GET request:", err)
-			}
-			defer resp.Body.Close() // 确保函数结束后关闭响应体
-
-			// 读取响应体
-			body, err := ioutil.ReadAll(resp.Body)
-			if err != nil {
-				log.Fatal("Error reading response body:", err)
-			}
-
-			// 打印响应内容
-			fmt.Println("Response Status:", resp.Status)
-			fmt.Println("Response Body:", string(body))
 			resultJsonData["streamPath"] = newStreamPath
 			resultJsonData["code"] = 0
 			resultJsonData["msg"] = ""
@@ -260,7 +241,7 @@ func (conf *RecordConfig) API_event_start(w http.ResponseWriter, r *http.Request
 	recorder.FileName = fileName
 	recorder.append = false
 	irecorder.SetId(streamPath)
-	filepath := conf.Flv.Path + "/" + streamPath + "/" + fileName + recorder.Ext //录像文件存入的完整路径（相对路径）
+	filepath := recorder.Path + "/" + streamPath + "/" + fileName + recorder.Ext //录像文件存入的完整路径（相对路径）
 	urlpath := "record/" + streamPath + "/" + fileName + recorder.Ext            //网络拉流的地址
 	if fragment != "" {
 		if f, err := time.ParseDuration(fragment); err == nil {
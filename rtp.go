@@ -0,0 +1,395 @@
+package record
+
+import (
+	"bufio"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/pion/rtp"
+	"go.uber.org/zap"
+	. "m7s.live/engine/v4"
+	"m7s.live/engine/v4/codec"
+	"m7s.live/engine/v4/track"
+	"m7s.live/engine/v4/util"
+	"m7s.live/plugin/record/v4/recordfile"
+)
+
+// pcap文件使用LINKTYPE_RAW，每个rtp包前加上伪造的ipv4和udp头，用wireshark打开后按端口解码为rtp
+const (
+	pcapMagic       = 0xa1b2c3d4
+	pcapLinkTypeRaw = 101
+	pcapSnapLen     = 65535
+	rtpVideoPort    = 5000
+	rtpAudioPort    = 5002
+)
+
+var ErrInvalidPcap = errors.New("invalid pcap file")
+
+// 与pcap文件同名的json文件，记录轨道信息，回放时用于创建轨道
+type rtpCaptureInfo struct {
+	StreamPath string            `json:"streamPath"`
+	StartTime  time.Time         `json:"startTime"`
+	Tracks     []rtpCaptureTrack `json:"tracks"`
+}
+
+type rtpCaptureTrack struct {
+	Kind         string `json:"kind"` // video或audio
+	Codec        string `json:"codec"`
+	Port         uint16 `json:"port"` // pcap中udp的目的端口
+	ClockRate    uint32 `json:"clockRate"`
+	SequenceHead []byte `json:"sequenceHead,omitempty"` // flv格式的序列头
+}
+
+func rtpCaptureInfoPath(pcapPath string) string {
+	return strings.TrimSuffix(pcapPath, filepath.Ext(pcapPath)) + ".json"
+}
+
+// 删除rtp抓包文件时一起删除轨道信息
+func removeSidecar(path string) {
+	if filepath.Ext(path) == ".pcap" {
+		os.Remove(rtpCaptureInfoPath(path))
+	}
+}
+
+// 录制原始的rtp包和到达时间，用于取证和按原始节奏回放
+type RTPRecorder struct {
+	Recorder
+	startTime time.Time
+	packet    []byte
+}
+
+func (r *RTPRecorder) SetId(streamPath string) {
+	r.ID = streamPath + "/rtp"
+}
+
+// rtp录制只有普通录像
+func (r *RTPRecorder) GetRecordModeString(mode RecordMode) string {
+	return recordModeString(mode)
+}
+
+// 定时停止的录像只支持flv
+func (r *RTPRecorder) StartWithDynamicTimeout(streamPath, fileName string, timeout time.Duration) error {
+	return errors.ErrUnsupported
+}
+
+// 没有定时器，不需要处理
+func (r *RTPRecorder) UpdateTimeout(timeout time.Duration) {
+}
+
+func NewRTPRecorder() (r *RTPRecorder) {
+	r = &RTPRecorder{}
+	r.Record = *RecordPluginConfig.getRecorderConfigByType("rtp")
+	return r
+}
+
+func (r *RTPRecorder) Start(streamPath string) error {
+	r.ID = streamPath + "/rtp"
+	return r.start(r, streamPath, SUBTYPE_RTP)
+}
+
+func (r *RTPRecorder) StartWithFileName(streamPath string, fileName string) error {
+	r.ID = streamPath + "/rtp/" + fileName
+	return r.start(r, streamPath, SUBTYPE_RTP)
+}
+
+func (r *RTPRecorder) Close() (err error) {
+	if r.File != nil {
+		err = r.File.Close()
+	}
+	return
+}
+
+// 写入pcap文件头和轨道信息
+func (r *RTPRecorder) writeHeader() (err error) {
+	header := make([]byte, 24)
+	binary.LittleEndian.PutUint32(header, pcapMagic)
+	binary.LittleEndian.PutUint16(header[4:], 2)
+	binary.LittleEndian.PutUint16(header[6:], 4)
+	binary.LittleEndian.PutUint32(header[16:], pcapSnapLen)
+	binary.LittleEndian.PutUint32(header[20:], pcapLinkTypeRaw)
+	if _, err = r.File.Write(header); err != nil {
+		return
+	}
+	info := rtpCaptureInfo{StreamPath: r.Stream.Path, StartTime: time.Now()}
+	if r.VideoReader != nil {
+		info.Tracks = append(info.Tracks, rtpCaptureTrack{Kind: "video", Codec: r.Video.GetName(), Port: rtpVideoPort, ClockRate: 90000, SequenceHead: r.Video.SequenceHead})
+	}
+	if r.AudioReader != nil {
+		info.Tracks = append(info.Tracks, rtpCaptureTrack{Kind: "audio", Codec: r.Audio.GetName(), Port: rtpAudioPort, ClockRate: r.Audio.SampleRate, SequenceHead: r.Audio.SequenceHead})
+	}
+	data, err := json.MarshalIndent(info, "", "  ")
+	if err != nil {
+		return
+	}
+	return os.WriteFile(rtpCaptureInfoPath(filepath.Join(r.Path, r.filePath)), data, 0666)
+}
+
+// 写入一个pcap记录，时间为rtp包到达的时间
+func (r *RTPRecorder) writePacket(port uint16, raw []byte) (err error) {
+	now := time.Now()
+	size := 16 + 20 + 8 + len(raw)
+	if cap(r.packet) < size {
+		r.packet = make([]byte, size)
+	}
+	p := r.packet[:size]
+	binary.LittleEndian.PutUint32(p, uint32(now.Unix()))
+	binary.LittleEndian.PutUint32(p[4:], uint32(now.Nanosecond()/1000))
+	binary.LittleEndian.PutUint32(p[8:], uint32(size-16))
+	binary.LittleEndian.PutUint32(p[12:], uint32(size-16))
+	ip := p[16:36]
+	ip[0] = 0x45
+	ip[1] = 0
+	binary.BigEndian.PutUint16(ip[2:], uint16(size-16))
+	binary.BigEndian.PutUint32(ip[4:], 0)
+	ip[8] = 64
+	ip[9] = 17 // udp
+	binary.BigEndian.PutUint16(ip[10:], 0)
+	copy(ip[12:], []byte{127, 0, 0, 1, 127, 0, 0, 1})
+	var sum uint32
+	for i := 0; i < 20; i += 2 {
+		sum += uint32(binary.BigEndian.Uint16(ip[i:]))
+	}
+	for sum > 0xffff {
+		sum = sum>>16 + sum&0xffff
+	}
+	binary.BigEndian.PutUint16(ip[10:], ^uint16(sum))
+	udp := p[36:44]
+	binary.BigEndian.PutUint16(udp, port)
+	binary.BigEndian.PutUint16(udp[2:], port)
+	binary.BigEndian.PutUint16(udp[4:], uint16(8+len(raw)))
+	binary.BigEndian.PutUint16(udp[6:], 0) // ipv4下udp校验和可以为0
+	copy(p[44:], raw)
+	_, err = r.File.Write(p)
+	return
+}
+
+// 判断rtp包是否为关键帧的开始，引擎在关键帧前发送参数集
+func (r *RTPRecorder) isKeyframeStart(payload []byte) bool {
+	if len(payload) < 3 {
+		return false
+	}
+	switch r.Video.CodecID {
+	case codec.CodecID_H264:
+		switch payload[0] & 0x1f {
+		case 7: // SPS
+			return true
+		case 24: // STAP-A
+			return len(payload) > 3 && payload[3]&0x1f == 7
+		case 28: // FU-A
+			return payload[1]&0x80 != 0 && payload[1]&0x1f == 5
+		}
+	case codec.CodecID_H265:
+		switch (payload[0] >> 1) & 0x3f {
+		case 32: // VPS
+			return true
+		case 48: // AP
+			return len(payload) > 4 && (payload[4]>>1)&0x3f == 32
+		case 49: // FU
+			return payload[2]&0x80 != 0 && (payload[2]&0x3f == 19 || payload[2]&0x3f == 20)
+		}
+	}
+	return false
+}
+
+func (r *RTPRecorder) OnEvent(event any) {
+	var err error
+	switch v := event.(type) {
+	case FileWr:
+		// 每个文件从0开始计算分片时长
+		r.startTime = time.Now()
+		r.SkipTS = 0
+		err = r.writeHeader()
+	case VideoRTP:
+		// rtp没有经过帧的处理，按到达时间在关键帧处分片
+		if r.Fragment > 0 && r.isKeyframeStart(v.Payload) {
+			r.cut(uint32(time.Since(r.startTime).Milliseconds()))
+		}
+		var raw []byte
+		if raw, err = v.Packet.Marshal(); err == nil {
+			err = r.writePacket(rtpVideoPort, raw)
+		}
+	case AudioRTP:
+		if r.Fragment > 0 && r.VideoReader == nil {
+			r.cut(uint32(time.Since(r.startTime).Milliseconds()))
+		}
+		var raw []byte
+		if raw, err = v.Packet.Marshal(); err == nil {
+			err = r.writePacket(rtpAudioPort, raw)
+		}
+	default:
+		r.Recorder.OnEvent(event)
+	}
+	if err != nil {
+		r.Stop(zap.Error(err))
+	}
+}
+
+// 读取pcap文件中的rtp包
+type pcapReader struct {
+	reader  *bufio.Reader
+	header  [16]byte
+	order   binary.ByteOrder
+	nano    bool
+	snapLen uint32
+}
+
+func newPcapReader(file io.Reader) (r *pcapReader, err error) {
+	r = &pcapReader{reader: bufio.NewReader(file)}
+	var header [24]byte
+	if _, err = io.ReadFull(r.reader, header[:]); err != nil {
+		return
+	}
+	switch binary.LittleEndian.Uint32(header[:]) {
+	case pcapMagic:
+		r.order = binary.LittleEndian
+	case 0xa1b23c4d:
+		r.order, r.nano = binary.LittleEndian, true
+	case 0xd4c3b2a1:
+		r.order = binary.BigEndian
+	case 0x4d3cb2a1:
+		r.order, r.nano = binary.BigEndian, true
+	default:
+		return nil, ErrInvalidPcap
+	}
+	if r.order.Uint32(header[20:]) != pcapLinkTypeRaw {
+		return nil, ErrInvalidPcap
+	}
+	// 包长度不能超过snaplen，也不能超过udp包的最大长度，防止损坏的文件导致分配过大的内存
+	if r.snapLen = r.order.Uint32(header[16:]); r.snapLen == 0 || r.snapLen > pcapSnapLen {
+		r.snapLen = pcapSnapLen
+	}
+	return
+}
+
+// 返回到达时间、udp目的端口和rtp包
+func (r *pcapReader) readPacket() (arrival time.Time, port uint16, payload []byte, err error) {
+	for {
+		if _, err = io.ReadFull(r.reader, r.header[:]); err != nil {
+			return
+		}
+		inclLen := r.order.Uint32(r.header[8:])
+		if inclLen > r.snapLen {
+			return arrival, 0, nil, ErrInvalidPcap
+		}
+		data := make([]byte, inclLen)
+		if _, err = io.ReadFull(r.reader, data); err != nil {
+			return
+		}
+		sub := int64(r.order.Uint32(r.header[4:]))
+		if !r.nano {
+			sub *= 1000
+		}
+		arrival = time.Unix(int64(r.order.Uint32(r.header[:])), sub)
+		// 只处理ipv4的udp包
+		if len(data) < 20 || data[0]>>4 != 4 || data[9] != 17 {
+			continue
+		}
+		ihl := int(data[0]&0x0f) * 4
+		if len(data) < ihl+8 {
+			continue
+		}
+		port = binary.BigEndian.Uint16(data[ihl+2:])
+		payload = data[ihl+8:]
+		return
+	}
+}
+
+// 按照rtp包的到达时间回放，rtp时间戳按轨道平移，保证换文件和循环时单调递增
+func (p *FilePublisher) publishRTPFile(filePath string, skip uint32, start time.Time) (err error) {
+	data, err := os.ReadFile(rtpCaptureInfoPath(filePath))
+	if err != nil {
+		return
+	}
+	var info rtpCaptureInfo
+	if err = json.Unmarshal(data, &info); err != nil {
+		return
+	}
+	file, err := os.Open(filePath)
+	if err != nil {
+		return
+	}
+	defer file.Close()
+	reader, err := newPcapReader(file)
+	if err != nil {
+		return
+	}
+	p.Info("publish rtp file", zap.String("file", filePath), zap.Int("loop", p.LoopCount))
+	tracks := make(map[uint16]*rtpCaptureTrack)
+	firstRTP := make(map[uint16]uint32)
+	// 每个轨道的rtp时间戳只平移一个常量(该轨道第一个包的回放时间换算为时钟频率)，包之间的间隔已经包含在rtp时间戳中
+	shiftRTP := make(map[uint16]uint32)
+	for i := range info.Tracks {
+		t := &info.Tracks[i]
+		tracks[t.Port] = t
+		// 先通过序列头创建轨道，g711没有序列头需要单独创建
+		switch {
+		case len(t.SequenceHead) > 0:
+			p.writeTag(&recordfile.FLVTag{Type: util.Conditoinal(t.Kind == "video", codec.FLV_TAG_TYPE_VIDEO, codec.FLV_TAG_TYPE_AUDIO), Data: t.SequenceHead}, p.tsBase)
+		case t.Codec == "pcma" && p.AudioTrack == nil:
+			p.AudioTrack = track.NewG711(p, true, uint32(t.ClockRate))
+		case t.Codec == "pcmu" && p.AudioTrack == nil:
+			p.AudioTrack = track.NewG711(p, false, uint32(t.ClockRate))
+		}
+	}
+	var first time.Time
+	for p.Err() == nil {
+		var arrival time.Time
+		var port uint16
+		var raw []byte
+		if arrival, port, raw, err = reader.readPacket(); err != nil {
+			break
+		}
+		t, ok := tracks[port]
+		if !ok {
+			continue
+		}
+		if first.IsZero() {
+			first = arrival
+		}
+		// 抓包时间可能回退，按0处理
+		var relative uint32
+		if elapsed := arrival.Sub(first).Milliseconds(); elapsed > 0 {
+			relative = uint32(elapsed)
+		}
+		if relative < skip {
+			continue
+		}
+		timestamp := p.tsBase + relative - skip
+		if p.Duration > 0 && time.Duration(timestamp-p.loopBase)*time.Millisecond > p.Duration {
+			err = errPublishRangeEnd
+			break
+		}
+		packet := &rtp.Packet{}
+		if packet.Unmarshal(raw) != nil {
+			continue
+		}
+		if _, ok := firstRTP[port]; !ok {
+			firstRTP[port] = packet.Timestamp
+			shiftRTP[port] = uint32(uint64(timestamp) * uint64(t.ClockRate) / 1000)
+		}
+		packet.Timestamp = packet.Timestamp - firstRTP[port] + shiftRTP[port]
+		if timestamp > p.lastTs {
+			p.lastTs = timestamp
+		}
+		if sleepTime := time.Duration(float64(timestamp)/p.Speed)*time.Millisecond - time.Since(start); sleepTime > 0 {
+			time.Sleep(sleepTime)
+		}
+		p.frames++
+		if t.Kind == "video" && p.VideoTrack != nil {
+			p.VideoTrack.WriteRTPPack(packet)
+		} else if t.Kind == "audio" && p.AudioTrack != nil {
+			p.AudioTrack.WriteRTPPack(packet)
+		}
+	}
+	if err == io.EOF || err == io.ErrUnexpectedEOF {
+		err = nil
+	}
+	p.tsBase = p.lastTs + recordfile.FileJoinGap
+	return
+}
@@ -0,0 +1,165 @@
+package record
+
+import (
+	"io/fs"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+// 自动录制规则，同一种格式可以按流路径使用不同的分片、目录和保留时长
+type RecordRule struct {
+	Filter               string        `json:"filter" desc:"录制过滤器，正则表达式，空表示匹配所有流"`
+	Fragment             time.Duration `json:"fragment" desc:"分片大小，0表示不分片"`
+	Path                 string        `json:"path" desc:"存储的子目录，相对于所属格式的Path"`
+	Naming               string        `json:"naming" desc:"分片文件名格式，{stream}替换为流名称，{time}替换为开始时间，默认{stream}_{time}"`
+	ExpireDays           int           `json:"expireDays" desc:"录像保留的天数，0表示不自动删除"`
+	Tracks               string        `json:"tracks" desc:"录制的轨道，格式同Record的Tracks，空表示使用所属格式的配置"`
+	DropUnsupportedAudio *bool         `json:"dropUnsupportedAudio" desc:"是否丢弃无法存储的音频编码，空表示使用所属格式的配置"`
+	filter               *regexp.Regexp
+	invalid              bool // 过滤器或路径不合法，规则不生效，避免匹配所有的流
+}
+
+var ruleRetentionOnce sync.Once
+
+func (rule *RecordRule) init() (err error) {
+	rule.filter, rule.invalid = nil, false
+	// 配置文件中的路径和通过接口设置的一样需要校验
+	if err = checkSettingsPath(rule.Path); err != nil {
+		rule.invalid = true
+		return
+	}
+	if rule.Filter != "" {
+		rule.filter, err = regexp.Compile(rule.Filter)
+		rule.invalid = err != nil
+	}
+	return
+}
+
+func (rule *RecordRule) match(streamPath string) bool {
+	if rule.invalid {
+		return false
+	}
+	return rule.filter == nil || rule.filter.MatchString(streamPath)
+}
+
+// 分片录像的文件名，不包含扩展名
+func (rule *RecordRule) fragmentName(streamPath string) string {
+	naming := rule.Naming
+	if naming == "" {
+		naming = "{stream}_{time}"
+	}
+	return strings.NewReplacer("{stream}", transform(streamPath), "{time}", time.Now().Format("2006-01-02-15-04-05")).Replace(naming)
+}
+
+// 返回匹配的录制规则，没有配置规则时使用Filter判断，rule为nil
+func (r *Record) MatchRule(streamPath string) (rule *RecordRule, ok bool) {
+	if !r.AutoRecord {
+		return nil, false
+	}
+	if len(r.Rules) == 0 {
+		return nil, !r.Filter.Valid() || r.Filter.MatchString(streamPath)
+	}
+	for i := range r.Rules {
+		if r.Rules[i].match(streamPath) {
+			return &r.Rules[i], true
+		}
+	}
+	return nil, false
+}
+
+// 使用规则中的分片、文件名和轨道配置
+func (r *Recorder) applyRule(rule *RecordRule) {
+	r.rule = rule
+	r.Fragment = rule.Fragment
+	if rule.Tracks != "" {
+		r.Tracks = rule.Tracks
+	}
+	if rule.DropUnsupportedAudio != nil {
+		r.DropUnsupportedAudio = *rule.DropUnsupportedAudio
+	}
+}
+
+// 按规则自动删除过期的录像，每分钟检查一次
+func (conf *RecordConfig) startRuleRetention() {
+	ruleRetentionOnce.Do(func() {
+		go func() {
+			for {
+				for _, t := range recordTypes {
+					record := conf.getRecorderConfigByType(t)
+					for i := range record.Rules {
+						if record.Rules[i].ExpireDays > 0 {
+							record.removeExpired(&record.Rules[i])
+						}
+					}
+				}
+				time.Sleep(time.Minute)
+			}
+		}()
+	})
+}
+
+// 删除规则目录下过期的录像，规则没有单独的目录(或者目录和其他规则相同)时按流路径过滤
+// 其他规则的目录由对应的规则负责，重要事件录像不删除
+func (r *Record) removeExpired(rule *RecordRule) {
+	if rule.invalid {
+		return
+	}
+	dir := filepath.Join(r.Path, rule.Path)
+	others := make(map[string]bool)
+	shared := rule.Path == ""
+	for i := range r.Rules {
+		if other := &r.Rules[i]; other != rule && other.Path != "" {
+			otherDir := filepath.Join(r.Path, other.Path)
+			others[otherDir] = true
+			shared = shared || otherDir == dir
+		}
+	}
+	expireTime := time.Now().AddDate(0, 0, -rule.ExpireDays)
+	filepath.WalkDir(dir, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return nil
+		}
+		if d.IsDir() {
+			if path != dir && others[path] {
+				return fs.SkipDir
+			}
+			return nil
+		}
+		if r.Ext != "." && filepath.Ext(path) != r.Ext && !(r.Ext == ".m3u8" && isHLSSegment(path)) && !mkvExtMatch(r.Ext, filepath.Ext(path)) {
+			return nil
+		}
+		if shared {
+			rel, _ := filepath.Rel(dir, filepath.Dir(path))
+			if !rule.match(filepath.ToSlash(rel)) {
+				return nil
+			}
+		}
+		if _, writing := WritingFiles.Load(path); writing {
+			return nil
+		}
+		info, err := d.Info()
+		if err != nil || info.ModTime().After(expireTime) {
+			return nil
+		}
+		filePath := filepath.ToSlash(path)
+		var important int64
+		db.Model(&EventRecord{}).Where("filepath = ? AND event_level = ?", filePath, "0").Count(&important)
+		if important > 0 {
+			return nil
+		}
+		if err = os.Remove(path); err != nil {
+			plugin.Error("remove expired record", zap.String("path", path), zap.Error(err))
+		} else {
+			plugin.Info("remove expired record", zap.String("path", path))
+			removeSidecar(path)
+			db.Where("filepath = ?", filePath).Delete(&EventRecord{})
+		}
+		return nil
+	})
+}
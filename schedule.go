@@ -0,0 +1,359 @@
+package record
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"go.uber.org/zap"
+	. "m7s.live/engine/v4"
+	"m7s.live/engine/v4/util"
+)
+
+var ErrInvalidPlan = errors.New("invalid record plan")
+
+// 计划录像启动的录像，多个计划可能同时匹配同一个流，所有计划都结束后才停止录像
+type planRecording struct {
+	PlanIds    []uint `json:"planIds"`
+	RecorderId string `json:"recorderId"`
+	StreamPath string `json:"streamPath"`
+	Type       string `json:"type"`
+	StartTime  string `json:"startTime"`
+}
+
+var scheduleOnce sync.Once
+var scheduleLock sync.Mutex
+var planPatterns sync.Map // 计划id -> 编译后的StreamPattern，避免每次调度都重新编译
+
+// 不指定文件名时录像的id
+func defaultRecorderId(t, streamPath string) string {
+	if t == "flv" {
+		return streamPath + "/flv/ordinarymode"
+	}
+	return streamPath + "/" + t
+}
+
+// 解析时间段，例如08:00-12:00，返回从0点开始的分钟数
+func parseTimeWindow(window string) (start, end int, err error) {
+	parts := strings.Split(strings.TrimSpace(window), "-")
+	if len(parts) != 2 {
+		return 0, 0, fmt.Errorf("%w: window %q", ErrInvalidPlan, window)
+	}
+	clock := func(s string) (int, error) {
+		t, err := time.Parse("15:04", strings.TrimSpace(s))
+		if err != nil {
+			return 0, fmt.Errorf("%w: window %q", ErrInvalidPlan, window)
+		}
+		return t.Hour()*60 + t.Minute(), nil
+	}
+	if start, err = clock(parts[0]); err != nil {
+		return
+	}
+	if end, err = clock(parts[1]); err != nil {
+		return
+	}
+	// 24:00无法用15:04解析，用00:00表示到当天结束
+	if end == 0 {
+		end = 24 * 60
+	}
+	return
+}
+
+// 校验计划，返回编译好的StreamPattern
+func (plan *RecordPlan) validate() (*regexp.Regexp, error) {
+	if plan.StreamPattern == "" {
+		return nil, fmt.Errorf("%w: no streamPattern", ErrInvalidPlan)
+	}
+	pattern, err := regexp.Compile(plan.StreamPattern)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrInvalidPlan, err)
+	}
+	if plan.Type == "" {
+		plan.Type = "flv"
+	}
+	if newRecorderByType(plan.Type) == nil {
+		return nil, fmt.Errorf("%w: type %q not supported", ErrInvalidPlan, plan.Type)
+	}
+	if plan.Fragment != "" {
+		if _, err := time.ParseDuration(plan.Fragment); err != nil {
+			return nil, fmt.Errorf("%w: fragment %q", ErrInvalidPlan, plan.Fragment)
+		}
+	}
+	if plan.Windows != "" {
+		for _, window := range strings.Split(plan.Windows, ",") {
+			if _, _, err := parseTimeWindow(window); err != nil {
+				return nil, err
+			}
+		}
+	}
+	if plan.Weekdays != "" {
+		for _, day := range strings.Split(plan.Weekdays, ",") {
+			if d, err := strconv.Atoi(strings.TrimSpace(day)); err != nil || d < 0 || d > 6 {
+				return nil, fmt.Errorf("%w: weekday %q", ErrInvalidPlan, day)
+			}
+		}
+	}
+	if plan.ExcludeDates != "" {
+		for _, date := range strings.Split(plan.ExcludeDates, ",") {
+			if _, err := time.Parse("2006-01-02", strings.TrimSpace(date)); err != nil {
+				return nil, fmt.Errorf("%w: date %q", ErrInvalidPlan, date)
+			}
+		}
+	}
+	return pattern, nil
+}
+
+// 使用添加或修改计划时编译好的正则表达式，启动前保存的计划在第一次使用时编译
+func (plan *RecordPlan) match(streamPath string) bool {
+	value, ok := planPatterns.Load(plan.Id)
+	if !ok || value.(*regexp.Regexp).String() != plan.StreamPattern {
+		pattern, err := regexp.Compile(plan.StreamPattern)
+		if err != nil {
+			return false
+		}
+		planPatterns.Store(plan.Id, pattern)
+		value = pattern
+	}
+	return value.(*regexp.Regexp).MatchString(streamPath)
+}
+
+// 判断计划在t时刻是否需要录像
+func (plan *RecordPlan) activeAt(t time.Time) bool {
+	if !plan.Enable {
+		return false
+	}
+	if plan.ExcludeDates != "" {
+		today := t.Format("2006-01-02")
+		for _, date := range strings.Split(plan.ExcludeDates, ",") {
+			if strings.TrimSpace(date) == today {
+				return false
+			}
+		}
+	}
+	if plan.Weekdays != "" {
+		weekday := strconv.Itoa(int(t.Weekday()))
+		found := false
+		for _, day := range strings.Split(plan.Weekdays, ",") {
+			if strings.TrimSpace(day) == weekday {
+				found = true
+				break
+			}
+		}
+		if !found {
+			return false
+		}
+	}
+	if plan.Windows == "" {
+		return true
+	}
+	minute := t.Hour()*60 + t.Minute()
+	for _, window := range strings.Split(plan.Windows, ",") {
+		start, end, err := parseTimeWindow(window)
+		if err != nil {
+			continue
+		}
+		// 跨越0点的时间段，例如22:00-06:00
+		if start <= end && minute >= start && minute < end || start > end && (minute >= start || minute < end) {
+			return true
+		}
+	}
+	return false
+}
+
+// 启动计划录像的后台调度，每10秒检查一次
+func (conf *RecordConfig) startScheduler() {
+	scheduleOnce.Do(func() {
+		go func() {
+			for {
+				conf.schedule()
+				time.Sleep(10 * time.Second)
+			}
+		}()
+	})
+}
+
+func (conf *RecordConfig) schedule() {
+	scheduleLock.Lock()
+	defer scheduleLock.Unlock()
+	var plans []RecordPlan
+	db.Where("enable = ?", true).Find(&plans)
+	now := time.Now()
+	active := make(map[uint]*RecordPlan)
+	for i := range plans {
+		if plans[i].activeAt(now) {
+			active[plans[i].Id] = &plans[i]
+		}
+	}
+	Streams.Range(func(streamPath string, s *Stream) {
+		for _, plan := range active {
+			if plan.match(streamPath) {
+				conf.startPlanRecording(plan, streamPath)
+			}
+		}
+	})
+	// 计划结束、被删除或者流已经结束的录像
+	conf.planRecordings.Range(func(key, value any) bool {
+		recording := value.(*planRecording)
+		recorder, ok := conf.recordings.Load(recording.RecorderId)
+		if !ok {
+			conf.planRecordings.Delete(key)
+			return true
+		}
+		planIds := recording.PlanIds[:0]
+		for _, id := range recording.PlanIds {
+			if plan, ok := active[id]; ok && plan.match(recording.StreamPath) {
+				planIds = append(planIds, id)
+			}
+		}
+		if len(planIds) > 0 {
+			recording.PlanIds = planIds
+			return true
+		}
+		plugin.Info("record plan stop", zap.Uints("plans", recording.PlanIds), zap.String("id", recording.RecorderId))
+		recorder.(IRecorder).GetRecorder().closing = true
+		recorder.(IRecorder).Stop(zap.String("reason", "record plan end"))
+		conf.planRecordings.Delete(key)
+		return true
+	})
+}
+
+// 流发布时立即检查计划，不用等到下一次调度
+func (conf *RecordConfig) schedulePublish(streamPath string) {
+	scheduleLock.Lock()
+	defer scheduleLock.Unlock()
+	var plans []RecordPlan
+	db.Where("enable = ?", true).Find(&plans)
+	now := time.Now()
+	for i := range plans {
+		if plans[i].activeAt(now) && plans[i].match(streamPath) {
+			conf.startPlanRecording(&plans[i], streamPath)
+		}
+	}
+}
+
+func (conf *RecordConfig) startPlanRecording(plan *RecordPlan, streamPath string) {
+	recorderId := defaultRecorderId(plan.Type, streamPath)
+	if _, ok := conf.recordings.Load(recorderId); ok {
+		// 其他计划启动的录像，记录该计划也在使用，手动启动的录像不由计划停止
+		if value, ok := conf.planRecordings.Load(recorderId); ok {
+			recording := value.(*planRecording)
+			for _, id := range recording.PlanIds {
+				if id == plan.Id {
+					return
+				}
+			}
+			recording.PlanIds = append(recording.PlanIds, plan.Id)
+		}
+		return
+	}
+	irecorder := newRecorderByType(plan.Type)
+	if plan.Fragment != "" {
+		irecorder.GetRecorder().Fragment, _ = time.ParseDuration(plan.Fragment)
+	}
+	if err := irecorder.Start(streamPath); err != nil {
+		plugin.Error("record plan start", zap.Uint("plan", plan.Id), zap.String("streamPath", streamPath), zap.Error(err))
+		return
+	}
+	plugin.Info("record plan start", zap.Uint("plan", plan.Id), zap.String("id", recorderId))
+	conf.planRecordings.Store(recorderId, &planRecording{
+		PlanIds:    []uint{plan.Id},
+		RecorderId: recorderId,
+		StreamPath: streamPath,
+		Type:       plan.Type,
+		StartTime:  time.Now().Format("2006-01-02 15:04:05"),
+	})
+}
+
+func (conf *RecordConfig) API_plan_list(w http.ResponseWriter, r *http.Request) {
+	util.ReturnFetchValue(func() (plans []RecordPlan) {
+		db.Order("id").Find(&plans)
+		return
+	}, w, r)
+}
+
+// 正在按计划录像的流
+func (conf *RecordConfig) API_plan_recording(w http.ResponseWriter, r *http.Request) {
+	util.ReturnFetchValue(func() (recordings []planRecording) {
+		scheduleLock.Lock()
+		defer scheduleLock.Unlock()
+		conf.planRecordings.Range(func(key, value any) bool {
+			recording := *value.(*planRecording)
+			recording.PlanIds = append([]uint(nil), recording.PlanIds...)
+			recordings = append(recordings, recording)
+			return true
+		})
+		return
+	}, w, r)
+}
+
+// 添加录像计划，请求体为RecordPlan的json
+func (conf *RecordConfig) API_plan_add(w http.ResponseWriter, r *http.Request) {
+	var plan RecordPlan
+	if err := json.NewDecoder(r.Body).Decode(&plan); err != nil {
+		util.ReturnError(util.APIErrorDecode, err.Error(), w, r)
+		return
+	}
+	pattern, err := plan.validate()
+	if err != nil {
+		util.ReturnError(util.APIErrorDecode, err.Error(), w, r)
+		return
+	}
+	plan.Id = 0
+	plan.CreateTime = time.Now().Format("2006-01-02 15:04:05")
+	if err = db.Create(&plan).Error; err != nil {
+		util.ReturnError(util.APIErrorInternal, err.Error(), w, r)
+		return
+	}
+	planPatterns.Store(plan.Id, pattern)
+	go conf.schedule()
+	util.ReturnValue(plan, w, r)
+}
+
+// 修改录像计划，请求体为RecordPlan的json，需要包含id
+func (conf *RecordConfig) API_plan_update(w http.ResponseWriter, r *http.Request) {
+	var plan RecordPlan
+	if err := json.NewDecoder(r.Body).Decode(&plan); err != nil {
+		util.ReturnError(util.APIErrorDecode, err.Error(), w, r)
+		return
+	}
+	var old RecordPlan
+	if err := db.First(&old, plan.Id).Error; err != nil {
+		util.ReturnError(util.APIErrorNotFound, err.Error(), w, r)
+		return
+	}
+	pattern, err := plan.validate()
+	if err != nil {
+		util.ReturnError(util.APIErrorDecode, err.Error(), w, r)
+		return
+	}
+	plan.CreateTime = old.CreateTime
+	if err = db.Save(&plan).Error; err != nil {
+		util.ReturnError(util.APIErrorInternal, err.Error(), w, r)
+		return
+	}
+	planPatterns.Store(plan.Id, pattern)
+	go conf.schedule()
+	util.ReturnValue(plan, w, r)
+}
+
+// 删除录像计划，正在按该计划录像的流会在下一次调度时停止
+func (conf *RecordConfig) API_plan_delete(w http.ResponseWriter, r *http.Request) {
+	id, err := strconv.Atoi(r.URL.Query().Get("id"))
+	if err != nil {
+		http.Error(w, "id parameter error", http.StatusBadRequest)
+		return
+	}
+	if err = db.Delete(&RecordPlan{}, id).Error; err != nil {
+		util.ReturnError(util.APIErrorInternal, err.Error(), w, r)
+		return
+	}
+	planPatterns.Delete(uint(id))
+	go conf.schedule()
+	util.ReturnOK(w, r)
+}
@@ -0,0 +1,80 @@
+package record
+
+import (
+	"errors"
+	"testing"
+	"time"
+)
+
+func TestParseTimeWindow(t *testing.T) {
+	tests := []struct {
+		window     string
+		start, end int
+		err        error
+	}{
+		{"08:00-12:00", 8 * 60, 12 * 60, nil},
+		{" 08:30 - 12:15 ", 8*60 + 30, 12*60 + 15, nil},
+		{"22:00-06:00", 22 * 60, 6 * 60, nil},
+		// 00:00作为结束时间表示到当天结束
+		{"18:00-00:00", 18 * 60, 24 * 60, nil},
+		{"00:00-00:00", 0, 24 * 60, nil},
+		{"08:00", 0, 0, ErrInvalidPlan},
+		{"08:00-12:00-13:00", 0, 0, ErrInvalidPlan},
+		{"8h-12h", 0, 0, ErrInvalidPlan},
+		{"24:00-25:00", 0, 0, ErrInvalidPlan},
+		{"", 0, 0, ErrInvalidPlan},
+	}
+	for _, tt := range tests {
+		t.Run(tt.window, func(t *testing.T) {
+			start, end, err := parseTimeWindow(tt.window)
+			if !errors.Is(err, tt.err) {
+				t.Fatalf("err = %v, want %v", err, tt.err)
+			}
+			if err == nil && (start != tt.start || end != tt.end) {
+				t.Errorf("got %d-%d, want %d-%d", start, end, tt.start, tt.end)
+			}
+		})
+	}
+}
+
+func TestRecordPlanActiveAt(t *testing.T) {
+	// 2024-10-07是周一
+	at := func(s string) time.Time {
+		t, err := time.ParseInLocation("2006-01-02 15:04", s, time.Local)
+		if err != nil {
+			panic(err)
+		}
+		return t
+	}
+	tests := []struct {
+		name   string
+		plan   RecordPlan
+		t      time.Time
+		active bool
+	}{
+		{"disabled", RecordPlan{}, at("2024-10-07 10:00"), false},
+		{"all day", RecordPlan{Enable: true}, at("2024-10-07 10:00"), true},
+		{"inside window", RecordPlan{Enable: true, Windows: "08:00-12:00"}, at("2024-10-07 08:00"), true},
+		{"window end excluded", RecordPlan{Enable: true, Windows: "08:00-12:00"}, at("2024-10-07 12:00"), false},
+		{"second window", RecordPlan{Enable: true, Windows: "08:00-12:00,14:00-18:00"}, at("2024-10-07 15:30"), true},
+		{"between windows", RecordPlan{Enable: true, Windows: "08:00-12:00,14:00-18:00"}, at("2024-10-07 13:00"), false},
+		{"across midnight before", RecordPlan{Enable: true, Windows: "22:00-06:00"}, at("2024-10-07 23:59"), true},
+		{"across midnight after", RecordPlan{Enable: true, Windows: "22:00-06:00"}, at("2024-10-07 05:59"), true},
+		{"across midnight outside", RecordPlan{Enable: true, Windows: "22:00-06:00"}, at("2024-10-07 06:00"), false},
+		{"until end of day", RecordPlan{Enable: true, Windows: "18:00-00:00"}, at("2024-10-07 23:59"), true},
+		{"invalid window ignored", RecordPlan{Enable: true, Windows: "bad,08:00-12:00"}, at("2024-10-07 09:00"), true},
+		{"weekday", RecordPlan{Enable: true, Weekdays: "1,2,3,4,5"}, at("2024-10-07 10:00"), true},
+		{"weekend", RecordPlan{Enable: true, Weekdays: "1,2,3,4,5"}, at("2024-10-06 10:00"), false},
+		{"sunday", RecordPlan{Enable: true, Weekdays: "0, 6"}, at("2024-10-06 10:00"), true},
+		{"excluded date", RecordPlan{Enable: true, ExcludeDates: "2024-10-01,2024-10-07"}, at("2024-10-07 10:00"), false},
+		{"other date", RecordPlan{Enable: true, ExcludeDates: "2024-10-01, 2024-10-02"}, at("2024-10-07 10:00"), true},
+		{"all conditions", RecordPlan{Enable: true, Windows: "08:00-12:00", Weekdays: "1", ExcludeDates: "2024-10-01"}, at("2024-10-07 11:00"), true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if active := tt.plan.activeAt(tt.t); active != tt.active {
+				t.Errorf("activeAt(%s) = %v, want %v", tt.t.Format("2006-01-02 15:04"), active, tt.active)
+			}
+		})
+	}
+}
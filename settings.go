@@ -0,0 +1,327 @@
+package record
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+
+	"go.uber.org/zap"
+	"m7s.live/engine/v4/config"
+	"m7s.live/engine/v4/util"
+)
+
+// 运行时可以修改的录制配置
+type RecordSettings struct {
+	Type                 string         `json:"type"`
+	Path                 string         `json:"path"`
+	AutoRecord           bool           `json:"autoRecord"`
+	Filter               string         `json:"filter"`
+	Fragment             string         `json:"fragment"` // 例如10m，空表示不分片
+	Tracks               string         `json:"tracks"`
+	DropUnsupportedAudio bool           `json:"dropUnsupportedAudio"`
+	Rules                []ruleSettings `json:"rules"`
+}
+
+// 录制规则的json格式，时长使用字符串
+type ruleSettings struct {
+	Filter               string `json:"filter"`
+	Fragment             string `json:"fragment"`
+	Path                 string `json:"path"`
+	Naming               string `json:"naming"`
+	ExpireDays           int    `json:"expireDays"`
+	Tracks               string `json:"tracks"`
+	DropUnsupportedAudio *bool  `json:"dropUnsupportedAudio"`
+}
+
+var (
+	settingsLock     sync.Mutex   // 串行执行修改配置的API
+	recordConfigLock sync.RWMutex // 替换配置时加写锁，读取配置时加读锁
+	defaultRecords   = map[string]Record{}
+)
+
+func durationString(d time.Duration) string {
+	if d == 0 {
+		return ""
+	}
+	return d.String()
+}
+
+func parseFragment(fragment string) (d time.Duration, err error) {
+	if fragment == "" {
+		return
+	}
+	if d, err = time.ParseDuration(fragment); err == nil && d < 0 {
+		err = fmt.Errorf("fragment %q is negative", fragment)
+	}
+	return
+}
+
+// 当前生效的配置
+func (r *Record) settings(t string) *RecordSettings {
+	s := &RecordSettings{
+		Type:                 t,
+		Path:                 r.Path,
+		AutoRecord:           r.AutoRecord,
+		Fragment:             durationString(r.Fragment),
+		Tracks:               r.Tracks,
+		DropUnsupportedAudio: r.DropUnsupportedAudio,
+	}
+	if r.Filter.Valid() {
+		s.Filter = r.Filter.String()
+	}
+	for _, rule := range r.Rules {
+		s.Rules = append(s.Rules, ruleSettings{
+			Filter:               rule.Filter,
+			Fragment:             durationString(rule.Fragment),
+			Path:                 rule.Path,
+			Naming:               rule.Naming,
+			ExpireDays:           rule.ExpireDays,
+			Tracks:               rule.Tracks,
+			DropUnsupportedAudio: rule.DropUnsupportedAudio,
+		})
+	}
+	return s
+}
+
+// 路径不能包含..，可以是绝对路径，例如把录像放到另一块硬盘上
+func checkSettingsPath(p string) error {
+	for _, elem := range strings.FieldsFunc(p, func(c rune) bool { return c == '/' || c == '\\' }) {
+		if elem == ".." {
+			return fmt.Errorf("path %q must not contain ..", p)
+		}
+	}
+	return nil
+}
+
+// 保存配置前确认目录可以创建和写入，否则之后的录像都会失败
+func checkSettingsDir(dir string) error {
+	if err := os.MkdirAll(dir, 0766); err != nil {
+		return err
+	}
+	file, err := os.CreateTemp(dir, ".record_settings_*")
+	if err != nil {
+		return err
+	}
+	file.Close()
+	return os.Remove(file.Name())
+}
+
+// 校验并基于当前配置生成新的录制配置，不修改当前生效的配置
+func (conf *RecordConfig) buildSettings(s *RecordSettings) (record *Record, err error) {
+	if record = conf.getRecorderConfigByType(s.Type); record == nil {
+		return nil, fmt.Errorf("type %q not supported", s.Type)
+	}
+	if s.Path == "" {
+		return nil, fmt.Errorf("path is empty")
+	}
+	if err = checkSettingsPath(s.Path); err != nil {
+		return nil, err
+	}
+	var filter *regexp.Regexp
+	if s.Filter != "" {
+		if filter, err = regexp.Compile(s.Filter); err != nil {
+			return nil, err
+		}
+	}
+	fragment, err := parseFragment(s.Fragment)
+	if err != nil {
+		return nil, err
+	}
+	var rules []RecordRule
+	for _, rs := range s.Rules {
+		if err = checkSettingsPath(rs.Path); err != nil {
+			return nil, err
+		}
+		rule := RecordRule{Filter: rs.Filter, Path: rs.Path, Naming: rs.Naming, ExpireDays: rs.ExpireDays, Tracks: rs.Tracks, DropUnsupportedAudio: rs.DropUnsupportedAudio}
+		if rule.Fragment, err = parseFragment(rs.Fragment); err != nil {
+			return nil, err
+		}
+		if err = rule.init(); err != nil {
+			return nil, err
+		}
+		rules = append(rules, rule)
+	}
+	record.Path = s.Path
+	record.AutoRecord = s.AutoRecord
+	record.Filter = config.Regexp{Regexp: filter}
+	record.Fragment = fragment
+	record.Tracks = s.Tracks
+	record.DropUnsupportedAudio = s.DropUnsupportedAudio
+	record.Rules = rules
+	return
+}
+
+// 替换生效的配置，正在录制的流继续使用旧配置的副本
+func (conf *RecordConfig) swapSettings(t string, record *Record) {
+	recordConfigLock.Lock()
+	*conf.recordConfigRef(t) = *record
+	recordConfigLock.Unlock()
+}
+
+// 加载通过API修改过的配置，需要在Record.Init之前调用
+// first表示第一次加载配置，此时保存配置文件中的值用于重置，重新加载配置时不能覆盖
+func (conf *RecordConfig) loadSettings(first bool) {
+	if first {
+		for _, t := range recordTypes {
+			record := *conf.recordConfigRef(t)
+			record.Rules = append([]RecordRule(nil), record.Rules...)
+			defaultRecords[t] = record
+		}
+	}
+	var settings []RecordSetting
+	db.Find(&settings)
+	for _, setting := range settings {
+		var s RecordSettings
+		var record *Record
+		err := json.Unmarshal([]byte(setting.Settings), &s)
+		if err == nil {
+			s.Type = setting.Type
+			record, err = conf.buildSettings(&s)
+		}
+		if err != nil {
+			plugin.Error("load record settings", zap.String("type", setting.Type), zap.Error(err))
+			continue
+		}
+		conf.swapSettings(s.Type, record)
+	}
+}
+
+func saveSettings(s *RecordSettings) error {
+	data, err := json.Marshal(s)
+	if err != nil {
+		return err
+	}
+	db.Where("type = ?", s.Type).Delete(&RecordSetting{})
+	return db.Omit("id").Create(&RecordSetting{
+		Type:       s.Type,
+		Settings:   string(data),
+		UpdateTime: time.Now().Format("2006-01-02 15:04:05"),
+	}).Error
+}
+
+// 用新的配置重新启动该类型正在录制的流，事件录像不重启
+func (conf *RecordConfig) restartRecorders(t string) {
+	conf.recordings.Range(func(key, value any) bool {
+		old := value.(IRecorder)
+		if recorderType(old) != t {
+			return true
+		}
+		if flv, ok := old.(*FLVRecorder); ok && flv.RecordMode == EventMode {
+			return true
+		}
+		go conf.restartRecorder(t, old)
+		return true
+	})
+}
+
+func (conf *RecordConfig) restartRecorder(t string, old IRecorder) {
+	o := old.GetRecorder()
+	id, streamPath, fileName := o.ID, o.Stream.Path, o.FileName
+	o.closing = true
+	old.Stop(zap.String("reason", "config changed"))
+	// 等待旧的录像退出，否则id冲突
+	for i := 0; i < 50; i++ {
+		if _, ok := conf.recordings.Load(id); !ok {
+			break
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+	irecorder := newRecorderByType(t)
+	if o.rule != nil {
+		if rule, ok := conf.getRecorderConfigByType(t).MatchRule(streamPath); ok && rule != nil {
+			irecorder.GetRecorder().applyRule(rule)
+		}
+	}
+	irecorder.GetRecorder().FileName = fileName
+	var err error
+	if fileName != "" {
+		err = irecorder.StartWithFileName(streamPath, fileName)
+	} else {
+		err = irecorder.Start(streamPath)
+	}
+	if err != nil {
+		plugin.Error("restart recorder", zap.String("id", id), zap.Error(err))
+	} else {
+		plugin.Info("restart recorder", zap.String("id", id))
+	}
+}
+
+// 查询录制配置，不指定type时返回所有类型
+func (conf *RecordConfig) API_config_get(w http.ResponseWriter, r *http.Request) {
+	if t := r.URL.Query().Get("type"); t != "" {
+		record := conf.getRecorderConfigByType(t)
+		if record == nil {
+			util.ReturnError(util.APIErrorNotFound, "type not supported", w, r)
+			return
+		}
+		util.ReturnValue(record.settings(t), w, r)
+		return
+	}
+	util.ReturnFetchValue(func() (settings []*RecordSettings) {
+		for _, t := range recordTypes {
+			settings = append(settings, conf.getRecorderConfigByType(t).settings(t))
+		}
+		return
+	}, w, r)
+}
+
+// 修改录制配置，请求体为RecordSettings的json，对之后启动的录像生效，restart=1时重启正在录制的流
+func (conf *RecordConfig) API_config_update(w http.ResponseWriter, r *http.Request) {
+	var s RecordSettings
+	if err := json.NewDecoder(r.Body).Decode(&s); err != nil {
+		util.ReturnError(util.APIErrorDecode, err.Error(), w, r)
+		return
+	}
+	settingsLock.Lock()
+	defer settingsLock.Unlock()
+	record, err := conf.buildSettings(&s)
+	if err != nil {
+		util.ReturnError(util.APIErrorDecode, err.Error(), w, r)
+		return
+	}
+	if err = checkSettingsDir(record.Path); err != nil {
+		util.ReturnError(util.APIErrorDecode, err.Error(), w, r)
+		return
+	}
+	if err = saveSettings(&s); err != nil {
+		util.ReturnError(util.APIErrorInternal, err.Error(), w, r)
+		return
+	}
+	record.Init()
+	conf.swapSettings(s.Type, record)
+	plugin.Info("record settings changed", zap.String("type", s.Type))
+	if r.URL.Query().Get("restart") != "" {
+		conf.restartRecorders(s.Type)
+	}
+	util.ReturnValue(record.settings(s.Type), w, r)
+}
+
+// 删除通过API修改的配置并立即恢复使用配置文件中的值，对之后启动的录像生效，restart=1时重启正在录制的流
+func (conf *RecordConfig) API_config_reset(w http.ResponseWriter, r *http.Request) {
+	t := r.URL.Query().Get("type")
+	record, ok := defaultRecords[t]
+	if !ok {
+		util.ReturnError(util.APIErrorNotFound, "type not supported", w, r)
+		return
+	}
+	settingsLock.Lock()
+	defer settingsLock.Unlock()
+	if err := db.Where("type = ?", t).Delete(&RecordSetting{}).Error; err != nil {
+		util.ReturnError(util.APIErrorInternal, err.Error(), w, r)
+		return
+	}
+	// 规则在Init中会被修改，不能和保存的默认值共用
+	record.Rules = append([]RecordRule(nil), record.Rules...)
+	record.Init()
+	conf.swapSettings(t, &record)
+	plugin.Info("record settings reset", zap.String("type", t))
+	if r.URL.Query().Get("restart") != "" {
+		conf.restartRecorders(t)
+	}
+	util.ReturnValue(record.settings(t), w, r)
+}
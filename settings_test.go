@@ -0,0 +1,28 @@
+package record
+
+import "testing"
+
+func TestCheckSettingsPath(t *testing.T) {
+	tests := []struct {
+		path string
+		ok   bool
+	}{
+		{"record/flv", true},
+		{"cam", true},
+		{"", true},
+		{"/data/record", true},
+		{`D:\record\flv`, true},
+		{"record/..flv", true},
+		{"..", false},
+		{"../record", false},
+		{"record/../../etc", false},
+		{"/data/../etc", false},
+		{`record\..\..\etc`, false},
+		{"record/flv/..", false},
+	}
+	for _, tt := range tests {
+		if err := checkSettingsPath(tt.path); (err == nil) != tt.ok {
+			t.Errorf("checkSettingsPath(%q) = %v, want ok %v", tt.path, err, tt.ok)
+		}
+	}
+}
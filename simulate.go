@@ -0,0 +1,152 @@
+package record
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"go.uber.org/zap"
+	"m7s.live/engine/v4/util"
+)
+
+var ErrSimulationExist = errors.New("simulation exist")
+
+// 循环发布录像文件来模拟摄像头
+type SimulateCamera struct {
+	StreamPath string   `json:"streamPath" desc:"发布的流路径"`
+	Type       string   `json:"type" desc:"录像类型，flv或mp4，默认flv"`
+	Files      []string `json:"files" desc:"录像文件，录像目录下的相对路径"`
+	Speed      float64  `json:"speed" desc:"倍速，默认1"`
+}
+
+type Simulation struct {
+	SimulateCamera
+	Publisher *FilePublisher `json:"publisher"`
+	Restarts  int            `json:"restarts"` // 发布意外结束后重新发布的次数
+	stopCh    chan struct{}
+	stopOnce  sync.Once
+	mu        sync.Mutex // 保护Publisher和Restarts，run中修改时列表API同时在读取
+}
+
+// 发布意外结束(例如被踢掉)后等待一段时间重新发布，直到调用stop
+func (s *Simulation) run() {
+	defer RecordPluginConfig.simulations.Delete(s.StreamPath)
+	for {
+		recorder := RecordPluginConfig.getRecorderConfigByType(s.Type)
+		var files []string
+		for _, file := range s.Files {
+			files = append(files, filepath.Join(recorder.Path, filepath.Clean("/"+file)))
+		}
+		publisher := NewFilePublisher(files...)
+		publisher.Loop = true
+		if s.Speed > 0 {
+			publisher.Speed = s.Speed
+		}
+		if err := publisher.Start(s.StreamPath); err != nil {
+			plugin.Error("simulate camera", zap.String("streamPath", s.StreamPath), zap.Error(err))
+		} else {
+			s.mu.Lock()
+			s.Publisher = publisher
+			s.mu.Unlock()
+			select {
+			case <-publisher.Done():
+			case <-s.stopCh:
+				publisher.Stop(zap.String("reason", "simulation stop"))
+				return
+			}
+			s.mu.Lock()
+			s.Restarts++
+			s.mu.Unlock()
+		}
+		select {
+		case <-time.After(5 * time.Second):
+		case <-s.stopCh:
+			return
+		}
+	}
+}
+
+// 可以重复调用，只有第一次生效
+func (s *Simulation) Stop() {
+	s.stopOnce.Do(func() {
+		close(s.stopCh)
+	})
+}
+
+// 列表API返回的副本
+type simulationInfo struct {
+	SimulateCamera
+	Publisher *FilePublisher `json:"publisher"`
+	Restarts  int            `json:"restarts"`
+}
+
+func (s *Simulation) info() simulationInfo {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return simulationInfo{SimulateCamera: s.SimulateCamera, Publisher: s.Publisher, Restarts: s.Restarts}
+}
+
+func (conf *RecordConfig) startSimulation(camera SimulateCamera) (err error) {
+	if camera.Type == "" {
+		camera.Type = "flv"
+	}
+	if camera.StreamPath == "" {
+		return errors.New("no streamPath")
+	}
+	if camera.Type != "flv" && camera.Type != "mp4" {
+		return errors.New("type not supported")
+	}
+	if len(camera.Files) == 0 {
+		return ErrNoRecordFile
+	}
+	// 文件不存在时循环发布不会有任何帧，直接返回错误
+	recorder := conf.getRecorderConfigByType(camera.Type)
+	for _, file := range camera.Files {
+		if _, err = os.Stat(filepath.Join(recorder.Path, filepath.Clean("/"+file))); err != nil {
+			return
+		}
+	}
+	s := &Simulation{SimulateCamera: camera, stopCh: make(chan struct{})}
+	if _, loaded := conf.simulations.LoadOrStore(camera.StreamPath, s); loaded {
+		return ErrSimulationExist
+	}
+	go s.run()
+	return
+}
+
+func (conf *RecordConfig) API_simulate_list(w http.ResponseWriter, r *http.Request) {
+	util.ReturnFetchValue(func() (simulations []any) {
+		conf.simulations.Range(func(key, value any) bool {
+			simulations = append(simulations, value.(*Simulation).info())
+			return true
+		})
+		return
+	}, w, r)
+}
+
+// 开始模拟摄像头，请求体为SimulateCamera的json
+func (conf *RecordConfig) API_simulate_start(w http.ResponseWriter, r *http.Request) {
+	var camera SimulateCamera
+	if err := json.NewDecoder(r.Body).Decode(&camera); err != nil {
+		util.ReturnError(util.APIErrorDecode, err.Error(), w, r)
+		return
+	}
+	if err := conf.startSimulation(camera); err != nil {
+		util.ReturnError(util.APIErrorInternal, err.Error(), w, r)
+		return
+	}
+	util.ReturnOK(w, r)
+}
+
+func (conf *RecordConfig) API_simulate_stop(w http.ResponseWriter, r *http.Request) {
+	if s, ok := conf.simulations.Load(r.URL.Query().Get("streamPath")); ok {
+		s.(*Simulation).Stop()
+		util.ReturnOK(w, r)
+		return
+	}
+	util.ReturnError(util.APIErrorNotFound, "no such simulation", w, r)
+}
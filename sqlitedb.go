@@ -16,6 +16,12 @@ func initSqliteDB(sqliteDbPath string) *gorm.DB {
 	err = sqlitedb.AutoMigrate(&FLVKeyframe{})
 	err = sqlitedb.AutoMigrate(&EventRecord{})
 	err = sqlitedb.AutoMigrate(&Exception{})
+	err = sqlitedb.AutoMigrate(&ExportJob{})
+	err = sqlitedb.AutoMigrate(&Discontinuity{})
+	err = sqlitedb.AutoMigrate(&ActiveRecording{})
+	err = sqlitedb.AutoMigrate(&RecordPlan{})
+	err = sqlitedb.AutoMigrate(&RecordSetting{})
+	err = sqlitedb.AutoMigrate(&HLSKey{})
 	if err != nil {
 		log.Fatal(err)
 	}
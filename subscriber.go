@@ -9,6 +9,7 @@ import (
 
 	"go.uber.org/zap"
 	. "m7s.live/engine/v4"
+	"m7s.live/engine/v4/track"
 )
 
 // 录像类型
@@ -20,6 +21,18 @@ const (
 	EventMode                      // 1，表示事件录像
 )
 
+// 录像id中使用的模式名称
+func recordModeString(mode RecordMode) string {
+	switch mode {
+	case EventMode:
+		return "eventmode"
+	case OrdinaryMode:
+		return "ordinarymode"
+	default:
+		return ""
+	}
+}
+
 // 判断是否有写入帧，用于解决pullonstart时拉取的流为空的情况下，生成空文件的问题
 var isWrifeFrame = false
 
@@ -38,12 +51,17 @@ type IRecorder interface {
 
 type Recorder struct {
 	Subscriber
-	SkipTS   uint32
-	Record   `json:"-" yaml:"-"`
-	File     FileWr `json:"-" yaml:"-"`
-	FileName string // 自定义文件名，分段录像无效
-	filePath string // 文件路径
-	append   bool   // 是否追加模式
+	SkipTS       uint32
+	Record       `json:"-" yaml:"-"`
+	File         FileWr      `json:"-" yaml:"-"`
+	FileName     string      // 自定义文件名，分段录像无效
+	filePath     string      // 文件路径
+	append       bool        // 是否追加模式
+	frameTs      uint32      // 当前帧修正后的时间戳
+	timeline     timeline    // 视频和音频的时间轴
+	splitPending bool        // 检测到时间戳不连续，等待下一个关键帧切分文件
+	closing      bool        // 主动停止，不等待重新推流
+	rule         *RecordRule // 自动录制匹配的规则
 }
 
 func (r *Recorder) GetRecorder() *Recorder {
@@ -83,10 +101,15 @@ func (r *Recorder) getFileName(streamPath string) (filename string) {
 	if RecordPluginConfig.RecordPathNotShowStreamPath {
 		filename = streamPath
 	}
+	if r.rule != nil {
+		filename = filepath.Join(r.rule.Path, filename)
+	}
 	if r.Fragment == 0 {
 		if r.FileName != "" {
 			filename = filepath.Join(filename, r.FileName)
 		}
+	} else if r.rule != nil {
+		filename = filepath.Join(filename, r.rule.fragmentName(streamPath))
 	} else {
 		filename = filepath.Join(filename, transform(streamPath)+"_"+time.Now().Format("2006-01-02-15-04-05"))
 	}
@@ -99,7 +122,7 @@ func (r *Recorder) start(re IRecorder, streamPath string, subType byte) (err err
 		if _, loaded := RecordPluginConfig.recordings.LoadOrStore(r.ID, re); loaded {
 			return ErrRecordExist
 		}
-		r.Closer = re
+		r.Closer = &graceCloser{re}
 		go func() {
 			r.PlayBlock(subType)
 			RecordPluginConfig.recordings.Delete(r.ID)
@@ -109,8 +132,9 @@ func (r *Recorder) start(re IRecorder, streamPath string, subType byte) (err err
 }
 
 func (r *Recorder) cut(absTime uint32) {
-	if ts := absTime - r.SkipTS; (time.Duration(ts)*time.Millisecond <= r.Fragment && r.Fragment-time.Duration(ts)*time.Millisecond <= time.Second) || time.Duration(ts)*time.Millisecond >= r.Fragment {
+	if ts := absTime - r.SkipTS; r.splitPending || (time.Duration(ts)*time.Millisecond <= r.Fragment && r.Fragment-time.Duration(ts)*time.Millisecond <= time.Second) || time.Duration(ts)*time.Millisecond >= r.Fragment {
 		r.SkipTS = absTime
+		r.splitPending = false
 		r.Close()
 		if file, err := r.Spesific.(IRecorder).CreateFile(); err == nil {
 			r.File = file
@@ -129,19 +153,29 @@ func (r *Recorder) cut(absTime uint32) {
 func (r *Recorder) OnEvent(event any) {
 	switch v := event.(type) {
 	case IRecorder:
+		// 断流重连后继续写入原来的文件
+		if r.File != nil {
+			return
+		}
 		if file, err := r.Spesific.(IRecorder).CreateFile(); err == nil {
 			r.File = file
 			r.Spesific.OnEvent(file)
 		} else {
 			r.Stop(zap.Error(err))
 		}
+	case *track.Video, *track.Audio:
+		if r.acceptTrack(v) {
+			r.Subscriber.OnEvent(event)
+		}
 	case AudioFrame:
+		r.frameTs = r.fixTimestamp(1, v.AbsTime)
 		// 纯音频流的情况下需要切割文件
 		if r.Fragment > 0 && r.VideoReader == nil {
-			r.cut(v.AbsTime)
+			r.cut(r.frameTs)
 		}
 	case VideoFrame:
 		isWrifeFrame = true
+		r.frameTs = r.fixTimestamp(0, v.AbsTime)
 		if v.IFrame {
 			//plugin.Error("this is keyframe and absTime is " + strconv.FormatUint(uint64(v.AbsTime), 10))
 			//go func() { //将视频关键帧的数据存入sqlite数据库中
@@ -154,7 +188,7 @@ func (r *Recorder) OnEvent(event any) {
 			//r.Info("这是关键帧，且取到了r.Offset是" + r.Stream.Path)
 		}
 		if r.Fragment > 0 && v.IFrame {
-			r.cut(v.AbsTime)
+			r.cut(r.frameTs)
 		}
 	default:
 		r.Subscriber.OnEvent(event)
@@ -0,0 +1,127 @@
+package record
+
+import (
+	"net/http"
+	"strings"
+	"time"
+
+	"go.uber.org/zap"
+	"m7s.live/engine/v4/util"
+)
+
+// 时间戳不连续时的处理方式
+const (
+	DiscontinuityRebase = "rebase" // 重写时间戳，保持时间轴连续
+	DiscontinuitySplit  = "split"  // 在下一个关键帧切分新文件，切分前的帧仍然重写时间戳
+)
+
+// 不连续处前后两帧的间隔(毫秒)，按25fps估算
+const discontinuityGap = 40
+
+// 单个轨道的时间轴，检测时间戳的跳跃和回退
+type trackTimeline struct {
+	init   bool
+	raw    uint32 // 上一帧的原始时间戳
+	last   uint32 // 上一帧修正后的时间戳
+	offset int64  // 该轨道正在使用的修正量
+	epoch  int    // offset对应的共用修正量版本
+}
+
+// 音视频共用一个修正量，否则各自接着自己的上一帧修正会导致音画不同步
+// 先检测到不连续的轨道计算新的修正量，另一个轨道随后检测到时沿用
+type timeline struct {
+	tracks [2]trackTimeline
+	offset int64
+	epoch  int
+}
+
+// 返回修正后的时间戳，前后跳跃都超过threshold才视为不连续，B帧和音频的小幅回退不算
+// jump不为0表示检测到不连续，为原始时间戳的跳跃量(毫秒)，负数表示回退
+func (tl *timeline) fix(track int, raw uint32, threshold uint32) (ts uint32, jump int64) {
+	t := &tl.tracks[track]
+	if t.init {
+		if jump = int64(raw) - int64(t.raw); jump < -int64(threshold) || jump > int64(threshold) {
+			last := int64(tl.tracks[0].last)
+			if other := int64(tl.tracks[1].last); other > last {
+				last = other
+			}
+			// 另一个轨道已经因为同一次不连续更新了修正量，修正后与已写入的帧接近时直接沿用
+			if fixed := int64(raw) + tl.offset; t.epoch == tl.epoch || fixed < last-int64(threshold) || fixed > last+int64(threshold) {
+				// 接着两个轨道中最后写入的帧继续
+				tl.offset = last + discontinuityGap - int64(raw)
+				tl.epoch++
+			}
+			t.offset, t.epoch = tl.offset, tl.epoch
+		} else {
+			jump = 0
+		}
+	}
+	t.init = true
+	t.raw = raw
+	if fixed := int64(raw) + t.offset; fixed > 0 {
+		t.last = uint32(fixed)
+	} else {
+		t.last = 0
+	}
+	return t.last, jump
+}
+
+// 检测时间戳是否连续，未配置Discontinuity时原样返回，配置了断流等待时默认rebase
+// track为0表示视频，1表示音频
+func (r *Recorder) fixTimestamp(track int, absTime uint32) uint32 {
+	action := r.Discontinuity
+	if action == "" && r.ReconnectGrace > 0 {
+		action = DiscontinuityRebase
+	}
+	if action == "" {
+		return absTime
+	}
+	lastRaw := r.timeline.tracks[track].raw
+	ts, jump := r.timeline.fix(track, absTime, uint32(r.DiscontinuityThreshold.Milliseconds()))
+	if jump == 0 {
+		return ts
+	}
+	// 不分片时文件名是固定的，无法切分
+	if action == DiscontinuitySplit && r.Fragment == 0 {
+		action = DiscontinuityRebase
+	}
+	if action == DiscontinuitySplit {
+		r.splitPending = true
+	}
+	trackName := "video"
+	if track == 1 {
+		trackName = "audio"
+	}
+	r.Warn("timestamp discontinuity", zap.String("track", trackName), zap.Uint32("last", lastRaw), zap.Uint32("current", absTime), zap.Int64("jump", jump), zap.String("action", action))
+	discontinuity := &Discontinuity{
+		StreamPath: r.Stream.Path,
+		Type:       strings.TrimPrefix(r.Ext, "."),
+		Filepath:   strings.ReplaceAll(r.filePath, "\\", "/"),
+		Track:      trackName,
+		LastTs:     lastRaw,
+		Ts:         absTime,
+		Jump:       jump,
+		Action:     action,
+		CreateTime: time.Now().Format("2006-01-02 15:04:05"),
+	}
+	go db.Create(discontinuity)
+	return ts
+}
+
+// 新文件的时间戳重新从0开始时需要重置时间轴
+func (r *Recorder) resetTimeline() {
+	r.timeline = timeline{}
+	r.splitPending = false
+}
+
+// 查询时间戳不连续的记录，可以用streamPath过滤
+func (conf *RecordConfig) API_discontinuity_list(w http.ResponseWriter, r *http.Request) {
+	util.ReturnFetchValue(func() (discontinuities []Discontinuity) {
+		query := db.Order("id DESC")
+		if streamPath := r.URL.Query().Get("streamPath"); streamPath != "" {
+			query = query.Where("stream_path = ?", streamPath)
+		}
+		query.Limit(100).Find(&discontinuities)
+		return
+	}, w, r)
+}
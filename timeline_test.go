@@ -0,0 +1,90 @@
+package record
+
+import "testing"
+
+func TestTimelineFix(t *testing.T) {
+	type frame struct {
+		track int
+		raw   uint32
+		ts    uint32
+		jump  int64
+	}
+	const threshold = 5000
+	tests := []struct {
+		name   string
+		frames []frame
+	}{
+		{
+			name: "continuous",
+			frames: []frame{
+				{0, 1000, 1000, 0},
+				{1, 1010, 1010, 0},
+				{0, 1040, 1040, 0},
+				{1, 1033, 1033, 0},
+			},
+		},
+		{
+			name: "jitter",
+			frames: []frame{
+				{0, 1000, 1000, 0},
+				{0, 999, 999, 0},
+				{1, 1020, 1020, 0},
+				{1, 1000, 1000, 0},
+				{0, 1040, 1040, 0},
+			},
+		},
+		{
+			name: "forward jump",
+			frames: []frame{
+				{0, 1000, 1000, 0},
+				{1, 1010, 1010, 0},
+				{0, 100000, 1050, 99000},
+				{0, 100040, 1090, 0},
+			},
+		},
+		{
+			name: "backward jump",
+			frames: []frame{
+				{0, 100000, 100000, 0},
+				{1, 100010, 100010, 0},
+				{0, 0, 100050, -100000},
+				{0, 40, 100090, 0},
+			},
+		},
+		{
+			name: "second track reuses epoch",
+			frames: []frame{
+				{0, 1000, 1000, 0},
+				{1, 1005, 1005, 0},
+				{0, 100000, 1045, 99000},
+				{1, 100005, 1050, 99000},
+				{0, 100040, 1085, 0},
+				{1, 100028, 1073, 0},
+			},
+		},
+		{
+			name: "stale epoch recomputed",
+			frames: []frame{
+				{0, 1000, 1000, 0},
+				{1, 1005, 1005, 0},
+				// 只有音频跳跃
+				{1, 200000, 1045, 198995},
+				{1, 200020, 1065, 0},
+				{0, 1040, 1040, 0},
+				// 视频很久之后才跳跃，不能沿用音频的修正量
+				{0, 500000, 1105, 498960},
+			},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var tl timeline
+			for i, f := range tt.frames {
+				ts, jump := tl.fix(f.track, f.raw, threshold)
+				if ts != f.ts || jump != f.jump {
+					t.Fatalf("frame %d: got ts %d jump %d, want ts %d jump %d", i, ts, jump, f.ts, f.jump)
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,77 @@
+package record
+
+import (
+	"strings"
+
+	"go.uber.org/zap"
+	"m7s.live/engine/v4/codec"
+	"m7s.live/engine/v4/track"
+)
+
+// 各录像格式可以存储的音频编码，没有列出的格式不限制
+var supportedAudioCodecs = map[string][]codec.AudioCodecID{
+	"flv":  {codec.CodecID_AAC, codec.CodecID_PCMA, codec.CodecID_PCMU},
+	"mp4":  {codec.CodecID_AAC, codec.CodecID_PCMA, codec.CodecID_PCMU},
+	"fmp4": {codec.CodecID_AAC, codec.CodecID_PCMA, codec.CodecID_PCMU},
+	"hls":  {codec.CodecID_AAC},
+	"ts":   {codec.CodecID_AAC},
+	"mkv":  {codec.CodecID_AAC, codec.CodecID_PCMA, codec.CodecID_PCMU},
+	"ps":   {codec.CodecID_AAC, codec.CodecID_PCMA, codec.CodecID_PCMU},
+}
+
+func audioSupported(t string, codecID codec.AudioCodecID) bool {
+	codecs, ok := supportedAudioCodecs[t]
+	if !ok {
+		return true
+	}
+	for _, c := range codecs {
+		if c == codecID {
+			return true
+		}
+	}
+	return false
+}
+
+// 判断轨道是否在Tracks中，kind为video或audio，Tracks为空时录制所有轨道
+func (r *Recorder) selectTrack(kind, name string) bool {
+	if r.Tracks == "" {
+		return true
+	}
+	for _, t := range strings.Split(r.Tracks, ",") {
+		if t = strings.TrimSpace(t); t == kind || t == name {
+			return true
+		}
+	}
+	return false
+}
+
+// API指定的轨道选择，参数为空时使用配置
+func (r *Recorder) setTracks(tracks, dropAudio string) {
+	if tracks != "" {
+		r.Tracks = tracks
+	}
+	if dropAudio != "" {
+		r.DropUnsupportedAudio = dropAudio != "0"
+	}
+}
+
+// 是否录制该轨道
+func (r *Recorder) acceptTrack(t any) bool {
+	switch v := t.(type) {
+	case *track.Video:
+		if !r.selectTrack("video", v.GetName()) {
+			r.Info("skip track", zap.String("name", v.GetName()), zap.String("tracks", r.Tracks))
+			return false
+		}
+	case *track.Audio:
+		if !r.selectTrack("audio", v.GetName()) {
+			r.Info("skip track", zap.String("name", v.GetName()), zap.String("tracks", r.Tracks))
+			return false
+		}
+		if t := recorderType(r.Spesific.(IRecorder)); r.DropUnsupportedAudio && !audioSupported(t, v.CodecID) && !(t == "mkv" && mkvWebMCodec(v.GetName()) != "") {
+			r.Warn("drop unsupported audio", zap.String("name", v.GetName()), zap.Uint8("codec", uint8(v.CodecID)))
+			return false
+		}
+	}
+	return true
+}
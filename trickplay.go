@@ -0,0 +1,261 @@
+package record
+
+import (
+	"bufio"
+	"bytes"
+	"io"
+	"io/fs"
+	"net/http"
+	"os"
+	"path/filepath"
+	"time"
+
+	"go.uber.org/zap"
+	"m7s.live/engine/v4/codec"
+	"m7s.live/engine/v4/util"
+	"m7s.live/plugin/record/v4/recordfile"
+)
+
+// 关键帧在回放时间轴上的位置
+type keyframePosition struct {
+	filePath string
+	offset   int64  // 关键帧tag在文件中的偏移
+	time     uint32 // 关键帧在整个回放时间轴上的时间(毫秒)
+	seqHead  []byte // 关键帧所在文件的视频序列头tag
+}
+
+// 从onMetaData中取出关键帧索引，文件未写入metaData时(例如仍在录制中)则扫描整个文件生成索引
+func readFLVKeyframes(file io.ReadSeeker) (filepositions []uint64, times []float64, err error) {
+	if _, err = file.Seek(int64(len(codec.FLVHeader)), io.SeekStart); err != nil {
+		return
+	}
+	reader := bufio.NewReader(file)
+	tagHead := make(util.Buffer, 11)
+	offset := uint64(len(codec.FLVHeader))
+	for {
+		if _, err = io.ReadFull(reader, tagHead); err != nil {
+			break
+		}
+		tmp := tagHead
+		t := tmp.ReadByte()
+		dataLen := tmp.ReadUint24()
+		timestamp := tmp.ReadUint24() | uint32(tmp.ReadByte())<<24
+		data := make([]byte, dataLen+4)
+		if _, err = io.ReadFull(reader, data); err != nil {
+			break
+		}
+		switch t {
+		case codec.FLV_TAG_TYPE_SCRIPT:
+			if fp, ts := parseMetaDataKeyframes(data); len(fp) > 0 && len(fp) == len(ts) {
+				return fp, ts, nil
+			}
+		case codec.FLV_TAG_TYPE_VIDEO:
+			if dataLen > 1 && recordfile.IsFLVKeyFrame(data) && !recordfile.IsFLVVideoSequenceHead(data) {
+				filepositions = append(filepositions, offset)
+				times = append(times, float64(timestamp)/1000)
+			}
+		}
+		offset += uint64(11 + dataLen + 4)
+	}
+	if err == io.EOF || err == io.ErrUnexpectedEOF {
+		err = nil
+	}
+	return
+}
+
+// 解析onMetaData中的keyframes
+func parseMetaDataKeyframes(data []byte) (filepositions []uint64, times []float64) {
+	if len(data) < 1+2+len("onMetaData")+4 {
+		return
+	}
+	amf := &util.AMF{
+		Buffer: util.Buffer(data[1+2+len("onMetaData") : len(data)-4]),
+	}
+	obj, err := amf.Unmarshal()
+	if err != nil {
+		return
+	}
+	metaData, ok := obj.(map[string]any)
+	if !ok {
+		return
+	}
+	keyframes, ok := metaData["keyframes"].(map[string]any)
+	if !ok {
+		return
+	}
+	if fp, ok := keyframes["filepositions"].([]any); ok {
+		for _, v := range fp {
+			if f, ok := v.(float64); ok {
+				filepositions = append(filepositions, uint64(f))
+			}
+		}
+	}
+	if ts, ok := keyframes["times"].([]any); ok {
+		for _, v := range ts {
+			if f, ok := v.(float64); ok {
+				times = append(times, f)
+			}
+		}
+	}
+	return
+}
+
+// 读取文件中第一个视频序列头
+func readFLVVideoSequenceHead(file io.ReadSeeker) (tag []byte, err error) {
+	if _, err = file.Seek(int64(len(codec.FLVHeader)), io.SeekStart); err != nil {
+		return
+	}
+	reader := bufio.NewReader(file)
+	tagHead := make(util.Buffer, 11)
+	for {
+		if _, err = io.ReadFull(reader, tagHead); err != nil {
+			return
+		}
+		tmp := tagHead
+		t := tmp.ReadByte()
+		dataLen := tmp.ReadUint24()
+		data := make([]byte, dataLen+4)
+		if _, err = io.ReadFull(reader, data); err != nil {
+			return
+		}
+		if t == codec.FLV_TAG_TYPE_VIDEO && dataLen > 1 && recordfile.IsFLVVideoSequenceHead(data) {
+			return append(append([]byte{}, tagHead...), data...), nil
+		}
+	}
+}
+
+// 生成回放时间轴上的关键帧列表，offsetTime为第一个文件中需要跳过的时长
+func (conf *RecordConfig) buildKeyframePositions(dir string, fileList []fs.FileInfo, offsetTime, timeRange time.Duration) (positions []keyframePosition) {
+	var fileStart uint32 // 当前文件在回放时间轴上的起始时间
+	skip := uint32(offsetTime.Milliseconds())
+	for i, info := range fileList {
+		filePath := filepath.Join(dir, info.Name())
+		file, err := os.Open(filePath)
+		if err != nil {
+			plugin.Error("open file failed", zap.String("file", filePath), zap.Error(err))
+			continue
+		}
+		// 每个文件的序列头可能不同(例如分辨率变化)，单独保存
+		seqHead, _ := readFLVVideoSequenceHead(file)
+		filepositions, times, err := readFLVKeyframes(file)
+		// 文件时长取最后一个tag的时间戳，最后一个关键帧之后还有一段内容
+		duration := getFLVDuration(file)
+		file.Close()
+		if err != nil {
+			plugin.Error("read keyframes failed", zap.String("file", filePath), zap.Error(err))
+			continue
+		}
+		for j := range filepositions {
+			t := uint32(times[j] * 1000)
+			if t > duration {
+				duration = t
+			}
+			if i == 0 {
+				if t < skip {
+					continue
+				}
+				t -= skip
+			}
+			if t+fileStart > uint32(timeRange.Milliseconds()) {
+				return
+			}
+			positions = append(positions, keyframePosition{
+				filePath: filePath,
+				offset:   int64(filepositions[j]),
+				time:     t + fileStart,
+				seqHead:  seqHead,
+			})
+		}
+		// 与连续回放时一样，下一个文件紧接着当前文件的最后一帧
+		if i != 0 {
+			fileStart += duration + recordfile.FileJoinGap
+		} else if duration > skip {
+			fileStart += duration - skip + recordfile.FileJoinGap
+		}
+	}
+	return
+}
+
+// 只输出关键帧的快进、快退回放，时间戳按照倍速重写
+func (conf *RecordConfig) playFLVKeyframes(r *http.Request, writer io.Writer, positions []keyframePosition, speed float64, reverse bool) {
+	if speed <= 0 {
+		speed = 1
+	}
+	// 只有视频的flv头
+	_, err := writer.Write([]byte{'F', 'L', 'V', 0x01, 0x01, 0, 0, 0, 9, 0, 0, 0, 0})
+	if err != nil {
+		return
+	}
+	if len(positions) == 0 {
+		return
+	}
+	if reverse {
+		for i, j := 0, len(positions)-1; i < j; i, j = i+1, j-1 {
+			positions[i], positions[j] = positions[j], positions[i]
+		}
+	}
+	origin := positions[0].time
+	start := time.Now()
+	var file *os.File
+	defer func() {
+		if file != nil {
+			file.Close()
+		}
+	}()
+	tagHead := make(util.Buffer, 11)
+	var lastSeqHead []byte // 最后一次发送的序列头
+	for _, pos := range positions {
+		if r.Context().Err() != nil {
+			return
+		}
+		if file == nil || file.Name() != pos.filePath {
+			if file != nil {
+				file.Close()
+			}
+			if file, err = os.Open(pos.filePath); err != nil {
+				plugin.Error("open file failed", zap.String("file", pos.filePath), zap.Error(err))
+				return
+			}
+		}
+		if _, err = file.Seek(pos.offset, io.SeekStart); err != nil {
+			return
+		}
+		if _, err = io.ReadFull(file, tagHead); err != nil {
+			return
+		}
+		tmp := tagHead
+		if tmp.ReadByte() != codec.FLV_TAG_TYPE_VIDEO {
+			continue
+		}
+		dataLen := tmp.ReadUint24()
+		data := make([]byte, dataLen+4)
+		if _, err = io.ReadFull(file, data); err != nil {
+			return
+		}
+		var distance uint32
+		if reverse {
+			distance = origin - pos.time
+		} else {
+			distance = pos.time - origin
+		}
+		timestamp := uint32(float64(distance) / speed)
+		// 序列头与上一次发送的不同时重新发送，否则解码器无法解码后续关键帧
+		if pos.seqHead != nil && (lastSeqHead == nil || !bytes.Equal(pos.seqHead[11:], lastSeqHead[11:])) {
+			putFlvTimestamp(pos.seqHead, timestamp)
+			if _, err = writer.Write(pos.seqHead); err != nil {
+				return
+			}
+			lastSeqHead = pos.seqHead
+		}
+		putFlvTimestamp(tagHead, timestamp)
+		if _, err = writer.Write(tagHead); err != nil {
+			return
+		}
+		if _, err = writer.Write(data); err != nil {
+			return
+		}
+		if sleepTime := time.Duration(timestamp)*time.Millisecond - time.Since(start); sleepTime > 0 {
+			time.Sleep(sleepTime)
+		}
+	}
+}
@@ -0,0 +1,169 @@
+package record
+
+import (
+	"bytes"
+	"errors"
+	"time"
+
+	"go.uber.org/zap"
+	. "m7s.live/engine/v4"
+	"m7s.live/engine/v4/codec"
+	"m7s.live/engine/v4/codec/mpegts"
+	"m7s.live/engine/v4/util"
+)
+
+// 录制连续的ts文件，开启分片时在关键帧切分
+type TSRecorder struct {
+	Recorder
+	MemoryTs
+	video_cc, audio_cc byte
+	pat_cc, pmt_cc     byte   // 引擎生成的PAT和PMT的continuity_counter固定为0，重复写入时需要递增
+	needTables         bool   // 新文件还没有写入PAT和PMT
+	tsBase             uint32 // 文件中第一帧的frameTs，每个文件的时间戳从0开始
+	tsBaseSet          bool
+}
+
+func (r *TSRecorder) SetId(streamPath string) {
+	r.ID = streamPath + "/ts"
+}
+
+// ts录制只有普通录像
+func (r *TSRecorder) GetRecordModeString(mode RecordMode) string {
+	return recordModeString(mode)
+}
+
+// 定时停止的录像只支持flv
+func (r *TSRecorder) StartWithDynamicTimeout(streamPath, fileName string, timeout time.Duration) error {
+	return errors.ErrUnsupported
+}
+
+// 没有定时器，不需要处理
+func (r *TSRecorder) UpdateTimeout(timeout time.Duration) {
+}
+
+func NewTSRecorder() (r *TSRecorder) {
+	r = &TSRecorder{}
+	r.Record = *RecordPluginConfig.getRecorderConfigByType("ts")
+	return r
+}
+
+func (r *TSRecorder) Start(streamPath string) error {
+	r.ID = streamPath + "/ts"
+	return r.start(r, streamPath, SUBTYPE_RAW)
+}
+
+func (r *TSRecorder) StartWithFileName(streamPath string, fileName string) error {
+	r.ID = streamPath + "/ts/" + fileName
+	return r.start(r, streamPath, SUBTYPE_RAW)
+}
+
+func (r *TSRecorder) Close() (err error) {
+	if r.File != nil {
+		err = r.File.Close()
+	}
+	return
+}
+
+// 写入PAT和PMT，轨道在第一帧之前才能确定，所以在写帧时写入
+func (r *TSRecorder) writeTables() (err error) {
+	var tables bytes.Buffer
+	if err = mpegts.WriteDefaultPATPacket(&tables); err != nil {
+		return
+	}
+	var vcodec codec.VideoCodecID = 0
+	var acodec codec.AudioCodecID = 0
+	if r.Video != nil {
+		vcodec = r.Video.CodecID
+	}
+	if r.Audio != nil {
+		acodec = r.Audio.CodecID
+	}
+	mpegts.WritePMTPacket(&tables, vcodec, acodec)
+	data := tables.Bytes()
+	for i := 0; i+mpegts.TS_PACKET_SIZE <= len(data); i += mpegts.TS_PACKET_SIZE {
+		packet := data[i : i+mpegts.TS_PACKET_SIZE]
+		cc := &r.pmt_cc
+		if pid := uint16(packet[1]&0x1f)<<8 | uint16(packet[2]); pid == mpegts.PID_PAT {
+			cc = &r.pat_cc
+		}
+		packet[3] = packet[3]&0xf0 | *cc
+		*cc = (*cc + 1) & 0x0f
+	}
+	if _, err = r.File.Write(data); err != nil {
+		return
+	}
+	r.needTables = false
+	return
+}
+
+// PES使用修正后的frameTs，时间戳不连续时重写的时间轴才能生效，每个文件从0开始
+func (r *TSRecorder) rebase(pts, dts uint32) (uint32, uint32) {
+	if !r.tsBaseSet {
+		r.tsBase, r.tsBaseSet = r.frameTs, true
+	}
+	var newDTS uint32
+	if r.frameTs > r.tsBase {
+		newDTS = (r.frameTs - r.tsBase) * 90
+	}
+	return newDTS + pts - dts, newDTS
+}
+
+func (r *TSRecorder) OnEvent(event any) {
+	var err error
+	defer func() {
+		if err != nil {
+			r.Stop(zap.Error(err))
+		}
+	}()
+	switch v := event.(type) {
+	case *TSRecorder:
+		r.BytesPool = make(util.BytesPool, 17)
+		r.Recorder.OnEvent(event)
+	case FileWr:
+		r.needTables = true
+		r.tsBaseSet = false
+	case AudioFrame:
+		r.Recorder.OnEvent(event)
+		if r.needTables {
+			if err = r.writeTables(); err != nil {
+				return
+			}
+		}
+		v.PTS, v.DTS = r.rebase(v.PTS, v.DTS)
+		pes := &mpegts.MpegtsPESFrame{
+			Pid:                       mpegts.PID_AUDIO,
+			IsKeyFrame:                false,
+			ContinuityCounter:         r.audio_cc,
+			ProgramClockReferenceBase: uint64(v.DTS),
+		}
+		r.WriteAudioFrame(v, pes)
+		_, err = r.BLL.WriteTo(r.File)
+		r.Recycle()
+		r.Clear()
+		r.audio_cc = pes.ContinuityCounter
+	case VideoFrame:
+		r.Recorder.OnEvent(event)
+		// 每个关键帧前重复PAT和PMT，从文件中间开始读取也能解码
+		if r.needTables || v.IFrame {
+			if err = r.writeTables(); err != nil {
+				return
+			}
+		}
+		v.PTS, v.DTS = r.rebase(v.PTS, v.DTS)
+		pes := &mpegts.MpegtsPESFrame{
+			Pid:                       mpegts.PID_VIDEO,
+			IsKeyFrame:                v.IFrame,
+			ContinuityCounter:         r.video_cc,
+			ProgramClockReferenceBase: uint64(v.DTS),
+		}
+		if err = r.WriteVideoFrame(v, pes); err != nil {
+			return
+		}
+		_, err = r.BLL.WriteTo(r.File)
+		r.Recycle()
+		r.Clear()
+		r.video_cc = pes.ContinuityCounter
+	default:
+		r.Recorder.OnEvent(v)
+	}
+}
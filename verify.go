@@ -0,0 +1,44 @@
+package record
+
+import (
+	"net/http"
+	"path/filepath"
+	"strconv"
+
+	"m7s.live/engine/v4/util"
+	"m7s.live/plugin/record/v4/recordfile"
+)
+
+// 检查录像文件，file为录像目录下的相对路径，gap为判断时间戳跳跃的阈值(毫秒)，默认1000
+func (conf *RecordConfig) API_verify(w http.ResponseWriter, r *http.Request) {
+	query := r.URL.Query()
+	t := query.Get("type")
+	if t == "" {
+		t = "flv"
+	}
+	recorder := conf.getRecorderConfigByType(t)
+	if recorder == nil {
+		http.Error(w, "type not supported", http.StatusBadRequest)
+		return
+	}
+	fileName := query.Get("file")
+	if fileName == "" {
+		http.Error(w, "no file", http.StatusBadRequest)
+		return
+	}
+	gapThreshold := uint32(1000)
+	if gap, err := strconv.ParseUint(query.Get("gap"), 10, 32); err == nil {
+		gapThreshold = uint32(gap)
+	}
+	filePath := filepath.Join(recorder.Path, filepath.Clean("/"+fileName))
+	if !util.Exist(filePath) {
+		util.ReturnError(util.APIErrorNotFound, "no such file: "+fileName, w, r)
+		return
+	}
+	report, err := recordfile.VerifyFile(filePath, gapThreshold)
+	if err != nil {
+		util.ReturnError(util.APIErrorInternal, err.Error(), w, r)
+		return
+	}
+	util.ReturnValue(report, w, r)
+}
@@ -28,13 +28,31 @@ func ext(path string) string {
 func (conf *RecordConfig) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 	switch ext(r.URL.Path) {
 	case ".flv":
-		conf.Flv.ServeHTTP(w, r)
+		conf.getRecorderConfigByType("flv").ServeHTTP(w, r)
 	case ".mp4":
-		conf.Mp4.ServeHTTP(w, r)
-	case ".m3u8", ".ts":
-		conf.Hls.ServeHTTP(w, r)
+		// hls(CMAF)的初始化分片
+		if strings.HasSuffix(r.URL.Path, "_init.mp4") && util.Exist(filepath.Join(conf.getRecorderConfigByType("hls").Path, filepath.Clean("/"+r.URL.Path))) {
+			conf.getRecorderConfigByType("hls").ServeHTTP(w, r)
+		} else {
+			conf.getRecorderConfigByType("mp4").ServeHTTP(w, r)
+		}
+	case ".m3u8", ".m4s":
+		conf.getRecorderConfigByType("hls").ServeHTTP(w, r)
+	case ".ts":
+		// hls的分片和ts录像扩展名相同，优先查找ts录像
+		if util.Exist(filepath.Join(conf.getRecorderConfigByType("ts").Path, filepath.Clean("/"+r.URL.Path))) {
+			conf.getRecorderConfigByType("ts").ServeHTTP(w, r)
+		} else {
+			conf.getRecorderConfigByType("hls").ServeHTTP(w, r)
+		}
+	case ".mkv", ".webm":
+		conf.getRecorderConfigByType("mkv").ServeHTTP(w, r)
+	case ".ps":
+		conf.getRecorderConfigByType("ps").ServeHTTP(w, r)
+	case ".pcap":
+		conf.getRecorderConfigByType("rtp").ServeHTTP(w, r)
 	case ".h264", ".h265":
-		conf.Raw.ServeHTTP(w, r)
+		conf.getRecorderConfigByType("raw").ServeHTTP(w, r)
 	}
 }
 
@@ -45,9 +63,43 @@ func putFlvTimestamp(header []byte, timestamp uint32) {
 	header[7] = byte(timestamp >> 24)
 }
 
+// 按照文件修改时间查找startTime到endTime之间的flv文件，offsetTime为第一个文件中需要跳过的时长
+func findFLVFiles(dir string, startTime, endTime time.Time) (fileList []fs.FileInfo, offsetTime time.Duration, found bool) {
+	return findRecordFiles(dir, ".flv", startTime, endTime)
+}
+
+// 按照文件修改时间查找startTime到endTime之间扩展名为ext的录像文件
+func findRecordFiles(dir string, ext string, startTime, endTime time.Time) (fileList []fs.FileInfo, offsetTime time.Duration, found bool) {
+	filepath.Walk(dir, func(path string, info fs.FileInfo, err error) error {
+		if err != nil || info.IsDir() || !strings.HasSuffix(info.Name(), ext) {
+			return nil
+		}
+		modTime := info.ModTime()
+		//tmp, _ := strconv.Atoi(strings.TrimSuffix(info.Name(), ".flv"))
+		//fileStartTime := time.Unix(tmp, 10)
+		if !found {
+			if modTime.After(startTime) {
+				found = true
+				//fmt.Println(path, modTime, startTime, found)
+			} else {
+				fileList = []fs.FileInfo{info}
+				offsetTime = startTime.Sub(modTime)
+				//fmt.Println(path, modTime, startTime, found)
+				return nil
+			}
+		}
+		if modTime.After(endTime) {
+			return nil
+		}
+		fileList = append(fileList, info)
+		return nil
+	})
+	return
+}
+
 func (conf *RecordConfig) Play_flv_(w http.ResponseWriter, r *http.Request) {
 	streamPath := strings.TrimSuffix(strings.TrimPrefix(r.URL.Path, "/play/flv/"), ".flv")
-	singleFile := filepath.Join(conf.Flv.Path, streamPath+".flv")
+	singleFile := filepath.Join(conf.getRecorderConfigByType("flv").Path, streamPath+".flv")
 	query := r.URL.Query()
 	startTimeStr := query.Get("start")
 	endTimeStr := query.Get("end")
@@ -64,13 +116,11 @@ func (conf *RecordConfig) Play_flv_(w http.ResponseWriter, r *http.Request) {
 	if err != nil {
 		speed = 1
 	}
-	dir := filepath.Join(conf.Flv.Path, streamPath)
+	trick := query.Get("trick") // forward表示只播放关键帧快进，reverse表示只播放关键帧快退
+	dir := filepath.Join(conf.getRecorderConfigByType("flv").Path, streamPath)
 	if util.Exist(singleFile) {
 
 	} else if util.Exist(dir) {
-		var fileList []fs.FileInfo
-		var found bool
-		var offsetTime time.Duration
 		var offsetTimestamp uint32
 		var lastTimestamp uint32
 		var start = time.Now()
@@ -82,30 +132,7 @@ func (conf *RecordConfig) Play_flv_(w http.ResponseWriter, r *http.Request) {
 				time.Sleep(sleepTime)
 			}
 		}
-		err = filepath.Walk(dir, func(path string, info fs.FileInfo, err error) error {
-			if info.IsDir() || !strings.HasSuffix(info.Name(), ".flv") {
-				return nil
-			}
-			modTime := info.ModTime()
-			//tmp, _ := strconv.Atoi(strings.TrimSuffix(info.Name(), ".flv"))
-			//fileStartTime := time.Unix(tmp, 10)
-			if !found {
-				if modTime.After(startTime) {
-					found = true
-					//fmt.Println(path, modTime, startTime, found)
-				} else {
-					fileList = []fs.FileInfo{info}
-					offsetTime = startTime.Sub(modTime)
-					//fmt.Println(path, modTime, startTime, found)
-					return nil
-				}
-			}
-			if modTime.After(endTime) {
-				return nil
-			}
-			fileList = append(fileList, info)
-			return nil
-		})
+		fileList, offsetTime, found := findFLVFiles(dir, startTime, endTime)
 		if !found {
 			http.NotFound(w, r)
 			return
@@ -122,6 +149,12 @@ func (conf *RecordConfig) Play_flv_(w http.ResponseWriter, r *http.Request) {
 		} else {
 			w.(http.Flusher).Flush()
 		}
+		if trick == "forward" || trick == "reverse" {
+			positions := conf.buildKeyframePositions(dir, fileList, offsetTime, endTime.Sub(startTime))
+			plugin.Info("trick play", zap.String("stream", streamPath), zap.String("trick", trick), zap.Int("keyframes", len(positions)))
+			conf.playFLVKeyframes(r, writer, positions, speed, trick == "reverse")
+			return
+		}
 		flvHead := make([]byte, 9+4)
 		tagHead := make(util.Buffer, 11)
 		var init, seqAudioWritten, seqVideoWritten bool
@@ -224,7 +257,7 @@ func (conf *RecordConfig) Play_flv_(w http.ResponseWriter, r *http.Request) {
 
 func (conf *RecordConfig) Download_flv_(w http.ResponseWriter, r *http.Request) {
 	streamPath := strings.TrimSuffix(strings.TrimPrefix(r.URL.Path, "/download/flv/"), ".flv")
-	singleFile := filepath.Join(conf.Flv.Path, streamPath+".flv")
+	singleFile := filepath.Join(conf.getRecorderConfigByType("flv").Path, streamPath+".flv")
 	query := r.URL.Query()
 	//rangeStr := strings.Split(query.Get("range"), "-")
 	//s, err := strconv.Atoi(rangeStr[0])
@@ -245,7 +278,7 @@ func (conf *RecordConfig) Download_flv_(w http.ResponseWriter, r *http.Request)
 	//endTime := time.UnixMilli(int64(e))
 	timeRange := endTime.Sub(startTime)
 	plugin.Info("download", zap.String("stream", streamPath), zap.Time("start", startTime), zap.Time("end", endTime))
-	dir := filepath.Join(conf.Flv.Path, streamPath)
+	dir := filepath.Join(conf.getRecorderConfigByType("flv").Path, streamPath)
 	if util.Exist(singleFile) {
 
 	} else if util.Exist(dir) {
@@ -0,0 +1,166 @@
+package record
+
+import (
+	"bufio"
+	"crypto/sha1"
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+)
+
+const (
+	wsOpContinuation byte = 0x0
+	wsOpText         byte = 0x1
+	wsOpBinary       byte = 0x2
+	wsOpClose        byte = 0x8
+	wsOpPing         byte = 0x9
+	wsOpPong         byte = 0xA
+)
+
+const wsGUID = "258EAFA5-E914-47DA-95CA-C5AB0DC85B11"
+
+const (
+	wsMaxMessageSize            = 4096 // 控制消息都是很小的json，超过后断开连接
+	wsMaxControlPayload         = 125  // 协议规定控制帧的最大长度
+	wsCloseProtocolError uint16 = 1002
+	wsCloseMessageTooBig uint16 = 1009
+)
+
+var ErrNotWebSocket = errors.New("not websocket request")
+var ErrWSMessageTooBig = errors.New("websocket message too big")
+var ErrWSProtocol = errors.New("websocket protocol error")
+
+// 简单的websocket服务端连接，仅用于回放控制
+type wsConn struct {
+	net.Conn
+	reader *bufio.Reader
+	mu     sync.Mutex
+}
+
+func upgradeWebSocket(w http.ResponseWriter, r *http.Request) (*wsConn, error) {
+	if !strings.EqualFold(r.Header.Get("Upgrade"), "websocket") || r.Header.Get("Sec-WebSocket-Key") == "" {
+		http.Error(w, ErrNotWebSocket.Error(), http.StatusBadRequest)
+		return nil, ErrNotWebSocket
+	}
+	hijacker, ok := w.(http.Hijacker)
+	if !ok {
+		http.Error(w, "hijack not supported", http.StatusInternalServerError)
+		return nil, ErrNotWebSocket
+	}
+	conn, rw, err := hijacker.Hijack()
+	if err != nil {
+		return nil, err
+	}
+	h := sha1.New()
+	h.Write([]byte(r.Header.Get("Sec-WebSocket-Key") + wsGUID))
+	accept := base64.StdEncoding.EncodeToString(h.Sum(nil))
+	response := "HTTP/1.1 101 Switching Protocols\r\nUpgrade: websocket\r\nConnection: Upgrade\r\nSec-WebSocket-Accept: " + accept + "\r\n"
+	if protocol := r.Header.Get("Sec-WebSocket-Protocol"); protocol != "" {
+		response += "Sec-WebSocket-Protocol: " + strings.TrimSpace(strings.Split(protocol, ",")[0]) + "\r\n"
+	}
+	if _, err = conn.Write([]byte(response + "\r\n")); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	return &wsConn{Conn: conn, reader: rw.Reader}, nil
+}
+
+// WriteMessage 写入一个完整的消息，服务端发送的帧不需要掩码
+func (c *wsConn) WriteMessage(opcode byte, data []byte) (err error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	header := make([]byte, 2, 10)
+	header[0] = 0x80 | opcode
+	switch l := len(data); {
+	case l < 126:
+		header[1] = byte(l)
+	case l <= 0xFFFF:
+		header[1] = 126
+		header = binary.BigEndian.AppendUint16(header, uint16(l))
+	default:
+		header[1] = 127
+		header = binary.BigEndian.AppendUint64(header, uint64(l))
+	}
+	buffers := net.Buffers{header, data}
+	_, err = buffers.WriteTo(c.Conn)
+	return
+}
+
+// ReadMessage 读取一个完整的消息，自动处理ping和分片
+// 客户端发送的帧必须有掩码，控制帧不能分片，违反协议时发送1002关闭帧并返回ErrWSProtocol
+func (c *wsConn) ReadMessage() (opcode byte, data []byte, err error) {
+	head := make([]byte, 8)
+	fragmented := false // 已经收到未结束的数据帧，等待后续的continuation帧
+	for {
+		if _, err = io.ReadFull(c.reader, head[:2]); err != nil {
+			return
+		}
+		fin := head[0]&0x80 != 0
+		op := head[0] & 0x0F
+		masked := head[1]&0x80 != 0
+		length := uint64(head[1] & 0x7F)
+		switch length {
+		case 126:
+			if _, err = io.ReadFull(c.reader, head[:2]); err != nil {
+				return
+			}
+			length = uint64(binary.BigEndian.Uint16(head[:2]))
+		case 127:
+			if _, err = io.ReadFull(c.reader, head[:8]); err != nil {
+				return
+			}
+			length = binary.BigEndian.Uint64(head[:8])
+		}
+		if !masked || op >= wsOpClose && (length > wsMaxControlPayload || !fin) ||
+			op == wsOpContinuation && !fragmented || (op == wsOpText || op == wsOpBinary) && fragmented {
+			c.closeWithCode(wsCloseProtocolError)
+			return op, nil, ErrWSProtocol
+		}
+		if length > wsMaxMessageSize || uint64(len(data))+length > wsMaxMessageSize {
+			c.closeWithCode(wsCloseMessageTooBig)
+			return op, nil, ErrWSMessageTooBig
+		}
+		var mask [4]byte
+		if _, err = io.ReadFull(c.reader, mask[:]); err != nil {
+			return
+		}
+		payload := make([]byte, length)
+		if _, err = io.ReadFull(c.reader, payload); err != nil {
+			return
+		}
+		for i := range payload {
+			payload[i] ^= mask[i%4]
+		}
+		switch op {
+		case wsOpPing:
+			if err = c.WriteMessage(wsOpPong, payload); err != nil {
+				return
+			}
+			continue
+		case wsOpPong:
+			continue
+		case wsOpClose:
+			c.WriteMessage(wsOpClose, payload)
+			return op, payload, io.EOF
+		case wsOpContinuation:
+			data = append(data, payload...)
+		default:
+			opcode = op
+			data = payload
+		}
+		if fin {
+			return
+		}
+		fragmented = true
+	}
+}
+
+// 发送关闭帧，调用者随后断开连接
+func (c *wsConn) closeWithCode(code uint16) {
+	c.WriteMessage(wsOpClose, binary.BigEndian.AppendUint16(nil, code))
+}
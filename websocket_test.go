@@ -0,0 +1,165 @@
+package record
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"io"
+	"net"
+	"testing"
+)
+
+// 只记录写入数据的连接，用于检查应答的pong和关闭帧
+type wsTestConn struct {
+	net.Conn
+	out bytes.Buffer
+}
+
+func (c *wsTestConn) Write(b []byte) (int, error) {
+	return c.out.Write(b)
+}
+
+// 客户端发送的帧，mask为false时不带掩码
+func wsTestFrame(fin bool, opcode byte, payload []byte, mask bool) []byte {
+	b := []byte{opcode}
+	if fin {
+		b[0] |= 0x80
+	}
+	var maskBit byte
+	if mask {
+		maskBit = 0x80
+	}
+	switch l := len(payload); {
+	case l < 126:
+		b = append(b, maskBit|byte(l))
+	case l <= 0xFFFF:
+		b = append(b, maskBit|126)
+		b = binary.BigEndian.AppendUint16(b, uint16(l))
+	default:
+		b = append(b, maskBit|127)
+		b = binary.BigEndian.AppendUint64(b, uint64(l))
+	}
+	if !mask {
+		return append(b, payload...)
+	}
+	key := [4]byte{0x12, 0x34, 0x56, 0x78}
+	b = append(b, key[:]...)
+	for i, c := range payload {
+		b = append(b, c^key[i%4])
+	}
+	return b
+}
+
+func TestWSReadMessage(t *testing.T) {
+	join := func(frames ...[]byte) []byte {
+		return bytes.Join(frames, nil)
+	}
+	tests := []struct {
+		name   string
+		input  []byte
+		opcode byte
+		data   string
+		err    error
+		reply  []byte // 服务端应答的帧，nil表示不检查
+	}{
+		{
+			name:   "text",
+			input:  wsTestFrame(true, wsOpText, []byte(`{"action":"pause"}`), true),
+			opcode: wsOpText,
+			data:   `{"action":"pause"}`,
+		},
+		{
+			name:   "extended length",
+			input:  wsTestFrame(true, wsOpBinary, bytes.Repeat([]byte{'a'}, 300), true),
+			opcode: wsOpBinary,
+			data:   string(bytes.Repeat([]byte{'a'}, 300)),
+		},
+		{
+			name: "fragmented with ping between",
+			input: join(
+				wsTestFrame(false, wsOpText, []byte("hel"), true),
+				wsTestFrame(true, wsOpPing, []byte("p"), true),
+				wsTestFrame(true, wsOpContinuation, []byte("lo"), true),
+			),
+			opcode: wsOpText,
+			data:   "hello",
+			reply:  []byte{0x80 | wsOpPong, 1, 'p'},
+		},
+		{
+			name:   "close",
+			input:  wsTestFrame(true, wsOpClose, []byte{0x03, 0xE8}, true),
+			opcode: wsOpClose,
+			data:   "\x03\xE8",
+			err:    io.EOF,
+			reply:  []byte{0x80 | wsOpClose, 2, 0x03, 0xE8},
+		},
+		{
+			name:  "unmasked",
+			input: wsTestFrame(true, wsOpText, []byte("hello"), false),
+			err:   ErrWSProtocol,
+			reply: []byte{0x80 | wsOpClose, 2, 0x03, 0xEA},
+		},
+		{
+			name:  "fragmented ping",
+			input: wsTestFrame(false, wsOpPing, []byte("p"), true),
+			err:   ErrWSProtocol,
+			reply: []byte{0x80 | wsOpClose, 2, 0x03, 0xEA},
+		},
+		{
+			name:  "control payload too long",
+			input: wsTestFrame(true, wsOpPing, bytes.Repeat([]byte{'p'}, 126), true),
+			err:   ErrWSProtocol,
+		},
+		{
+			name:  "continuation without start",
+			input: wsTestFrame(true, wsOpContinuation, []byte("lo"), true),
+			err:   ErrWSProtocol,
+		},
+		{
+			name: "new message inside fragments",
+			input: join(
+				wsTestFrame(false, wsOpText, []byte("hel"), true),
+				wsTestFrame(true, wsOpText, []byte("lo"), true),
+			),
+			err: ErrWSProtocol,
+		},
+		{
+			name:  "too big",
+			input: wsTestFrame(true, wsOpText, bytes.Repeat([]byte{'a'}, wsMaxMessageSize+1), true),
+			err:   ErrWSMessageTooBig,
+			reply: []byte{0x80 | wsOpClose, 2, 0x03, 0xF1},
+		},
+		{
+			name: "fragments too big",
+			input: join(
+				wsTestFrame(false, wsOpText, bytes.Repeat([]byte{'a'}, wsMaxMessageSize), true),
+				wsTestFrame(true, wsOpContinuation, []byte("a"), true),
+			),
+			err: ErrWSMessageTooBig,
+		},
+		{
+			name:  "truncated",
+			input: wsTestFrame(true, wsOpText, []byte("hello"), true)[:8],
+			err:   io.ErrUnexpectedEOF,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			conn := &wsTestConn{}
+			c := &wsConn{Conn: conn, reader: bufio.NewReader(bytes.NewReader(tt.input))}
+			opcode, data, err := c.ReadMessage()
+			if !errors.Is(err, tt.err) {
+				t.Fatalf("err = %v, want %v", err, tt.err)
+			}
+			if tt.err == nil || tt.err == io.EOF {
+				if opcode != tt.opcode || string(data) != tt.data {
+					t.Errorf("got opcode %d data %q, want %d %q", opcode, data, tt.opcode, tt.data)
+				}
+			}
+			if tt.reply != nil && !bytes.Equal(conn.out.Bytes(), tt.reply) {
+				t.Errorf("reply = % x, want % x", conn.out.Bytes(), tt.reply)
+			}
+		})
+	}
+}